@@ -0,0 +1,100 @@
+package backend
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rabobank/npsb/conf"
+	"github.com/rabobank/npsb/model"
+	"github.com/rabobank/npsb/policyserver"
+)
+
+// The kinds of errors a backend can return, callers check them with errors.Is. They are the same errors as the policy server client returns.
+var (
+	ErrValidation    = policyserver.ErrValidation
+	ErrForbidden     = policyserver.ErrForbidden
+	ErrLimitExceeded = policyserver.ErrLimitExceeded
+	ErrUnavailable   = policyserver.ErrUnavailable
+)
+
+// PolicyBackend - Enforces the network policies between apps, like the CF policy server or kubernetes NetworkPolicies (for Korifi)
+type PolicyBackend interface {
+	// Create - Creates the given network policies, policies that already exist are ignored
+	Create(policies []model.NetworkPolicy) error
+	// Delete - Deletes the given network policies, policies that do not exist are ignored
+	Delete(policies []model.NetworkPolicy) error
+	// List - Returns the network policies that have one of the given apps as source or destination
+	List(appGuids []string) ([]model.NetworkPolicy, error)
+}
+
+var current PolicyBackend
+
+// Init - Initializes the backend that is configured with POLICY_BACKEND
+func Init() error {
+	switch conf.PolicyBackend {
+	case conf.PolicyBackendPolicyServer:
+		current = policyServerBackend{}
+	case conf.PolicyBackendKubernetes:
+		kubeClient, err := NewKubeRestClient(conf.KubeApiURL, conf.KubeTokenFile, conf.KubeCaFile)
+		if err != nil {
+			return fmt.Errorf("failed to initialize the kubernetes policy backend: %s", err)
+		}
+		current = NewKubernetesBackend(kubeClient, SpaceNamespace)
+	case conf.PolicyBackendFile:
+		fileBackend, err := NewFileBackend(conf.PolicyFile, conf.PolicyFileFormat)
+		if err != nil {
+			return fmt.Errorf("failed to initialize the file policy backend: %s", err)
+		}
+		current = fileBackend
+	default:
+		return fmt.Errorf("unknown policy backend %s", conf.PolicyBackend)
+	}
+	fmt.Printf("using policy backend %s\n", conf.PolicyBackend)
+	return nil
+}
+
+// Set - Replaces the current backend, i.e. with one that uses a fake kubernetes client
+func Set(backend PolicyBackend) {
+	current = backend
+}
+
+// WithDeadline - Returns the current backend, with requests (and their retries) that give up at the deadline. The synchronous broker requests use it so they are answered before
+// the broker timeout of the CC. Only the policy server retries, the other backends are returned as they are.
+func WithDeadline(deadline time.Time) PolicyBackend {
+	if _, isPolicyServer := current.(policyServerBackend); isPolicyServer {
+		return policyServerBackend{deadline: deadline}
+	}
+	return current
+}
+
+// Create - Creates the given network policies with the current backend
+func Create(policies []model.NetworkPolicy) error {
+	return current.Create(policies)
+}
+
+// Delete - Deletes the given network policies with the current backend
+func Delete(policies []model.NetworkPolicy) error {
+	return current.Delete(policies)
+}
+
+// List - Returns the network policies of the given apps from the current backend
+func List(appGuids []string) ([]model.NetworkPolicy, error) {
+	return current.List(appGuids)
+}
+
+// policyServerBackend - The CF policy server (the default backend), if deadline is not zero the requests give up at the deadline
+type policyServerBackend struct {
+	deadline time.Time
+}
+
+func (b policyServerBackend) Create(policies []model.NetworkPolicy) error {
+	return policyserver.Create(b.deadline, policies)
+}
+
+func (b policyServerBackend) Delete(policies []model.NetworkPolicy) error {
+	return policyserver.Delete(b.deadline, policies)
+}
+
+func (b policyServerBackend) List(appGuids []string) ([]model.NetworkPolicy, error) {
+	return policyserver.List(b.deadline, appGuids)
+}
@@ -0,0 +1,180 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rabobank/npsb/conf"
+	"github.com/rabobank/npsb/model"
+	"gopkg.in/yaml.v3"
+)
+
+// fileBackend - Does not apply the network policies, but writes the policy set to a file (or a directory with a file per destination app), so it can be reviewed, checked into git and diffed between runs.
+// The files are deterministic, the policies are sorted by source, destination, ports and protocol. The format is the same as the body of the policy server api ({"policies": [...]}).
+type fileBackend struct {
+	path      string
+	format    string
+	directory bool
+	policies  map[string]model.NetworkPolicy
+	mutex     sync.Mutex
+}
+
+// NewFileBackend - Creates a file backend and loads the policies that were written before. If path is a directory (or ends with a /), there is a file per destination app in it.
+func NewFileBackend(path string, format string) (PolicyBackend, error) {
+	b := &fileBackend{path: path, format: format, policies: make(map[string]model.NetworkPolicy)}
+	if info, err := os.Stat(path); (err == nil && info.IsDir()) || strings.HasSuffix(path, "/") {
+		b.directory = true
+		if err = os.MkdirAll(path, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create policy directory %s: %s", path, err)
+		}
+	}
+	files := []string{path}
+	if b.directory {
+		var err error
+		if files, err = filepath.Glob(filepath.Join(path, "*."+format)); err != nil {
+			return nil, fmt.Errorf("failed to list policy files in %s: %s", path, err)
+		}
+	}
+	for _, file := range files {
+		policies, err := b.read(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, policy := range policies {
+			b.policies[policy.Key()] = policy
+		}
+	}
+	fmt.Printf("loaded %d network policies from %s\n", len(b.policies), path)
+	return b, nil
+}
+
+func (b *fileBackend) Create(policies []model.NetworkPolicy) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, policy := range policies {
+		b.policies[policy.Key()] = policy
+	}
+	return b.write()
+}
+
+func (b *fileBackend) Delete(policies []model.NetworkPolicy) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, policy := range policies {
+		delete(b.policies, policy.Key())
+	}
+	return b.write()
+}
+
+func (b *fileBackend) List(appGuids []string) ([]model.NetworkPolicy, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	apps := make(map[string]bool, len(appGuids))
+	for _, appGuid := range appGuids {
+		apps[appGuid] = true
+	}
+	policies := make([]model.NetworkPolicy, 0)
+	for _, policy := range b.sorted() {
+		if apps[policy.Source.Id] || apps[policy.Destination.Id] {
+			policies = append(policies, policy)
+		}
+	}
+	return policies, nil
+}
+
+// sorted - Returns the policies sorted by key, the caller should hold the mutex
+func (b *fileBackend) sorted() []model.NetworkPolicy {
+	policies := make([]model.NetworkPolicy, 0, len(b.policies))
+	for _, policy := range b.policies {
+		policies = append(policies, policy)
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Key() < policies[j].Key() })
+	return policies
+}
+
+// write - Writes the policy file, or in directory mode a file per destination app and removes the files of destination apps without policies. The caller should hold the mutex.
+func (b *fileBackend) write() error {
+	if !b.directory {
+		return b.writeFile(b.path, b.sorted())
+	}
+	byDestination := make(map[string][]model.NetworkPolicy)
+	for _, policy := range b.sorted() {
+		byDestination[policy.Destination.Id] = append(byDestination[policy.Destination.Id], policy)
+	}
+	for destination, policies := range byDestination {
+		if err := b.writeFile(filepath.Join(b.path, destination+"."+b.format), policies); err != nil {
+			return err
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(b.path, "*."+b.format))
+	if err != nil {
+		return fmt.Errorf("failed to list policy files in %s: %s", b.path, err)
+	}
+	for _, file := range files {
+		if _, found := byDestination[strings.TrimSuffix(filepath.Base(file), "."+b.format)]; !found {
+			if err = os.Remove(file); err != nil {
+				return fmt.Errorf("failed to remove policy file %s: %s", file, err)
+			}
+		}
+	}
+	return nil
+}
+
+// writeFile - Writes the policies to a temporary file and renames it, so we never end up with a half written file
+func (b *fileBackend) writeFile(path string, policies []model.NetworkPolicy) error {
+	var data []byte
+	var err error
+	if b.format == conf.PolicyFileFormatYaml {
+		data, err = yaml.Marshal(model.NetworkPolicies{Policies: policies})
+	} else {
+		data, err = json.MarshalIndent(model.NetworkPolicies{Policies: policies}, "", "  ")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to marshal network policies: %s", err)
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary policy file: %s", err)
+	}
+	if _, err = tmpFile.Write(data); err != nil {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+		return fmt.Errorf("failed to write temporary policy file %s: %s", tmpFile.Name(), err)
+	}
+	_ = tmpFile.Close()
+	if err = os.Rename(tmpFile.Name(), path); err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return fmt.Errorf("failed to rename %s to policy file %s: %s", tmpFile.Name(), path, err)
+	}
+	if conf.Debug {
+		fmt.Printf("wrote %d network policies to %s\n", len(policies), path)
+	}
+	return nil
+}
+
+// read - Reads the policies from a policy file, a file that does not exist has no policies
+func (b *fileBackend) read(path string) ([]model.NetworkPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read policy file %s: %s", path, err)
+	}
+	policies := model.NetworkPolicies{}
+	if b.format == conf.PolicyFileFormatYaml {
+		err = yaml.Unmarshal(data, &policies)
+	} else {
+		err = json.Unmarshal(data, &policies)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse policy file %s: %s", path, err)
+	}
+	return policies.Policies, nil
+}
@@ -0,0 +1,153 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rabobank/npsb/conf"
+	"github.com/rabobank/npsb/model"
+)
+
+// kubeRestClient - A KubeClient that talks to the kubernetes api with a (service account) bearer token
+type kubeRestClient struct {
+	apiURL     string
+	tokenFile  string
+	httpClient *http.Client
+}
+
+// NewKubeRestClient - Creates a KubeClient for the given api url, the token is read from tokenFile for every request (service account tokens are rotated).
+// The api certificate is verified with caFile if it exists.
+func NewKubeRestClient(apiURL string, tokenFile string, caFile string) (KubeClient, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if conf.SkipSslValidation {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	} else if caCert, err := os.ReadFile(caFile); err == nil {
+		certPool := x509.NewCertPool()
+		if !certPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: certPool}
+	}
+	if _, err := os.Stat(tokenFile); err != nil {
+		return nil, fmt.Errorf("kubernetes token file %s not readable: %s", tokenFile, err)
+	}
+	return &kubeRestClient{apiURL: strings.TrimSuffix(apiURL, "/"), tokenFile: tokenFile, httpClient: &http.Client{Transport: transport, Timeout: conf.PolicyServerTimeout}}, nil
+}
+
+func (c *kubeRestClient) Apply(policy model.KubeNetworkPolicy) error {
+	body, err := json.Marshal(policy)
+	if err != nil {
+		return fmt.Errorf("failed to marshal NetworkPolicy to json: %s", err)
+	}
+	// json is valid yaml, so it can be used for a server side apply
+	path := fmt.Sprintf("/apis/networking.k8s.io/v1/namespaces/%s/networkpolicies/%s?fieldManager=%s&force=true", policy.Metadata.Namespace, policy.Metadata.Name, conf.KubeFieldManager)
+	_, err = c.do(http.MethodPatch, path, "application/apply-patch+yaml", body)
+	return err
+}
+
+func (c *kubeRestClient) Delete(namespace string, name string) error {
+	_, err := c.do(http.MethodDelete, fmt.Sprintf("/apis/networking.k8s.io/v1/namespaces/%s/networkpolicies/%s", namespace, name), "", nil)
+	if statusCode(err) == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+func (c *kubeRestClient) List(labelSelector string) ([]model.KubeNetworkPolicy, error) {
+	body, err := c.do(http.MethodGet, "/apis/networking.k8s.io/v1/networkpolicies?labelSelector="+url.QueryEscape(labelSelector), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	list := model.KubeNetworkPolicyList{}
+	if err = json.Unmarshal(body, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse NetworkPolicy list: %s", err)
+	}
+	return list.Items, nil
+}
+
+// kubeError - A failed kubernetes api request, it wraps one of the Err* errors
+type kubeError struct {
+	kind       error
+	statusCode int
+	message    string
+}
+
+func (e *kubeError) Error() string {
+	return fmt.Sprintf("%s (response code %d): %s", e.kind, e.statusCode, e.message)
+}
+
+func (e *kubeError) Unwrap() error {
+	return e.kind
+}
+
+func statusCode(err error) int {
+	var kubeErr *kubeError
+	if errors.As(err, &kubeErr) {
+		return kubeErr.statusCode
+	}
+	return 0
+}
+
+func (c *kubeRestClient) do(method string, path string, contentType string, body []byte) ([]byte, error) {
+	token, err := os.ReadFile(c.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read kubernetes token: %s", ErrUnavailable, err)
+	}
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequest(method, c.apiURL+path, bodyReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request for kubernetes api: %s", err)
+	}
+	request.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	request.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	startTime := time.Now()
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUnavailable, err)
+	}
+	defer func() { _ = response.Body.Close() }()
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to read response: %s", ErrUnavailable, err)
+	}
+	if conf.Debug {
+		fmt.Printf("response in %d ms from %s %s: Status code: %v\n", time.Since(startTime).Milliseconds(), method, path, response.Status)
+	}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		status := model.KubeStatus{}
+		message := string(responseBody)
+		if err = json.Unmarshal(responseBody, &status); err == nil && status.Message != "" {
+			message = status.Message
+		}
+		return nil, &kubeError{kind: kubeErrorKind(response.StatusCode), statusCode: response.StatusCode, message: message}
+	}
+	return responseBody, nil
+}
+
+// kubeErrorKind - Maps the response code of the kubernetes api to one of the Err* errors
+func kubeErrorKind(statusCode int) error {
+	switch {
+	case statusCode == http.StatusTooManyRequests || statusCode >= 500:
+		return ErrUnavailable
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ErrForbidden
+	default:
+		return ErrValidation
+	}
+}
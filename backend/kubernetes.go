@@ -0,0 +1,167 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/rabobank/npsb/conf"
+	"github.com/rabobank/npsb/model"
+)
+
+// KubeClient - The kubernetes api calls the kubernetes backend needs, so it can be tested with a fake client
+type KubeClient interface {
+	// Apply - Creates or updates the given NetworkPolicy (server side apply)
+	Apply(policy model.KubeNetworkPolicy) error
+	// Delete - Deletes the NetworkPolicy, a policy that does not exist is not an error
+	Delete(namespace string, name string) error
+	// List - Returns the NetworkPolicies in all namespaces that match the label selector
+	List(labelSelector string) ([]model.KubeNetworkPolicy, error)
+}
+
+// kubernetesBackend - Renders every network policy as a networking.k8s.io/v1 NetworkPolicy in the namespace of the destination app, that allows ingress from the pods of the source app.
+// The pods are selected by their app guid label (korifi.cloudfoundry.org/app-guid).
+type kubernetesBackend struct {
+	client    KubeClient
+	namespace func(appGuid string) (string, error)
+}
+
+// NewKubernetesBackend - Creates a kubernetes backend, namespace returns the namespace of the pods of an app
+func NewKubernetesBackend(client KubeClient, namespace func(appGuid string) (string, error)) PolicyBackend {
+	return &kubernetesBackend{client: client, namespace: namespace}
+}
+
+var spaceNamespaces = make(map[string]string)
+var spaceNamespacesMutex sync.Mutex
+
+// SpaceNamespace - Returns the namespace of the pods of the given app, Korifi uses the space guid as the name of the namespace of the space
+func SpaceNamespace(appGuid string) (string, error) {
+	spaceNamespacesMutex.Lock()
+	defer spaceNamespacesMutex.Unlock()
+	if namespace, found := spaceNamespaces[appGuid]; found {
+		return namespace, nil
+	}
+	app, err := conf.CfClient.Applications.Get(conf.CfCtx, appGuid)
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to get app %s: %s", ErrUnavailable, appGuid, err)
+	}
+	spaceNamespaces[appGuid] = app.Relationships.Space.Data.GUID
+	return app.Relationships.Space.Data.GUID, nil
+}
+
+func (b *kubernetesBackend) Create(policies []model.NetworkPolicy) error {
+	for _, policy := range policies {
+		kubePolicy, err := b.render(policy)
+		if err != nil {
+			return err
+		}
+		if err = b.client.Apply(kubePolicy); err != nil {
+			return err
+		}
+		if conf.Debug {
+			fmt.Printf("applied NetworkPolicy %s/%s for %s\n", kubePolicy.Metadata.Namespace, kubePolicy.Metadata.Name, policy.Key())
+		}
+	}
+	fmt.Printf("applied %d NetworkPolicies\n", len(policies))
+	return nil
+}
+
+func (b *kubernetesBackend) Delete(policies []model.NetworkPolicy) error {
+	for _, policy := range policies {
+		namespace, err := b.namespace(policy.Destination.Id)
+		if err != nil {
+			return err
+		}
+		if err = b.client.Delete(namespace, KubePolicyName(policy)); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("deleted %d NetworkPolicies\n", len(policies))
+	return nil
+}
+
+// List - Queries the NetworkPolicies by their source and destination app labels, in batches of conf.PolicyServerQueryBatchSize apps
+func (b *kubernetesBackend) List(appGuids []string) ([]model.NetworkPolicy, error) {
+	policies := make([]model.NetworkPolicy, 0)
+	seen := make(map[string]bool)
+	for i := 0; i < len(appGuids); i += conf.PolicyServerQueryBatchSize {
+		end := min(i+conf.PolicyServerQueryBatchSize, len(appGuids))
+		apps := strings.Join(appGuids[i:end], ",")
+		for _, labelName := range []string{conf.KubeLabelSourceApp, conf.KubeLabelDestinationApp} {
+			kubePolicies, err := b.client.List(fmt.Sprintf("%s=%s,%s in (%s)", conf.KubeLabelManagedBy, conf.KubeFieldManager, labelName, apps))
+			if err != nil {
+				return nil, err
+			}
+			for _, kubePolicy := range kubePolicies {
+				if policy, ok := ParseKubePolicy(kubePolicy); ok && !seen[policy.Key()] {
+					seen[policy.Key()] = true
+					policies = append(policies, policy)
+				}
+			}
+		}
+	}
+	if conf.Debug {
+		fmt.Printf("found %d existing NetworkPolicies for %d apps\n", len(policies), len(appGuids))
+	}
+	return policies, nil
+}
+
+func (b *kubernetesBackend) render(policy model.NetworkPolicy) (model.KubeNetworkPolicy, error) {
+	namespace, err := b.namespace(policy.Destination.Id)
+	if err != nil {
+		return model.KubeNetworkPolicy{}, err
+	}
+	return RenderKubePolicy(policy, namespace), nil
+}
+
+// KubePolicyName - The name of the NetworkPolicy for a network policy, derived from the policy key so it is the same every time
+func KubePolicyName(policy model.NetworkPolicy) string {
+	hash := sha256.Sum256([]byte(policy.Key()))
+	return conf.KubePolicyNamePrefix + hex.EncodeToString(hash[:])[:20]
+}
+
+// RenderKubePolicy - Renders the network policy as a NetworkPolicy in the given namespace
+func RenderKubePolicy(policy model.NetworkPolicy, namespace string) model.KubeNetworkPolicy {
+	port := model.KubeNetworkPolicyPort{Protocol: strings.ToUpper(policy.Destination.Protocol), Port: policy.Destination.Ports.Start}
+	if policy.Destination.Ports.End > policy.Destination.Ports.Start {
+		port.EndPort = policy.Destination.Ports.End
+	}
+	return model.KubeNetworkPolicy{
+		ApiVersion: "networking.k8s.io/v1",
+		Kind:       "NetworkPolicy",
+		Metadata: model.KubeObjectMeta{
+			Name:      KubePolicyName(policy),
+			Namespace: namespace,
+			Labels:    map[string]string{conf.KubeLabelManagedBy: conf.KubeFieldManager, conf.KubeLabelSourceApp: policy.Source.Id, conf.KubeLabelDestinationApp: policy.Destination.Id},
+		},
+		Spec: model.KubeNetworkPolicySpec{
+			PodSelector: model.KubeLabelSelector{MatchLabels: map[string]string{conf.KubeLabelAppGuid: policy.Destination.Id}},
+			PolicyTypes: []string{"Ingress"},
+			Ingress: []model.KubeNetworkPolicyIngressRule{{
+				// the source app can be in any namespace (space)
+				From:  []model.KubeNetworkPolicyPeer{{PodSelector: &model.KubeLabelSelector{MatchLabels: map[string]string{conf.KubeLabelAppGuid: policy.Source.Id}}, NamespaceSelector: &model.KubeLabelSelector{}}},
+				Ports: []model.KubeNetworkPolicyPort{port},
+			}},
+		},
+	}
+}
+
+// ParseKubePolicy - Converts a NetworkPolicy rendered by RenderKubePolicy back to a network policy, returns false if it does not have the expected form
+func ParseKubePolicy(kubePolicy model.KubeNetworkPolicy) (model.NetworkPolicy, bool) {
+	destination := kubePolicy.Spec.PodSelector.MatchLabels[conf.KubeLabelAppGuid]
+	if destination == "" || len(kubePolicy.Spec.Ingress) != 1 || len(kubePolicy.Spec.Ingress[0].From) != 1 || len(kubePolicy.Spec.Ingress[0].Ports) != 1 || kubePolicy.Spec.Ingress[0].From[0].PodSelector == nil {
+		return model.NetworkPolicy{}, false
+	}
+	source := kubePolicy.Spec.Ingress[0].From[0].PodSelector.MatchLabels[conf.KubeLabelAppGuid]
+	if source == "" {
+		return model.NetworkPolicy{}, false
+	}
+	port := kubePolicy.Spec.Ingress[0].Ports[0]
+	ports := model.Ports{Start: port.Port, End: port.Port}
+	if port.EndPort > port.Port {
+		ports.End = port.EndPort
+	}
+	return model.NetworkPolicy{Source: model.Source{Id: source}, Destination: model.Destination{Id: destination, Protocol: strings.ToLower(port.Protocol), Ports: ports}}, true
+}
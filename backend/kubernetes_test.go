@@ -0,0 +1,339 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cloudfoundry/go-cfclient/v3/client"
+	"github.com/rabobank/npsb/conf"
+	"github.com/rabobank/npsb/model"
+)
+
+const (
+	testToken          = "test-token"
+	networkPolicyApi   = "/apis/networking.k8s.io/v1/"
+	applyPatchMimeType = "application/apply-patch+yaml"
+)
+
+// fakeKubeApi - Mimics the NetworkPolicy part of the kubernetes api, the NetworkPolicies are kept by namespace/name.
+// If failWith is set, every request is answered with that response code.
+type fakeKubeApi struct {
+	t        *testing.T
+	mutex    sync.Mutex
+	policies map[string]model.KubeNetworkPolicy
+	failWith int
+}
+
+func (api *fakeKubeApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	api.mutex.Lock()
+	defer api.mutex.Unlock()
+	if r.Header.Get("Authorization") != "Bearer "+testToken {
+		writeKubeStatus(w, http.StatusUnauthorized, "Unauthorized", "Unauthorized")
+		return
+	}
+	if api.failWith != 0 {
+		writeKubeStatus(w, api.failWith, "Injected", fmt.Sprintf("injected failure %d", api.failWith))
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Path == networkPolicyApi+"networkpolicies" {
+		labelSelector, err := model.ParseLabelSelector(r.URL.Query().Get("labelSelector"))
+		if err != nil {
+			api.t.Errorf("unexpected label selector: %s", err)
+			writeKubeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+		list := model.KubeNetworkPolicyList{Items: make([]model.KubeNetworkPolicy, 0)}
+		for _, policy := range api.policies {
+			if matchesSelector(policy.Metadata.Labels, labelSelector) {
+				list.Items = append(list.Items, policy)
+			}
+		}
+		writeJson(w, http.StatusOK, list)
+		return
+	}
+	// /apis/networking.k8s.io/v1/namespaces/<namespace>/networkpolicies/<name>
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, networkPolicyApi+"namespaces/"), "/")
+	if !strings.HasPrefix(r.URL.Path, networkPolicyApi+"namespaces/") || len(parts) != 3 || parts[1] != "networkpolicies" {
+		writeKubeStatus(w, http.StatusNotFound, "NotFound", "the server could not find the requested resource")
+		return
+	}
+	key := parts[0] + "/" + parts[2]
+	switch r.Method {
+	case http.MethodPatch:
+		if r.Header.Get("Content-Type") != applyPatchMimeType || r.URL.Query().Get("fieldManager") != conf.KubeFieldManager || r.URL.Query().Get("force") != "true" {
+			api.t.Errorf("unexpected apply request: content type %s, query %s", r.Header.Get("Content-Type"), r.URL.RawQuery)
+			writeKubeStatus(w, http.StatusUnsupportedMediaType, "UnsupportedMediaType", "not a server side apply")
+			return
+		}
+		policy := model.KubeNetworkPolicy{}
+		if err := json.NewDecoder(r.Body).Decode(&policy); err != nil {
+			writeKubeStatus(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+		if policy.Metadata.Namespace+"/"+policy.Metadata.Name != key {
+			writeKubeStatus(w, http.StatusBadRequest, "BadRequest", "the name of the object does not match the name in the url")
+			return
+		}
+		api.policies[key] = policy
+		writeJson(w, http.StatusOK, policy)
+	case http.MethodDelete:
+		if _, found := api.policies[key]; !found {
+			writeKubeStatus(w, http.StatusNotFound, "NotFound", fmt.Sprintf("networkpolicies \"%s\" not found", parts[2]))
+			return
+		}
+		delete(api.policies, key)
+		writeKubeStatus(w, http.StatusOK, "", "")
+	default:
+		writeKubeStatus(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "method not allowed")
+	}
+}
+
+func writeJson(w http.ResponseWriter, statusCode int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeKubeStatus(w http.ResponseWriter, statusCode int, reason string, message string) {
+	writeJson(w, statusCode, model.KubeStatus{Message: message, Reason: reason, Code: statusCode})
+}
+
+// matchesSelector - Returns true if the labels match all requirements of the (parsed) label selector
+func matchesSelector(labels map[string]string, labelSelector client.LabelSelector) bool {
+	for key, filter := range labelSelector {
+		value, found := labels[key]
+		if matches := found && (len(filter.Values) == 0 || slices.Contains(filter.Values, value)); matches == filter.Not {
+			return false
+		}
+	}
+	return true
+}
+
+// newTestKubeClient - Starts a fake kubernetes api and returns a kubeRestClient that talks to it
+func newTestKubeClient(t *testing.T) (*fakeKubeApi, KubeClient) {
+	api := &fakeKubeApi{t: t, policies: make(map[string]model.KubeNetworkPolicy)}
+	server := httptest.NewServer(api)
+	t.Cleanup(server.Close)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte(testToken+"\n"), 0600); err != nil {
+		t.Fatalf("failed to write token file: %s", err)
+	}
+	client, err := NewKubeRestClient(server.URL+"/", tokenFile, filepath.Join(t.TempDir(), "ca.crt"))
+	if err != nil {
+		t.Fatalf("failed to create kubernetes client: %s", err)
+	}
+	return api, client
+}
+
+func testNamespace(appGuid string) (string, error) {
+	return "space-of-" + appGuid, nil
+}
+
+func testPolicies() []model.NetworkPolicy {
+	return []model.NetworkPolicy{
+		{Source: model.Source{Id: "app-a"}, Destination: model.Destination{Id: "app-b", Protocol: conf.LabelValueProtocolTCP, Ports: model.Ports{Start: 8080, End: 8080}}},
+		{Source: model.Source{Id: "app-a"}, Destination: model.Destination{Id: "app-c", Protocol: conf.LabelValueProtocolUDP, Ports: model.Ports{Start: 9000, End: 9100}}},
+		{Source: model.Source{Id: "app-d"}, Destination: model.Destination{Id: "app-e", Protocol: conf.LabelValueProtocolTCP, Ports: model.Ports{Start: 8443, End: 8443}}},
+	}
+}
+
+func sortedKeys(policies []model.NetworkPolicy) []string {
+	keys := make([]string, 0, len(policies))
+	for _, policy := range policies {
+		keys = append(keys, policy.Key())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestRenderAndParseKubePolicy(t *testing.T) {
+	for _, policy := range testPolicies() {
+		kubePolicy := RenderKubePolicy(policy, "space-1")
+		if kubePolicy.Metadata.Namespace != "space-1" || kubePolicy.Metadata.Name != KubePolicyName(policy) {
+			t.Errorf("policy %s rendered as %s/%s", policy.Key(), kubePolicy.Metadata.Namespace, kubePolicy.Metadata.Name)
+		}
+		port := kubePolicy.Spec.Ingress[0].Ports[0]
+		if policy.Destination.Ports.End > policy.Destination.Ports.Start && port.EndPort != policy.Destination.Ports.End {
+			t.Errorf("port range of policy %s rendered with endPort %d", policy.Key(), port.EndPort)
+		}
+		if policy.Destination.Ports.End == policy.Destination.Ports.Start && port.EndPort != 0 {
+			t.Errorf("single port of policy %s rendered with endPort %d", policy.Key(), port.EndPort)
+		}
+		parsed, ok := ParseKubePolicy(kubePolicy)
+		if !ok {
+			t.Fatalf("failed to parse the NetworkPolicy of policy %s", policy.Key())
+		}
+		if !reflect.DeepEqual(parsed, policy) {
+			t.Errorf("policy %s parsed as %s", policy.Key(), parsed.Key())
+		}
+	}
+}
+
+func TestParseKubePolicyRejectsForeignPolicies(t *testing.T) {
+	kubePolicy := RenderKubePolicy(testPolicies()[0], "space-1")
+	kubePolicy.Spec.Ingress[0].From = append(kubePolicy.Spec.Ingress[0].From, model.KubeNetworkPolicyPeer{})
+	if _, ok := ParseKubePolicy(kubePolicy); ok {
+		t.Errorf("a NetworkPolicy with two peers should not be parsed")
+	}
+	if _, ok := ParseKubePolicy(model.KubeNetworkPolicy{}); ok {
+		t.Errorf("an empty NetworkPolicy should not be parsed")
+	}
+}
+
+func TestKubeRestClient(t *testing.T) {
+	api, client := newTestKubeClient(t)
+	kubePolicy := RenderKubePolicy(testPolicies()[1], "space-1")
+
+	if err := client.Apply(kubePolicy); err != nil {
+		t.Fatalf("failed to apply NetworkPolicy: %s", err)
+	}
+	// the body of the apply is the complete NetworkPolicy, so it survives the json of the kubernetes api
+	stored, found := api.policies["space-1/"+kubePolicy.Metadata.Name]
+	if !found {
+		t.Fatalf("NetworkPolicy %s was not applied in namespace space-1", kubePolicy.Metadata.Name)
+	}
+	if !reflect.DeepEqual(stored, kubePolicy) {
+		t.Errorf("NetworkPolicy applied as %+v, expected %+v", stored, kubePolicy)
+	}
+	// applying it again is an update, not a conflict
+	if err := client.Apply(kubePolicy); err != nil {
+		t.Fatalf("failed to apply NetworkPolicy again: %s", err)
+	}
+
+	listed, err := client.List(fmt.Sprintf("%s=%s,%s in (app-x,app-a)", conf.KubeLabelManagedBy, conf.KubeFieldManager, conf.KubeLabelSourceApp))
+	if err != nil || len(listed) != 1 || !reflect.DeepEqual(listed[0], kubePolicy) {
+		t.Errorf("expected NetworkPolicy %s to be listed, got %d policies (error: %v)", kubePolicy.Metadata.Name, len(listed), err)
+	}
+	if listed, err = client.List(fmt.Sprintf("%s in (app-x)", conf.KubeLabelSourceApp)); err != nil || len(listed) != 0 {
+		t.Errorf("expected no NetworkPolicies for app-x, got %d (error: %v)", len(listed), err)
+	}
+
+	if err = client.Delete("space-1", kubePolicy.Metadata.Name); err != nil {
+		t.Fatalf("failed to delete NetworkPolicy: %s", err)
+	}
+	if len(api.policies) != 0 {
+		t.Errorf("expected no NetworkPolicies after delete, got %d", len(api.policies))
+	}
+	// the api answers 404 for a NetworkPolicy that does not exist, that is not an error
+	if err = client.Delete("space-1", kubePolicy.Metadata.Name); err != nil {
+		t.Errorf("failed to delete a NetworkPolicy that does not exist: %s", err)
+	}
+}
+
+func TestKubeRestClientErrors(t *testing.T) {
+	api, client := newTestKubeClient(t)
+	kubePolicy := RenderKubePolicy(testPolicies()[0], "space-1")
+	for _, test := range []struct {
+		statusCode int
+		kind       error
+	}{
+		{http.StatusConflict, ErrValidation},
+		{http.StatusUnprocessableEntity, ErrValidation},
+		{http.StatusNotFound, ErrValidation},
+		{http.StatusForbidden, ErrForbidden},
+		{http.StatusUnauthorized, ErrForbidden},
+		{http.StatusTooManyRequests, ErrUnavailable},
+		{http.StatusServiceUnavailable, ErrUnavailable},
+	} {
+		api.failWith = test.statusCode
+		err := client.Apply(kubePolicy)
+		if !errors.Is(err, test.kind) || statusCode(err) != test.statusCode {
+			t.Errorf("apply answered with %d: expected %s, got %v", test.statusCode, test.kind, err)
+		}
+		// the message of the kubernetes status is part of the error
+		if err != nil && !strings.Contains(err.Error(), fmt.Sprintf("injected failure %d", test.statusCode)) {
+			t.Errorf("apply answered with %d: expected the status message in %s", test.statusCode, err)
+		}
+		if _, err = client.List(conf.KubeLabelManagedBy + "=" + conf.KubeFieldManager); !errors.Is(err, test.kind) {
+			t.Errorf("list answered with %d: expected %s, got %v", test.statusCode, test.kind, err)
+		}
+	}
+	// a 404 on delete means the NetworkPolicy is gone already, a 409 is an error
+	api.failWith = http.StatusNotFound
+	if err := client.Delete("space-1", kubePolicy.Metadata.Name); err != nil {
+		t.Errorf("delete answered with 404: expected no error, got %s", err)
+	}
+	api.failWith = http.StatusConflict
+	if err := client.Delete("space-1", kubePolicy.Metadata.Name); !errors.Is(err, ErrValidation) {
+		t.Errorf("delete answered with 409: expected %s, got %v", ErrValidation, err)
+	}
+}
+
+func TestNewKubeRestClientWithoutToken(t *testing.T) {
+	if _, err := NewKubeRestClient("https://kubernetes.default", filepath.Join(t.TempDir(), "token"), ""); err == nil {
+		t.Errorf("expected an error for a token file that does not exist")
+	}
+}
+
+func TestKubernetesBackend(t *testing.T) {
+	api, client := newTestKubeClient(t)
+	Set(NewKubernetesBackend(client, testNamespace))
+	policies := testPolicies()
+
+	if err := Create(policies); err != nil {
+		t.Fatalf("failed to create policies: %s", err)
+	}
+	if len(api.policies) != len(policies) {
+		t.Fatalf("expected %d NetworkPolicies, got %d", len(policies), len(api.policies))
+	}
+	for _, policy := range policies {
+		if _, found := api.policies["space-of-"+policy.Destination.Id+"/"+KubePolicyName(policy)]; !found {
+			t.Errorf("NetworkPolicy for %s is not in the namespace of the destination app", policy.Key())
+		}
+	}
+	// creating the same policies again does not result in duplicates
+	if err := Create(policies); err != nil {
+		t.Fatalf("failed to create policies again: %s", err)
+	}
+	if len(api.policies) != len(policies) {
+		t.Fatalf("expected %d NetworkPolicies after creating them again, got %d", len(policies), len(api.policies))
+	}
+
+	// app-a is the source of two policies, app-e the destination of one
+	listed, err := List([]string{"app-a", "app-e"})
+	if err != nil {
+		t.Fatalf("failed to list policies: %s", err)
+	}
+	if expected := sortedKeys(policies); !reflect.DeepEqual(sortedKeys(listed), expected) {
+		t.Errorf("expected policies %v, got %v", expected, sortedKeys(listed))
+	}
+	if listed, err = List([]string{"app-c"}); err != nil || len(listed) != 1 || listed[0].Key() != policies[1].Key() {
+		t.Errorf("expected policy %s for app-c, got %v (error: %v)", policies[1].Key(), sortedKeys(listed), err)
+	}
+
+	// the policies that are not created by the broker are ignored
+	foreign := RenderKubePolicy(model.NetworkPolicy{Source: model.Source{Id: "app-x"}, Destination: model.Destination{Id: "app-b", Protocol: conf.LabelValueProtocolTCP, Ports: model.Ports{Start: 80, End: 80}}}, "space-of-app-b")
+	delete(foreign.Metadata.Labels, conf.KubeLabelManagedBy)
+	api.policies[foreign.Metadata.Namespace+"/"+foreign.Metadata.Name] = foreign
+	if listed, err = List([]string{"app-b"}); err != nil || len(listed) != 1 {
+		t.Errorf("expected only the policy created by the broker for app-b, got %v (error: %v)", sortedKeys(listed), err)
+	}
+
+	if err = Delete(policies[:2]); err != nil {
+		t.Fatalf("failed to delete policies: %s", err)
+	}
+	if listed, err = List([]string{"app-a", "app-d"}); err != nil || !reflect.DeepEqual(sortedKeys(listed), sortedKeys(policies[2:])) {
+		t.Errorf("expected policies %v after delete, got %v (error: %v)", sortedKeys(policies[2:]), sortedKeys(listed), err)
+	}
+	// deleting a policy that does not exist is not an error
+	if err = Delete(policies[:1]); err != nil {
+		t.Errorf("failed to delete a policy that does not exist: %s", err)
+	}
+
+	// a failing kubernetes api is reported as unavailable, so the broker can tell the platform to retry
+	api.failWith = http.StatusServiceUnavailable
+	if err = Create(policies); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("expected %s from a failing kubernetes api, got %v", ErrUnavailable, err)
+	}
+}
@@ -7,9 +7,11 @@ import (
 	"github.com/cloudfoundry-community/go-cfenv"
 	"github.com/cloudfoundry/go-cfclient/v3/client"
 	"github.com/cloudfoundry/go-cfclient/v3/config"
+	"net"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rabobank/npsb/model"
 )
@@ -20,9 +22,10 @@ var (
 	Debug      = false
 	CredhubURL = os.Getenv("CREDHUB_URL")
 
-	Catalog          model.Catalog
-	ListenPort       int
-	SyncIntervalSecs int
+	Catalog               model.Catalog
+	ListenPort            int
+	SyncIntervalSecs      int
+	EventPollIntervalSecs int
 
 	ClientId             = os.Getenv("CLIENT_ID")
 	ClientSecret         = os.Getenv("CLIENT_SECRET")
@@ -31,16 +34,40 @@ var (
 	CatalogDir           = os.Getenv("CATALOG_DIR")
 	ListenPortStr        = os.Getenv("LISTEN_PORT")
 	SyncIntervalSecsStr  = os.Getenv("SYNC_INTERVAL_SECS")
+	EventPollIntervalStr = os.Getenv("EVENT_POLL_INTERVAL_SECS")
 	CfApiURL             = os.Getenv("CFAPI_URL")
 	UaaApiURL            = os.Getenv("UAA_URL")
 	SkipSslValidationStr = os.Getenv("SKIP_SSL_VALIDATION")
 	SkipSslValidation    bool
+	SyncDeleteStaleStr   = os.Getenv("SYNC_DELETE_STALE")
+	SyncDeleteStale      bool
+	SyncDryRunStr        = os.Getenv("SYNC_DRY_RUN")
+	SyncDryRun           bool
+	RegistryFile         = os.Getenv("REGISTRY_FILE")
+	InternalDomain       = os.Getenv("INTERNAL_DOMAIN")
+	EgressAllowedCidrStr = os.Getenv("EGRESS_ALLOWED_CIDRS")
+	EgressAllowedCidrs   []*net.IPNet
+	PolicyBackend        = os.Getenv("POLICY_BACKEND")
+	KubeApiURL           = os.Getenv("KUBE_API_URL")
+	KubeTokenFile        = os.Getenv("KUBE_TOKEN_FILE")
+	KubeCaFile           = os.Getenv("KUBE_CA_FILE")
+	PolicyFile           = os.Getenv("POLICY_FILE")
+	PolicyFileFormat     = os.Getenv("POLICY_FILE_FORMAT")
+
+	RefuseReferencedSourceDeleteStr = os.Getenv("REFUSE_REFERENCED_SOURCE_DELETE")
+	RefuseReferencedSourceDelete    bool
+
+	AsyncBindThresholdStr = os.Getenv("ASYNC_BIND_THRESHOLD")
+	AsyncBindThreshold    int
+
+	RegistryMaxAgeSecsStr = os.Getenv("REGISTRY_MAX_AGE_SECS")
+	RegistryMaxAgeSecs    int
 	//CredsPath            = os.Getenv("CREDS_PATH") // something like /brokers/npsb/credentials
 
 	CfClient      *client.Client
 	CfConfig      *config.Config
 	CfCtx         = context.Background()
-	AllLabelNames = []string{LabelNameType, LabelNameName, LabelNameSourceName, LabelNameSourceSpace, LabelNameSourceOrg, LabelNamePort, LabelNameProtocol}
+	AllLabelNames = []string{LabelNameType, LabelNameName, LabelNameSourceName, LabelNameSourceSpace, LabelNameSourceOrg, LabelNamePort, LabelNamePortEnd, LabelNameProtocol, LabelNameEgressSecurityGroup, LabelNameScope, LabelNameAppSelector}
 )
 
 const (
@@ -54,11 +81,77 @@ const (
 	LabelNameSourceSpace  = "npsb.dest.source.space"
 	LabelNameSourceOrg    = "npsb.dest.source.org"
 	LabelNamePort         = "npsb.dest.port"
+	LabelNamePortEnd      = "npsb.dest.port.end"
 	LabelNameProtocol     = "npsb.dest.protocol"
 	LabelValueProtocolTCP = "tcp"
 	LabelValueProtocolUDP = "udp"
+	ProtocolBoth          = "both"
+	AnnotationNamePorts   = "npsb.dest.ports"
 	ActionBind            = "create"
 	ActionUnbind          = "delete"
+
+	LabelNameInternalRoute     = "npsb.dest.internal.route"
+	AnnotationNameInternalHost = "npsb.dest.internal.hostname"
+	LabelNameBindingGuid       = "npsb.binding.guid"
+
+	LabelValueTypeEgress             = "egress"
+	LabelNameEgressSecurityGroup     = "npsb.egress.security.group"
+	AnnotationNameEgressDestinations = "npsb.egress.destinations"
+	AnnotationNameEgressPorts        = "npsb.egress.ports"
+	AnnotationNameEgressProtocol     = "npsb.egress.protocol"
+	EgressSecurityGroupPrefix        = "npsb-egress-"
+	EgressProtocolAll                = "all"
+
+	AnnotationNameSources = "npsb.dest.sources"
+	LabelNameSourcePrefix = "npsb.dest.src."
+	MaxSources            = 50
+	LabelNameScope        = "npsb.source.scope"
+	LabelValueScopeSpace  = "space"
+
+	LabelNameAppSelector      = "npsb.app.selector"
+	AnnotationNameAppSelector = "npsb.app.selector"
+
+	AnnotationNameDanglingSources = "npsb.dest.dangling.sources"
+
+	PolicyBackendPolicyServer = "policyserver"
+	PolicyBackendKubernetes   = "kubernetes"
+	PolicyBackendFile         = "file"
+	PolicyFileFormatJson      = "json"
+	PolicyFileFormatYaml      = "yaml"
+	KubeLabelAppGuid          = "korifi.cloudfoundry.org/app-guid"
+	KubeLabelManagedBy        = "app.kubernetes.io/managed-by"
+	KubeLabelSourceApp        = "npsb.source.app"
+	KubeLabelDestinationApp   = "npsb.dest.app"
+	KubeFieldManager          = "npsb"
+	KubePolicyNamePrefix      = "npsb-"
+
+	EventTypeBindingCreate  = "audit.service_binding.create"
+	EventTypeBindingDelete  = "audit.service_binding.delete"
+	EventTypeInstanceCreate = "audit.service_instance.create"
+	EventTypeInstanceUpdate = "audit.service_instance.update"
+	EventTypeInstanceDelete = "audit.service_instance.delete"
+	EventTypeAppCreate      = "audit.app.create"
+	EventTypeAppDelete      = "audit.app.delete-request"
+	EventTypeAppUpdate      = "audit.app.update"
+
+	OperationStateInProgress = "in progress"
+	OperationStateSucceeded  = "succeeded"
+	OperationStateFailed     = "failed"
+	OperationMaxAttempts     = 10
+	OperationRetryDelay      = 2 * time.Second
+	OperationMaxRetryDelay   = 30 * time.Second
+
+	PolicyServerChunkSize      = 500
+	PolicyServerQueryBatchSize = 100
+	PolicyServerTimeout        = 30 * time.Second
+	PolicyServerMaxAttempts    = 5
+	PolicyServerRetryDelay     = 500 * time.Millisecond
+	PolicyServerMaxRetryDelay  = 10 * time.Second
+	// the time the policy server requests (with their retries) of a synchronous bind, unbind or deprovision may take, so the broker answers before the broker timeout of the CC (60s by default).
+	// A rollback of a failed bind or unbind gets the same time.
+	PolicyServerSyncRequestTime = 20 * time.Second
+
+	BindChunkSize = 50
 )
 
 // EnvironmentComplete - Check for required environment variables and exit if not all are there.
@@ -73,6 +166,45 @@ func EnvironmentComplete() {
 	if CatalogDir == "" {
 		CatalogDir = "./catalog"
 	}
+	if RegistryFile == "" {
+		RegistryFile = "./npsb-registry.json"
+	}
+	if PolicyBackend == "" {
+		PolicyBackend = PolicyBackendPolicyServer
+	}
+	if PolicyBackend != PolicyBackendPolicyServer && PolicyBackend != PolicyBackendKubernetes && PolicyBackend != PolicyBackendFile {
+		fmt.Printf("invalid envvar POLICY_BACKEND: %s, should be %s, %s or %s\n", PolicyBackend, PolicyBackendPolicyServer, PolicyBackendKubernetes, PolicyBackendFile)
+		envComplete = false
+	}
+	if PolicyFile == "" {
+		PolicyFile = "./npsb-policies.json"
+	}
+	if PolicyFileFormat == "" {
+		PolicyFileFormat = PolicyFileFormatJson
+		if strings.HasSuffix(PolicyFile, ".yaml") || strings.HasSuffix(PolicyFile, ".yml") {
+			PolicyFileFormat = PolicyFileFormatYaml
+		}
+	}
+	if PolicyFileFormat != PolicyFileFormatJson && PolicyFileFormat != PolicyFileFormatYaml {
+		fmt.Printf("invalid envvar POLICY_FILE_FORMAT: %s, should be %s or %s\n", PolicyFileFormat, PolicyFileFormatJson, PolicyFileFormatYaml)
+		envComplete = false
+	}
+	if KubeApiURL == "" && os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		KubeApiURL = fmt.Sprintf("https://%s:%s", os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT"))
+	}
+	if KubeTokenFile == "" {
+		KubeTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	}
+	if KubeCaFile == "" {
+		KubeCaFile = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	}
+	if PolicyBackend == PolicyBackendKubernetes && KubeApiURL == "" {
+		fmt.Println("missing envvar: KUBE_API_URL (required for POLICY_BACKEND=kubernetes when not running in a kubernetes pod)")
+		envComplete = false
+	}
+	if InternalDomain == "" {
+		InternalDomain = "apps.internal"
+	}
 	if ListenPortStr == "" {
 		ListenPort = 8080
 	} else {
@@ -84,7 +216,7 @@ func EnvironmentComplete() {
 		}
 	}
 	if SyncIntervalSecsStr == "" {
-		SyncIntervalSecs = 300
+		SyncIntervalSecs = 3600
 	} else {
 		var err error
 		SyncIntervalSecs, err = strconv.Atoi(SyncIntervalSecsStr)
@@ -93,6 +225,28 @@ func EnvironmentComplete() {
 			envComplete = false
 		}
 	}
+	if EventPollIntervalStr == "" {
+		EventPollIntervalSecs = 30
+	} else {
+		var err error
+		EventPollIntervalSecs, err = strconv.Atoi(EventPollIntervalStr)
+		if err != nil {
+			fmt.Printf("failed reading envvar EVENT_POLL_INTERVAL_SECS, err: %s\n", err)
+			envComplete = false
+		}
+	}
+
+	// the CIDRs that egress service instances are allowed to open, if empty no egress instances can be created
+	if EgressAllowedCidrStr != "" {
+		for _, cidr := range strings.Split(EgressAllowedCidrStr, ",") {
+			if _, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr)); err != nil {
+				fmt.Printf("failed reading envvar EGRESS_ALLOWED_CIDRS, err: %s\n", err)
+				envComplete = false
+			} else {
+				EgressAllowedCidrs = append(EgressAllowedCidrs, ipNet)
+			}
+		}
+	}
 
 	app, e := cfenv.Current()
 	if e != nil {
@@ -119,6 +273,39 @@ func EnvironmentComplete() {
 		SkipSslValidation = true
 	}
 
+	if strings.EqualFold(SyncDeleteStaleStr, "true") {
+		SyncDeleteStale = true
+	}
+
+	if strings.EqualFold(SyncDryRunStr, "true") {
+		SyncDryRun = true
+	}
+
+	if strings.EqualFold(RefuseReferencedSourceDeleteStr, "true") {
+		RefuseReferencedSourceDelete = true
+	}
+
+	if AsyncBindThresholdStr == "" {
+		AsyncBindThreshold = 100
+	} else {
+		var err error
+		AsyncBindThreshold, err = strconv.Atoi(AsyncBindThresholdStr)
+		if err != nil {
+			fmt.Printf("failed reading envvar ASYNC_BIND_THRESHOLD, err: %s\n", err)
+			envComplete = false
+		}
+	}
+	if RegistryMaxAgeSecsStr == "" {
+		RegistryMaxAgeSecs = 86400
+	} else {
+		var err error
+		RegistryMaxAgeSecs, err = strconv.Atoi(RegistryMaxAgeSecsStr)
+		if err != nil {
+			fmt.Printf("failed reading envvar REGISTRY_MAX_AGE_SECS, err: %s\n", err)
+			envComplete = false
+		}
+	}
+
 	// try to get the uaa credentials from credhub
 	type VcapService struct {
 		Credentials struct {
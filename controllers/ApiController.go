@@ -11,6 +11,7 @@ import (
 	"github.com/rabobank/npsb/util"
 	"io"
 	"net/http"
+	"strconv"
 )
 
 func GetSources(w http.ResponseWriter, r *http.Request) {
@@ -33,7 +34,11 @@ func GetSources(w http.ResponseWriter, r *http.Request) {
 						space := util.GetSpaceByGuidCached(instance.Relationships.Space.Data.GUID)
 						org := util.GetOrgByGuidCached(space.Relationships.Organization.Data.GUID)
 						desc := instance.Metadata.Annotations[conf.AnnotationNameDesc]
-						sourcesList.SourcesResponses = append(sourcesList.SourcesResponses, model.SourceResponse{Source: *name, Org: org.Name, Space: space.Name, Description: *desc})
+						scope := scopeBinding
+						if util.IsSpaceScoped(instance.Metadata) {
+							scope = conf.LabelValueScopeSpace
+						}
+						sourcesList.SourcesResponses = append(sourcesList.SourcesResponses, model.SourceResponse{Source: *name, Org: org.Name, Space: space.Name, Description: *desc, Scope: scope})
 					}
 				}
 				util.PrintfIfDebug("found %d sources\n", len(sourcesList.SourcesResponses))
@@ -48,6 +53,59 @@ func GetSources(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// TriggerSync - Starts a sync (full, or limited to the group of the given service instance) in the background, only for admins. The result can be queried with GetSyncRuns.
+func TriggerSync(w http.ResponseWriter, r *http.Request) {
+	if ValidateAdminRequest(w, r) {
+		var syncRequest model.SyncRequest
+		if body, err := io.ReadAll(r.Body); err != nil {
+			util.WriteHttpResponse(w, http.StatusBadRequest, fmt.Sprintf("failed to read request body: %s", err))
+			return
+		} else if len(body) > 0 {
+			if err = json.Unmarshal(body, &syncRequest); err != nil {
+				util.WriteHttpResponse(w, http.StatusBadRequest, fmt.Sprintf("failed to parse request body: %s", err))
+				return
+			}
+		}
+		var instanceGuids []string
+		if syncRequest.InstanceGuid != "" {
+			instanceGuids = []string{syncRequest.InstanceGuid}
+		}
+		if runId, started := util.TriggerSync(util.SyncTriggerApi, instanceGuids, syncRequest.DryRun); started {
+			util.WriteHttpResponse(w, http.StatusAccepted, model.SyncResponse{RunId: runId})
+		} else {
+			util.WriteHttpResponse(w, http.StatusConflict, "a sync is already running, try again later")
+		}
+	}
+}
+
+// GetSyncRuns - Returns the last N (query parameter count, default 10) sync runs, only for admins
+func GetSyncRuns(w http.ResponseWriter, r *http.Request) {
+	if ValidateAdminRequest(w, r) {
+		count := 10
+		if countStr := r.URL.Query().Get("count"); countStr != "" {
+			var err error
+			if count, err = strconv.Atoi(countStr); err != nil || count < 1 {
+				util.WriteHttpResponse(w, http.StatusBadRequest, fmt.Sprintf("query parameter count=%s is invalid, should be a positive integer", countStr))
+				return
+			}
+		}
+		util.WriteHttpResponse(w, http.StatusOK, util.GetSyncRuns(count))
+	}
+}
+
+// ValidateAdminRequest - We validate the incoming http request, it should have a valid JWT with the cloud_controller.admin scope
+func ValidateAdminRequest(w http.ResponseWriter, r *http.Request) bool {
+	if token, ok := context.Get(r, "jwt").(jwt.Token); !ok {
+		util.WriteHttpResponse(w, http.StatusBadRequest, "failed to parse access token")
+	} else {
+		if scopes, ok := token.Claims.(jwt.MapClaims)["scope"].([]interface{}); ok && util.Contains(scopes, "cloud_controller.admin") {
+			return true
+		}
+		util.WriteHttpResponse(w, http.StatusForbidden, "this endpoint is only available for admins")
+	}
+	return false
+}
+
 // ValidateRequest - We validate the incoming http request, it should have a valid JWT, there should be a user_id claim in the JWT, the request body should be json-parse-able and the user should be authorized for the requested space.
 func ValidateRequest(w http.ResponseWriter, r *http.Request) (bool, string, model.GenericRequest) {
 	var userId string
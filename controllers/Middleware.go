@@ -2,11 +2,13 @@ package controllers
 
 import (
 	"crypto/rsa"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/rabobank/npsb/model"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt"
@@ -15,7 +17,7 @@ import (
 	"github.com/rabobank/npsb/util"
 )
 
-//const IdentityHeader = "X-Broker-Api-Originating-Identity"
+const IdentityHeader = "X-Broker-Api-Originating-Identity"
 
 func BasicAuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -46,6 +48,23 @@ type OrigIdentity struct {
 	UserID string `json:"user_id"`
 }
 
+// originatingUser - Returns the user_id from the originating identity header that the CC sends along ("cloudfoundry <base64 encoded json>"), or an empty string if it is not there
+func originatingUser(r *http.Request) string {
+	identityHeader := strings.Fields(r.Header.Get(IdentityHeader))
+	if len(identityHeader) != 2 {
+		return ""
+	}
+	var origIdentity OrigIdentity
+	if decoded, err := base64.StdEncoding.DecodeString(identityHeader[1]); err != nil {
+		fmt.Printf("failed to decode originating identity header: %s\n", err)
+	} else {
+		if err = json.Unmarshal(decoded, &origIdentity); err != nil {
+			fmt.Printf("failed to parse originating identity header: %s\n", err)
+		}
+	}
+	return origIdentity.UserID
+}
+
 func CheckJWTMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if accessToken, err := util.GetAccessTokenFromRequest(r); err == nil {
@@ -2,17 +2,26 @@ package controllers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/cloudfoundry/go-cfclient/v3/client"
 	"github.com/cloudfoundry/go-cfclient/v3/resource"
 	"github.com/gorilla/mux"
+	"github.com/rabobank/npsb/backend"
 	"github.com/rabobank/npsb/conf"
 	"github.com/rabobank/npsb/model"
+	"github.com/rabobank/npsb/policyserver"
+	"github.com/rabobank/npsb/registry"
 	"github.com/rabobank/npsb/util"
 	"net/http"
+	"regexp"
+	"sort"
 	"strconv"
+	"time"
 )
 
+var validHostname = regexp.MustCompile("^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$")
+
 func CreateServiceBinding(w http.ResponseWriter, r *http.Request) {
 	var err error
 	serviceInstanceGuid := mux.Vars(r)["service_instance_guid"]
@@ -30,115 +39,649 @@ func CreateServiceBinding(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	serviceInstance, err := conf.CfClient.ServiceInstances.Get(conf.CfCtx, serviceInstanceGuid)
+	if err != nil {
+		fmt.Printf("failed to get service instance %s: %s\n", serviceBinding.ServiceInstanceId, err)
+		util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: fmt.Sprintf("failed to get service instance %s: %s", serviceBinding.ServiceInstanceId, err), InstanceUsable: false, UpdateRepeatable: false})
+		return
+	}
+	if serviceInstance == nil || serviceInstance.Metadata == nil || serviceInstance.Metadata.Labels == nil {
+		fmt.Printf("service instance (metadata.labels) for id %s not found\n", serviceBinding.ServiceInstanceId)
+		util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: fmt.Sprintf("service instance (metadata.labels) for id %s not found", serviceBinding.ServiceInstanceId), InstanceUsable: false, UpdateRepeatable: false})
+		return
+	}
+
+	// egress instances apply to the whole space through their security group, there is nothing to bind
+	if serviceInstance.Metadata.Labels[conf.LabelNameType] != nil && *serviceInstance.Metadata.Labels[conf.LabelNameType] == conf.LabelValueTypeEgress {
+		util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: "type=egress service instances can not be bound, the security group applies to all apps in the space (after a restart)", InstanceUsable: true, UpdateRepeatable: false})
+		return
+	}
+
+	// for a space scoped source all apps in the space are members already
+	if util.IsSpaceScoped(serviceInstance.Metadata) {
+		util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: "this source service instance has scope=space, all apps in the space are sources without binding", InstanceUsable: true, UpdateRepeatable: false})
+		return
+	}
+
+	// for an instance with an app selector the apps matching the selector are members, apps are added by labelling them
+	if selector := util.AppSelector(serviceInstance.Metadata); selector != "" {
+		util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: fmt.Sprintf("this service instance has appSelector %s, the apps in the space matching the selector are members without binding", selector), InstanceUsable: true, UpdateRepeatable: false})
+		return
+	}
+
+	if serviceBindingParms.InternalRoute && (serviceInstance.Metadata.Labels[conf.LabelNameType] == nil || *serviceInstance.Metadata.Labels[conf.LabelNameType] != conf.LabelValueTypeDest) {
+		util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: "parameter \"internalRoute\" is only allowed for bindings to type=destination service instances", InstanceUsable: false, UpdateRepeatable: false})
+		return
+	}
+
+	// if no port was given for a destination binding, we try to detect the port the app listens on
+	if serviceInstance.Metadata.Labels[conf.LabelNameType] != nil && *serviceInstance.Metadata.Labels[conf.LabelNameType] == conf.LabelValueTypeDest && serviceBindingParms.Port == 0 && serviceBindingParms.StartPort == 0 && len(serviceBindingParms.Ports) == 0 {
+		// a service key has no app to detect the port of
+		if serviceBinding.AppGuid == "" {
+			util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: "port required for service keys: there is no app to detect the port of, use the parameter port, startPort/endPort or ports", InstanceUsable: true, UpdateRepeatable: false})
+			return
+		}
+		if serviceBindingParms.Port, err = util.DetectAppPort(serviceBinding.AppGuid); err != nil {
+			fmt.Printf("failed to detect the port for service binding %s: %s\n", serviceBindingGuid, err)
+			util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: err.Error(), InstanceUsable: false, UpdateRepeatable: false})
+			return
+		}
+		fmt.Printf("detected port %d for app %s of service binding %s\n", serviceBindingParms.Port, serviceBinding.AppGuid, serviceBindingGuid)
+	}
+
+	// the (first) port and protocol go in the labels, if there is more than one port or protocol, all of them go in the npsb.dest.ports annotation
+	destinationPorts := destinationPortsFromParameters(serviceBindingParms)
 	labels := make(map[string]*string)
-	portStr := strconv.Itoa(serviceBindingParms.Port)
+	annotations := make(map[string]*string)
+	portStr := strconv.Itoa(destinationPorts[0].Ports.Start)
 	labels[conf.LabelNamePort] = &portStr
-	labels[conf.LabelNameProtocol] = &serviceBindingParms.Protocol
-
-	serviceBindingUpdate := resource.ServiceCredentialBindingUpdate{Metadata: &resource.Metadata{Labels: labels}}
+	labels[conf.LabelNameProtocol] = &destinationPorts[0].Protocol
+	if destinationPorts[0].Ports.End != destinationPorts[0].Ports.Start {
+		// a port range, the start port goes in the same label as a single port
+		endPortStr := strconv.Itoa(destinationPorts[0].Ports.End)
+		labels[conf.LabelNamePortEnd] = &endPortStr
+	}
+	if len(destinationPorts) > 1 {
+		portsStr := util.FormatDestinationPorts(destinationPorts)
+		annotations[conf.AnnotationNamePorts] = &portsStr
+	}
+	// the sync makes sure the internal route (re)exists as long as the binding has this label
+	if serviceBindingParms.InternalRoute {
+		internalRouteStr := "true"
+		labels[conf.LabelNameInternalRoute] = &internalRouteStr
+		if serviceBindingParms.InternalRouteHostname != "" {
+			annotations[conf.AnnotationNameInternalHost] = &serviceBindingParms.InternalRouteHostname
+		}
+	}
 
 	// update the service binding with the labels
-	if *labels[conf.LabelNamePort] != "" {
-		if _, err = conf.CfClient.ServiceCredentialBindings.Update(conf.CfCtx, serviceBindingGuid, &serviceBindingUpdate); err != nil {
-			fmt.Printf("failed to update service binding %s: %s\n", serviceBindingGuid, err)
-			util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: fmt.Sprintf("failed to update service binding %s: %s", serviceBindingGuid, err), InstanceUsable: false, UpdateRepeatable: false})
+	serviceBindingUpdate := resource.ServiceCredentialBindingUpdate{Metadata: &resource.Metadata{Labels: labels, Annotations: annotations}}
+	if _, err = conf.CfClient.ServiceCredentialBindings.Update(conf.CfCtx, serviceBindingGuid, &serviceBindingUpdate); err != nil {
+		fmt.Printf("failed to update service binding %s: %s\n", serviceBindingGuid, err)
+		util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: fmt.Sprintf("failed to update service binding %s: %s", serviceBindingGuid, err), InstanceUsable: false, UpdateRepeatable: false})
+		return
+	}
+
+	if serviceBindingParms.InternalRoute {
+		if _, _, err = util.EnsureInternalRoute(serviceBinding.AppGuid, serviceBindingGuid, serviceBindingParms.InternalRouteHostname); err != nil {
+			fmt.Printf("failed to create internal route for service binding %s: %s\n", serviceBindingGuid, err)
+			compensateFailedBind(serviceBindingGuid, labels, annotations)
+			util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: err.Error(), InstanceUsable: false, UpdateRepeatable: false})
 			return
 		}
 	}
 
-	if serviceInstance, err := conf.CfClient.ServiceInstances.Get(conf.CfCtx, serviceInstanceGuid); err != nil {
-		fmt.Printf("failed to get service instance %s: %s\n", serviceBinding.ServiceInstanceId, err)
-		util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: fmt.Sprintf("failed to get service instance %s: %s", serviceBinding.ServiceInstanceId, err), InstanceUsable: false, UpdateRepeatable: false})
+	policyLabels, err := bindingPolicies(conf.ActionBind, serviceInstance, serviceBinding.AppGuid, destinationPorts)
+	if err != nil {
+		compensateFailedBind(serviceBindingGuid, labels, annotations)
+		writePolicyErrorResponse(w, fmt.Sprintf("failed to create policies for service instance %s", serviceBinding.ServiceInstanceId), err)
+		return
+	}
+	// the policy backend requests of the synchronous bind give up in time to answer before the broker timeout of the CC
+	deadline := time.Now().Add(conf.PolicyServerSyncRequestTime)
+	newPolicies, err := unregisteredPolicies(serviceBinding.AppGuid, policyLabels, deadline)
+	if err != nil {
+		compensateFailedBind(serviceBindingGuid, labels, annotations)
+		writePolicyErrorResponse(w, fmt.Sprintf("failed to create policies for service instance %s", serviceBinding.ServiceInstanceId), err)
+		return
+	}
+
+	// a large fan-out (i.e. binding to a popular source) could take longer than the broker timeout of the CC, if the CC allows it the policies are created in the background.
+	// A failed attempt is not rolled back, the binding keeps its labels and the applied policies are registered, so the retry or the sync finishes it (or the unbind undoes it)
+	user := originatingUser(r)
+	if r.URL.Query().Get("accepts_incomplete") == "true" && conf.AsyncBindThreshold > 0 && len(policyLabels) > conf.AsyncBindThreshold {
+		operationId := util.RunOperationWithProgress(serviceBindingGuid, fmt.Sprintf("creating %d policies", len(policyLabels)), func(progress func(string)) (string, error) {
+			if err := applyPolicies(conf.ActionBind, serviceInstance.GUID, serviceBindingGuid, user, networkPolicies(policyLabels), newPolicies, false, time.Time{}, func(applied int, total int) {
+				progress(fmt.Sprintf("%d/%d policies applied", applied, total))
+			}); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%d policies created successfully", len(policyLabels)), nil
+		})
+		fmt.Printf("creating %d policies for service binding %s asynchronously (operation %s)\n", len(policyLabels), serviceBindingGuid, operationId)
+		util.WriteHttpResponse(w, http.StatusAccepted, model.CreateServiceBindingResponse{Result: fmt.Sprintf("creating %d policies", len(policyLabels)), Operation: operationId})
+		return
+	}
+
+	// a failed bind is rolled back completely, so the orphan mitigation (unbind) of the CC finds nothing to clean up and a retry of the bind starts from scratch
+	if err = applyPolicies(conf.ActionBind, serviceInstance.GUID, serviceBindingGuid, user, networkPolicies(policyLabels), newPolicies, true, deadline, nil); err != nil {
+		compensateFailedBind(serviceBindingGuid, labels, annotations)
+		writePolicyErrorResponse(w, fmt.Sprintf("failed to create policies for service instance %s", serviceBinding.ServiceInstanceId), err)
 	} else {
-		if serviceInstance == nil || serviceInstance.Metadata == nil || serviceInstance.Metadata.Labels == nil {
-			fmt.Printf("service instance (metadata.labels) for id %s not found\n", serviceBinding.ServiceInstanceId)
-			util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: fmt.Sprintf("service instance (metadata.labels) for id %s not found", serviceBinding.ServiceInstanceId), InstanceUsable: false, UpdateRepeatable: false})
+		util.WriteHttpResponse(w, http.StatusCreated, model.CreateServiceBindingResponse{Result: fmt.Sprintf("%d policies created successfully", len(policyLabels)), Credentials: bindingCredentials(*serviceInstance.Metadata.Labels[conf.LabelNameType], policyLabels)})
+	}
+}
+
+// compensateFailedBind - Undoes what a failed bind changed besides the policies (applyPolicies rolls those back): the internal routes of the binding are deleted and its labels
+// and annotations are removed, so the sync does not recreate the policies of a binding that the Cloud Controller is about to delete
+func compensateFailedBind(bindingGuid string, labels map[string]*string, annotations map[string]*string) {
+	if _, err := util.DeleteInternalRoutes(bindingGuid); err != nil {
+		fmt.Printf("failed to delete internal routes of failed service binding %s: %s\n", bindingGuid, err)
+	}
+	metadata := resource.Metadata{Labels: make(map[string]*string), Annotations: make(map[string]*string)}
+	for name := range labels {
+		metadata.Labels[name] = nil
+	}
+	for name := range annotations {
+		metadata.Annotations[name] = nil
+	}
+	if _, err := conf.CfClient.ServiceCredentialBindings.Update(conf.CfCtx, bindingGuid, &resource.ServiceCredentialBindingUpdate{Metadata: &metadata}); err != nil {
+		fmt.Printf("failed to remove the labels of failed service binding %s, the sync keeps its policies until the binding is deleted: %s\n", bindingGuid, err)
+	}
+}
+
+// GetServiceBindingLastOperation - Returns the state of the asynchronous creation of the policies of a service binding, while in progress the description shows how many policies are applied
+func GetServiceBindingLastOperation(w http.ResponseWriter, r *http.Request) {
+	serviceBindingGuid := mux.Vars(r)["service_binding_guid"]
+	operationId := r.URL.Query().Get("operation")
+	if operation, found := util.GetOperation(serviceBindingGuid, operationId); found {
+		util.WriteHttpResponse(w, http.StatusOK, operation)
+		return
+	}
+
+	// we don't know the operation (i.e. the broker was restarted), the labels of the binding are written before the policies are created, the sync creates the missing policies
+	if serviceBinding, err := conf.CfClient.ServiceCredentialBindings.Get(conf.CfCtx, serviceBindingGuid); err != nil {
+		fmt.Printf("failed to get service binding %s: %s\n", serviceBindingGuid, err)
+		util.WriteHttpResponse(w, http.StatusOK, model.Operation{State: conf.OperationStateFailed, Description: fmt.Sprintf("operation %s is unknown and service binding could not be found: %s", operationId, err)})
+	} else {
+		if serviceBinding.Metadata != nil && serviceBinding.Metadata.Labels[conf.LabelNamePort] != nil {
+			util.WriteHttpResponse(w, http.StatusOK, model.Operation{State: conf.OperationStateSucceeded, Description: "service binding is labelled, the sync creates the missing policies"})
 		} else {
-			port, _ := strconv.Atoi(portStr)
-			if numCreated, err := createOrDeletePolicies(conf.ActionBind, serviceInstance, serviceBinding.AppGuid, port, serviceBindingParms.Protocol); err != nil {
-				util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: fmt.Sprintf("failed to create policies for service instance %s: %s", serviceBinding.ServiceInstanceId, err), InstanceUsable: false, UpdateRepeatable: false})
-			} else {
-				util.WriteHttpResponse(w, http.StatusCreated, model.CreateServiceBindingResponse{Result: fmt.Sprintf("%d policies created successfully", numCreated)})
+			util.WriteHttpResponse(w, http.StatusOK, model.Operation{State: conf.OperationStateFailed, Description: fmt.Sprintf("operation %s is unknown (the broker was probably restarted) and the service binding has no labels, please recreate the service binding", operationId)})
+		}
+	}
+}
+
+// GetServiceBinding - Returns the parameters of the service binding (rebuilt from its labels), the network policies it currently produces and the peers of the bound app as credentials
+func GetServiceBinding(w http.ResponseWriter, r *http.Request) {
+	serviceInstanceGuid := mux.Vars(r)["service_instance_guid"]
+	serviceBindingGuid := mux.Vars(r)["service_binding_guid"]
+	// OSBAPI: a binding that is still being created can not be fetched yet
+	if operation, found := util.GetOperation(serviceBindingGuid, ""); found && operation.State == conf.OperationStateInProgress {
+		util.WriteHttpResponse(w, http.StatusNotFound, model.BrokerError{Error: "NotFound", Description: fmt.Sprintf("service binding %s is being created: %s", serviceBindingGuid, operation.Description)})
+		return
+	}
+	binding, err := conf.CfClient.ServiceCredentialBindings.Get(conf.CfCtx, serviceBindingGuid)
+	if err != nil || binding.Relationships.ServiceInstance.Data.GUID != serviceInstanceGuid || binding.Relationships.App.Data == nil {
+		util.PrintfIfDebug("service binding %s of service instance %s not found (error: %v)\n", serviceBindingGuid, serviceInstanceGuid, err)
+		util.WriteHttpResponse(w, http.StatusNotFound, model.BrokerError{Error: "NotFound", Description: fmt.Sprintf("service binding %s not found", serviceBindingGuid)})
+		return
+	}
+	serviceInstance, err := conf.CfClient.ServiceInstances.Get(conf.CfCtx, serviceInstanceGuid)
+	if err != nil || serviceInstance.Metadata == nil || serviceInstance.Metadata.Labels[conf.LabelNameType] == nil {
+		util.PrintfIfDebug("service instance %s not found or not labelled (error: %v)\n", serviceInstanceGuid, err)
+		util.WriteHttpResponse(w, http.StatusNotFound, model.BrokerError{Error: "NotFound", Description: fmt.Sprintf("service instance %s not found", serviceInstanceGuid)})
+		return
+	}
+
+	appGuid := binding.Relationships.App.Data.GUID
+	srcOrDst := *serviceInstance.Metadata.Labels[conf.LabelNameType]
+	parameters := make(map[string]interface{})
+	policyLabels := make([]model.NetworkPolicyLabels, 0)
+	if srcOrDst == conf.LabelValueTypeSrc && serviceInstance.Metadata.Labels[conf.LabelNameName] != nil {
+		if policyLabels, err = policies4Source(*serviceInstance.Metadata.Labels[conf.LabelNameName], serviceInstance.Relationships.Space.Data.GUID, appGuid); err != nil {
+			util.WriteHttpResponse(w, http.StatusInternalServerError, model.BrokerError{Error: "FAILED", Description: fmt.Sprintf("failed to get the policies of service binding %s: %s", serviceBindingGuid, err)})
+			return
+		}
+	}
+	if srcOrDst == conf.LabelValueTypeDest {
+		destinationPorts := util.DestinationPortsFromMetadata(binding.Metadata)
+		parameters = bindingParameters(binding.Metadata, destinationPorts)
+		seenPolicies := make(map[string]bool)
+		for _, source := range util.InstanceSources(serviceInstance.Metadata) {
+			sourcePolicyLabels, err := policies4Destination(source.Name, source.Space, source.Org, appGuid, destinationPorts)
+			if err != nil {
+				util.WriteHttpResponse(w, http.StatusInternalServerError, model.BrokerError{Error: "FAILED", Description: fmt.Sprintf("failed to get the policies of service binding %s: %s", serviceBindingGuid, err)})
+				return
+			}
+			for _, policyLabel := range sourcePolicyLabels {
+				if !seenPolicies[policyLabel.NetworkPolicy().Key()] {
+					seenPolicies[policyLabel.NetworkPolicy().Key()] = true
+					policyLabels = append(policyLabels, policyLabel)
+				}
 			}
 		}
 	}
+	util.WriteHttpResponse(w, http.StatusOK, model.GetServiceBindingResponse{Credentials: bindingCredentials(srcOrDst, policyLabels), Parameters: parameters, Policies: policyLabels})
+}
+
+// bindingParameters - Rebuilds the parameters of a destination binding from its destination ports and its internal route label and annotation
+func bindingParameters(metadata *resource.Metadata, destinationPorts []model.DestinationPort) map[string]interface{} {
+	parameters := make(map[string]interface{})
+	setPorts := func(ports model.Ports) {
+		if ports.Start == ports.End {
+			parameters["port"] = ports.Start
+		} else {
+			parameters["startPort"] = ports.Start
+			parameters["endPort"] = ports.End
+		}
+	}
+	switch {
+	case len(destinationPorts) == 1:
+		setPorts(destinationPorts[0].Ports)
+		parameters["protocol"] = destinationPorts[0].Protocol
+	case len(destinationPorts) == 2 && destinationPorts[0].Ports == destinationPorts[1].Ports && destinationPorts[0].Protocol != destinationPorts[1].Protocol:
+		// protocol "both" results in a tcp and an udp entry for the same port(s)
+		setPorts(destinationPorts[0].Ports)
+		parameters["protocol"] = conf.ProtocolBoth
+	default:
+		ports := make([]model.PortProtocolParameter, 0, len(destinationPorts))
+		for _, destinationPort := range destinationPorts {
+			ports = append(ports, model.PortProtocolParameter{Port: destinationPort.Ports.Start, Protocol: destinationPort.Protocol})
+		}
+		parameters["ports"] = ports
+	}
+	if metadata != nil && metadata.Labels[conf.LabelNameInternalRoute] != nil && *metadata.Labels[conf.LabelNameInternalRoute] == "true" {
+		parameters["internalRoute"] = true
+		if metadata.Annotations[conf.AnnotationNameInternalHost] != nil && *metadata.Annotations[conf.AnnotationNameInternalHost] != "" {
+			parameters["internalRouteHostname"] = *metadata.Annotations[conf.AnnotationNameInternalHost]
+		}
+	}
+	return parameters
 }
 
-// DeleteServiceBinding - Deletes the service binding and the associated network policies
+// DeleteServiceBinding - Deletes the service binding and the associated network policies, a failed unbind is rolled back so the binding stays intact and the unbind can be retried.
+// The orphan mitigation of the CC can unbind a binding that is (partially) gone: the policies registered for the binding are deleted then, and a binding that does not exist results in 410 Gone.
 func DeleteServiceBinding(w http.ResponseWriter, r *http.Request) {
 	serviceInstanceGuid := mux.Vars(r)["service_instance_guid"]
 	serviceBindingGuid := mux.Vars(r)["service_binding_guid"]
+	// the policy backend requests of the unbind give up in time to answer before the broker timeout of the CC
+	deadline := time.Now().Add(conf.PolicyServerSyncRequestTime)
 
-	if serviceCredentialBinding, err := conf.CfClient.ServiceCredentialBindings.Get(conf.CfCtx, serviceBindingGuid); err != nil {
-		util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: fmt.Sprintf("failed to get service binding %s: %s", serviceBindingGuid, err), InstanceUsable: false, UpdateRepeatable: false})
-	} else {
-		if serviceInstance, err := conf.CfClient.ServiceInstances.Get(conf.CfCtx, serviceInstanceGuid); err != nil {
-			fmt.Printf("failed to get service instance %s: %s\n", serviceCredentialBinding.Relationships.ServiceInstance.Data.GUID, err)
-			util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: fmt.Sprintf("failed to get service instance %s: %s", serviceCredentialBinding.Relationships.ServiceInstance.Data.GUID, err), InstanceUsable: false, UpdateRepeatable: false})
+	if operation, found := util.GetOperation(serviceBindingGuid, ""); found && operation.State == conf.OperationStateInProgress {
+		util.WriteHttpResponse(w, http.StatusUnprocessableEntity, model.BrokerError{Error: "ConcurrencyError", Description: fmt.Sprintf("service binding %s is being created: %s", serviceBindingGuid, operation.Description), InstanceUsable: true, UpdateRepeatable: true})
+		return
+	}
+
+	serviceCredentialBinding, err := conf.CfClient.ServiceCredentialBindings.Get(conf.CfCtx, serviceBindingGuid)
+	if err != nil {
+		if !resource.IsResourceNotFoundError(err) && !resource.IsNotFoundError(err) {
+			util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: fmt.Sprintf("failed to get service binding %s: %s", serviceBindingGuid, err), InstanceUsable: false, UpdateRepeatable: false})
+			return
+		}
+		fmt.Printf("service binding %s not found, deleting what is registered for it\n", serviceBindingGuid)
+		if deleted, err := deleteRegisteredBindingPolicies(serviceBindingGuid, deadline); err != nil {
+			writePolicyErrorResponse(w, fmt.Sprintf("failed to delete policies for service binding %s", serviceBindingGuid), err)
 		} else {
-			if serviceInstance == nil || serviceInstance.Metadata == nil || serviceInstance.Metadata.Labels == nil {
-				fmt.Printf("service instance (metadata.labels) for id %s not found\n", serviceCredentialBinding.Relationships.ServiceInstance.Data.GUID)
-				util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: fmt.Sprintf("service instance (metadata.labels) for id %s not found", serviceCredentialBinding.Relationships.ServiceInstance.Data.GUID), InstanceUsable: false, UpdateRepeatable: false})
-			} else {
-				port := 8080
-				if serviceCredentialBinding.Metadata.Labels[conf.LabelNamePort] != nil && *serviceCredentialBinding.Metadata.Labels[conf.LabelNamePort] != "0" {
-					port, _ = strconv.Atoi(*serviceCredentialBinding.Metadata.Labels[conf.LabelNamePort])
-				}
-				protocol := conf.LabelValueProtocolTCP
-				if serviceCredentialBinding.Metadata.Labels[conf.LabelNameProtocol] != nil && *serviceCredentialBinding.Metadata.Labels[conf.LabelNameProtocol] != "" {
-					protocol = *serviceCredentialBinding.Metadata.Labels[conf.LabelNameProtocol]
-				}
-				if numDeleted, err := createOrDeletePolicies(conf.ActionUnbind, serviceInstance, serviceCredentialBinding.Relationships.App.Data.GUID, port, protocol); err != nil {
-					util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: fmt.Sprintf("failed to create policies for service instance %s: %s", serviceCredentialBinding.Relationships.ServiceInstance.Data.GUID, err), InstanceUsable: false, UpdateRepeatable: false})
-				} else {
-					util.WriteHttpResponse(w, http.StatusOK, model.DeleteServiceBindingResponse{Result: fmt.Sprintf("%d policies deleted successfully", numDeleted)})
-				}
+			util.WriteHttpResponse(w, http.StatusGone, model.DeleteServiceBindingResponse{Result: fmt.Sprintf("service binding not found, %d registered policies deleted", deleted)})
+		}
+		return
+	}
+
+	serviceInstance, err := conf.CfClient.ServiceInstances.Get(conf.CfCtx, serviceInstanceGuid)
+	if err != nil || serviceInstance == nil || serviceInstance.Metadata == nil || serviceInstance.Metadata.Labels == nil {
+		// without the labels of the instance we can not compute the policies of the binding, the policies we created for it are in the registry
+		fmt.Printf("service instance (metadata.labels) for id %s not found (error: %v), deleting the policies registered for service binding %s\n", serviceInstanceGuid, err, serviceBindingGuid)
+		if deleted, err := deleteRegisteredBindingPolicies(serviceBindingGuid, deadline); err != nil {
+			writePolicyErrorResponse(w, fmt.Sprintf("failed to delete policies for service binding %s", serviceBindingGuid), err)
+		} else {
+			util.WriteHttpResponse(w, http.StatusOK, model.DeleteServiceBindingResponse{Result: fmt.Sprintf("%d registered policies deleted successfully", deleted)})
+		}
+		return
+	}
+
+	destinationPorts := util.DestinationPortsFromMetadata(serviceCredentialBinding.Metadata)
+	if deleted, err := deleteBindingPolicies(serviceInstance, serviceBindingGuid, serviceCredentialBinding.Relationships.App.Data.GUID, destinationPorts, deadline); err != nil {
+		writePolicyErrorResponse(w, fmt.Sprintf("failed to delete policies for service instance %s", serviceCredentialBinding.Relationships.ServiceInstance.Data.GUID), err)
+	} else {
+		// only the internal routes that were created by the broker (labelled with the binding guid) are deleted
+		if _, err = util.DeleteInternalRoutes(serviceBindingGuid); err != nil {
+			fmt.Printf("failed to delete internal routes for service binding %s: %s\n", serviceBindingGuid, err)
+			util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: err.Error(), InstanceUsable: false, UpdateRepeatable: false})
+			return
+		}
+		util.WriteHttpResponse(w, http.StatusOK, model.DeleteServiceBindingResponse{Result: fmt.Sprintf("%d policies deleted successfully", deleted)})
+	}
+}
+
+// deleteRegisteredBindingPolicies - Deletes the policies (and internal routes) that were created for a service binding of which we can not compute the policies anymore
+// (the binding or its instance is gone, or the bind never completed), as recorded in the registry. The policy backend requests give up at the deadline. Returns the number of deleted policies.
+func deleteRegisteredBindingPolicies(bindingGuid string, deadline time.Time) (int, error) {
+	policies := make([]model.NetworkPolicy, 0)
+	for _, entry := range registry.ForBinding(bindingGuid) {
+		policies = append(policies, entry.Policy)
+	}
+	if len(policies) > 0 {
+		if err := backend.WithDeadline(deadline).Delete(policies); err != nil {
+			return 0, err
+		}
+		if err := registry.Forget(policies); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := util.DeleteInternalRoutes(bindingGuid); err != nil {
+		fmt.Printf("failed to delete internal routes for service binding %s: %s\n", bindingGuid, err)
+	}
+	fmt.Printf("deleted %d registered policies of service binding %s\n", len(policies), bindingGuid)
+	return len(policies), nil
+}
+
+// deleteBindingPolicies - Deletes the network policies of an unbound app that the broker created (registered for the binding, or for the counterpart of a computed policy of the binding)
+// and that no other binding of the app still requires. Policies that were not created by the broker (i.e. added by hand) are left alone. A still required policy that was registered
+// for the binding is registered for the binding that requires it. The policy backend requests give up at the deadline. Returns the number of deleted policies.
+func deleteBindingPolicies(serviceInstance *resource.ServiceInstance, bindingGuid string, appGuid string, destinationPorts []model.DestinationPort, deadline time.Time) (int, error) {
+	policyLabels, err := bindingPolicies(conf.ActionUnbind, serviceInstance, appGuid, destinationPorts)
+	if err != nil {
+		return 0, err
+	}
+	stillRequired, err := otherBindingsPolicies(appGuid, bindingGuid)
+	if err != nil {
+		return 0, err
+	}
+	registered := make(map[string]registry.Entry)
+	for _, entry := range registry.ForBinding(bindingGuid) {
+		registered[entry.Policy.Key()] = entry
+	}
+	for _, policyLabel := range policyLabels {
+		if entry, found := registry.Get(policyLabel.NetworkPolicy()); found {
+			registered[entry.Policy.Key()] = entry
+		}
+	}
+	policies := make([]model.NetworkPolicy, 0, len(registered))
+	for _, entry := range registered {
+		if owner, found := stillRequired[entry.Policy.Key()]; !found {
+			policies = append(policies, entry.Policy)
+		} else if entry.BindingGuid == bindingGuid {
+			if err = registry.Record([]model.NetworkPolicy{entry.Policy}, owner.instanceGuid, owner.bindingGuid, entry.User); err != nil {
+				return 0, err
 			}
+			fmt.Printf("policy %s is still required by service binding %s, it is registered for that binding now\n", entry.Policy.Key(), owner.bindingGuid)
 		}
 	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].Key() < policies[j].Key() })
+	if err = applyPolicies(conf.ActionUnbind, serviceInstance.GUID, bindingGuid, "", policies, nil, true, deadline, nil); err != nil {
+		return 0, err
+	}
+	return len(policies), nil
 }
 
-// createOrDeletePolicies - Creates or deletes (indicated by the action parameter) network policies for the given source or destination (determined by the presence of the name or source label) service instances,
-//
-//	returns the number of policies created or deleted and an optional error
-func createOrDeletePolicies(action string, serviceInstance *resource.ServiceInstance, appGuid string, port int, protocol string) (numProcessed int, err error) {
+// otherBindingsPolicies - Returns the network policies the other bindings of the app require, with the instance and binding that require them keyed by policy key
+func otherBindingsPolicies(appGuid string, bindingGuid string) (map[string]policyOwner, error) {
+	labelSelector := client.LabelSelector{}
+	labelSelector.Existence(conf.LabelNamePort)
+	bindingListOptions := client.ServiceCredentialBindingListOptions{ListOptions: &client.ListOptions{LabelSel: labelSelector}, AppGUIDs: client.Filter{Values: []string{appGuid}}}
+	bindings, err := conf.CfClient.ServiceCredentialBindings.ListAll(conf.CfCtx, &bindingListOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the service bindings of app %s: %s", appGuid, err)
+	}
+	owners := make(map[string]policyOwner)
+	for _, binding := range bindings {
+		if binding.GUID == bindingGuid {
+			continue
+		}
+		serviceInstance, err := conf.CfClient.ServiceInstances.Get(conf.CfCtx, binding.Relationships.ServiceInstance.Data.GUID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get service instance %s of service binding %s: %s", binding.Relationships.ServiceInstance.Data.GUID, binding.GUID, err)
+		}
+		if serviceInstance.Metadata == nil || serviceInstance.Metadata.Labels[conf.LabelNameType] == nil {
+			continue
+		}
+		policyLabels, err := bindingPolicies(conf.ActionBind, serviceInstance, appGuid, util.DestinationPortsFromMetadata(binding.Metadata))
+		if err != nil {
+			return nil, err
+		}
+		for _, policyLabel := range policyLabels {
+			if _, found := owners[policyLabel.NetworkPolicy().Key()]; !found {
+				owners[policyLabel.NetworkPolicy().Key()] = policyOwner{instanceGuid: serviceInstance.GUID, bindingGuid: binding.GUID}
+			}
+		}
+	}
+	return owners, nil
+}
+
+// policyOwner - The service instance and binding a network policy is registered for
+type policyOwner struct {
+	instanceGuid string
+	bindingGuid  string
+}
+
+// bindingPolicies - Returns the network policies (with app names) for the given app bound to the given source or destination (determined by the presence of the name or source label) service instance
+func bindingPolicies(action string, serviceInstance *resource.ServiceInstance, appGuid string, destinationPorts []model.DestinationPort) (policyLabels []model.NetworkPolicyLabels, err error) {
 	var srcPolicyLabels []model.NetworkPolicyLabels
 	var destPolicyLabels []model.NetworkPolicyLabels
-	var policies []model.NetworkPolicy
 	// get the policies for the source service instance
 	if serviceInstance.Metadata.Labels[conf.LabelNameType] != nil && *serviceInstance.Metadata.Labels[conf.LabelNameType] == conf.LabelValueTypeSrc {
 		if srcPolicyLabels, err = policies4Source(*serviceInstance.Metadata.Labels[conf.LabelNameName], serviceInstance.Relationships.Space.Data.GUID, appGuid); err != nil {
 			fmt.Printf("failed to get policies for source service instance id %s: %s\n", serviceInstance.GUID, err)
-			return 0, err
+			return nil, err
 		} else {
 			for ix, policyLabel := range srcPolicyLabels {
 				fmt.Printf("%s policyLabel %d for source service instance id %s: %s\n", action, ix, serviceInstance.GUID, policyLabel)
-				policies = append(policies, model.NetworkPolicy{Source: model.Source{Id: policyLabel.Source}, Destination: model.Destination{Id: policyLabel.Destination, Protocol: policyLabel.Protocol, Port: policyLabel.Port}})
 			}
 		}
 	}
 	// get the policies for the destination service instance
+	// a destination instance can refer to more than one source, an app bound to more than one of them results in the same policy, we only need it once
 	if serviceInstance.Metadata.Labels[conf.LabelNameType] != nil && *serviceInstance.Metadata.Labels[conf.LabelNameType] == conf.LabelValueTypeDest {
-		if destPolicyLabels, err = policies4Destination(*serviceInstance.Metadata.Labels[conf.LabelNameSourceName], *serviceInstance.Metadata.Labels[conf.LabelNameSourceSpace], *serviceInstance.Metadata.Labels[conf.LabelNameSourceOrg], appGuid, port, protocol); err != nil {
-			fmt.Printf("failed to get policies for destination service instance id %s: %s\n", serviceInstance.GUID, err)
-			return 0, err
+		seenPolicies := make(map[string]bool)
+		for _, source := range util.InstanceSources(serviceInstance.Metadata) {
+			sourcePolicyLabels, err := policies4Destination(source.Name, source.Space, source.Org, appGuid, destinationPorts)
+			if err != nil {
+				fmt.Printf("failed to get policies for destination service instance id %s and source %s: %s\n", serviceInstance.GUID, source, err)
+				return nil, err
+			}
+			for _, policyLabel := range sourcePolicyLabels {
+				if !seenPolicies[policyLabel.NetworkPolicy().Key()] {
+					seenPolicies[policyLabel.NetworkPolicy().Key()] = true
+					destPolicyLabels = append(destPolicyLabels, policyLabel)
+				}
+			}
+		}
+		for ix, policyLabel := range destPolicyLabels {
+			fmt.Printf("%s policyLabel %d for destination service instance id %s: %s\n", action, ix, serviceInstance.GUID, policyLabel)
+		}
+	}
+	return append(srcPolicyLabels, destPolicyLabels...), nil
+}
+
+// unregisteredPolicies - Returns the given policies that do not exist yet for the app. Policies that already exist (i.e. added by hand) are not registered as created by the broker,
+// so we never delete them later. This has to be determined before the policies are created, a retry of a partially applied bind would otherwise find its own policies.
+// The policy backend request gives up at the deadline.
+func unregisteredPolicies(appGuid string, policyLabels []model.NetworkPolicyLabels, deadline time.Time) ([]model.NetworkPolicy, error) {
+	newPolicies := make([]model.NetworkPolicy, 0)
+	if len(policyLabels) == 0 {
+		return newPolicies, nil
+	}
+	existingPolicies, err := backend.WithDeadline(deadline).List([]string{appGuid})
+	if err != nil {
+		fmt.Printf("failed to get existing policies for app %s: %s\n", appGuid, err)
+		return nil, err
+	}
+	existing := make(map[string]bool)
+	for _, policy := range existingPolicies {
+		existing[policy.Key()] = true
+	}
+	for _, policyLabel := range policyLabels {
+		if policy := policyLabel.NetworkPolicy(); !existing[policy.Key()] {
+			newPolicies = append(newPolicies, policy)
+		}
+	}
+	return newPolicies, nil
+}
+
+// applyPolicies - Creates or deletes (indicated by the action parameter) the given policies in chunks of conf.BindChunkSize, after every chunk progress (if not nil) is called with
+// the number of applied and total policies. After a bind the newPolicies are recorded in the registry, after an unbind the deleted policies are removed from it.
+// An unbind only deletes the policies that are in the registry, the policies the broker did not create are left alone.
+// If a chunk fails and rollback is true, the chunks that were applied are undone (only the new policies are deleted again, policies that existed before the bind are left alone).
+// Whatever could not be undone is recorded as the partial state in the registry, so the unbind (orphan mitigation) or the sync can finish or undo it.
+// If the registry can not be saved the error is returned, a bind with rollback is then rolled back as well.
+// If the deadline is not zero (a synchronous bind or unbind), the policy backend requests give up at the deadline, a rollback gets conf.PolicyServerSyncRequestTime of its own.
+func applyPolicies(action string, instanceGuid string, bindingGuid string, user string, policies []model.NetworkPolicy, newPolicies []model.NetworkPolicy, rollback bool, deadline time.Time, progress func(applied int, total int)) (err error) {
+	if action == conf.ActionUnbind {
+		policies = registeredPolicies(policies)
+	}
+	if len(policies) == 0 {
+		return nil
+	}
+	policyBackend := backend.WithDeadline(deadline)
+	applied := make([]model.NetworkPolicy, 0, len(policies))
+	for _, chunk := range policyserver.ChunkSlice(policies, conf.BindChunkSize) {
+		if action == conf.ActionBind {
+			err = policyBackend.Create(chunk)
 		} else {
-			for ix, policyLabel := range destPolicyLabels {
-				fmt.Printf("%s policyLabel %d for destination service instance id %s: %s\n", action, ix, serviceInstance.GUID, policyLabel)
-				policies = append(policies, model.NetworkPolicy{Source: model.Source{Id: policyLabel.Source}, Destination: model.Destination{Id: policyLabel.Destination, Protocol: policyLabel.Protocol, Port: policyLabel.Port}})
+			err = policyBackend.Delete(chunk)
+		}
+		if err != nil {
+			fmt.Printf("failed to send policies to the policy backend (%d of %d applied): %s\n", len(applied), len(policies), err)
+			if rollback {
+				applied = rollbackPolicies(action, bindingGuid, applied, newPolicies)
+			}
+			if recordErr := recordAppliedPolicies(action, instanceGuid, bindingGuid, user, applied, newPolicies); recordErr != nil {
+				fmt.Printf("failed to record the partially applied policies of service binding %s: %s\n", bindingGuid, recordErr)
 			}
+			return err
+		}
+		applied = append(applied, chunk...)
+		if progress != nil {
+			progress(len(applied), len(policies))
 		}
 	}
-	if len(policies) > 0 {
-		if err = util.Send2PolicyServer(action, model.NetworkPolicies{Policies: policies}); err != nil {
-			fmt.Printf("failed to send policies to policy server: %s\n", err)
-			return 0, err
+	if err = recordAppliedPolicies(action, instanceGuid, bindingGuid, user, applied, newPolicies); err != nil && rollback && action == conf.ActionBind {
+		// the policies are registered in memory only, a bind that is rolled back can be retried by the CC, after a restart the registry would not know the policies it created
+		fmt.Printf("failed to record the policies of service binding %s, rolling back the bind: %s\n", bindingGuid, err)
+		if remaining := rollbackPolicies(action, bindingGuid, applied, newPolicies); len(remaining) == 0 {
+			_ = registry.Forget(onlyNewPolicies(applied, newPolicies))
+		}
+	}
+	return err
+}
+
+// rollbackPolicies - Undoes the applied chunks of a failed bind (deletes the new policies) or unbind (recreates the deleted policies, these are all registered), returns the policies that are still applied
+func rollbackPolicies(action string, bindingGuid string, applied []model.NetworkPolicy, newPolicies []model.NetworkPolicy) []model.NetworkPolicy {
+	if len(applied) == 0 {
+		return applied
+	}
+	// the rollback gets its own time, the deadline of the bind or unbind may have passed already
+	var err error
+	policyBackend := backend.WithDeadline(time.Now().Add(conf.PolicyServerSyncRequestTime))
+	if action == conf.ActionBind {
+		err = policyBackend.Delete(onlyNewPolicies(applied, newPolicies))
+	} else {
+		err = policyBackend.Create(applied)
+	}
+	if err != nil {
+		fmt.Printf("failed to roll back %d applied policies of service binding %s: %s\n", len(applied), bindingGuid, err)
+		return applied
+	}
+	fmt.Printf("rolled back %d applied policies of service binding %s\n", len(applied), bindingGuid)
+	return make([]model.NetworkPolicy, 0)
+}
+
+// recordAppliedPolicies - Records the new policies that were created by a bind in the registry, or removes the policies that were deleted by an unbind from it
+func recordAppliedPolicies(action string, instanceGuid string, bindingGuid string, user string, applied []model.NetworkPolicy, newPolicies []model.NetworkPolicy) error {
+	if action == conf.ActionBind {
+		return registry.Record(onlyNewPolicies(applied, newPolicies), instanceGuid, bindingGuid, user)
+	}
+	return registry.Forget(applied)
+}
+
+// networkPolicies - Returns the network policies of the given policy labels
+func networkPolicies(policyLabels []model.NetworkPolicyLabels) []model.NetworkPolicy {
+	policies := make([]model.NetworkPolicy, 0, len(policyLabels))
+	for _, policyLabel := range policyLabels {
+		policies = append(policies, policyLabel.NetworkPolicy())
+	}
+	return policies
+}
+
+// registeredPolicies - Returns the policies that are in the registry (the ones the broker created)
+func registeredPolicies(policies []model.NetworkPolicy) []model.NetworkPolicy {
+	result := make([]model.NetworkPolicy, 0, len(policies))
+	for _, policy := range policies {
+		if registry.Contains(policy) {
+			result = append(result, policy)
 		}
 	}
-	return
+	return result
 }
 
-// validateBindingParameters - Validates the parameters of the service binding, returns the parameters or an error. The only allowed parameters are port (must be between 1024 and 65535) and protocol (must be "tcp" or "udp")
+// onlyNewPolicies - Returns the policies that are in newPolicies
+func onlyNewPolicies(policies []model.NetworkPolicy, newPolicies []model.NetworkPolicy) []model.NetworkPolicy {
+	isNew := make(map[string]bool)
+	for _, policy := range newPolicies {
+		isNew[policy.Key()] = true
+	}
+	result := make([]model.NetworkPolicy, 0, len(policies))
+	for _, policy := range policies {
+		if isNew[policy.Key()] {
+			result = append(result, policy)
+		}
+	}
+	return result
+}
+
+// bindingCredentials - Returns the peers of the bound app as binding credentials, so the app can find them through VCAP_SERVICES.
+// For a source binding these are the destinations the app can reach (with their internal hostnames), for a destination binding the source apps that are allowed in.
+func bindingCredentials(srcOrDst string, policyLabels []model.NetworkPolicyLabels) *model.BindingCredentials {
+	credentials := model.BindingCredentials{}
+	if srcOrDst == conf.LabelValueTypeSrc {
+		credentials.Destinations = make([]model.PeerDestination, 0)
+		internalHostnames := make(map[string][]string)
+		for _, policyLabel := range policyLabels {
+			if _, found := internalHostnames[policyLabel.Destination]; !found {
+				internalHostnames[policyLabel.Destination] = util.InternalHostnames(policyLabel.Destination)
+			}
+			credentials.Destinations = append(credentials.Destinations, model.PeerDestination{AppGuid: policyLabel.Destination, AppName: policyLabel.DestinationName, InternalHostnames: internalHostnames[policyLabel.Destination], Port: policyLabel.Port, EndPort: policyLabel.Ports().End, Protocol: policyLabel.Protocol})
+		}
+	} else {
+		credentials.Sources = make([]model.PeerSource, 0)
+		seenSources := make(map[string]bool)
+		for _, policyLabel := range policyLabels {
+			if !seenSources[policyLabel.Source] {
+				seenSources[policyLabel.Source] = true
+				credentials.Sources = append(credentials.Sources, model.PeerSource{AppGuid: policyLabel.Source, AppName: policyLabel.SourceName})
+			}
+		}
+	}
+	return &credentials
+}
+
+// writePolicyErrorResponse - Maps the (policy backend) error to an OSBAPI error response, errors that are not from the policy backend are reported as a bad request
+func writePolicyErrorResponse(w http.ResponseWriter, description string, err error) {
+	brokerError := model.BrokerError{Error: "FAILED", Description: fmt.Sprintf("%s: %s", description, err), InstanceUsable: false, UpdateRepeatable: false}
+	switch {
+	case errors.Is(err, backend.ErrValidation):
+		brokerError.Error = "ValidationFailed"
+		util.WriteHttpResponse(w, http.StatusBadRequest, brokerError)
+	case errors.Is(err, backend.ErrForbidden):
+		brokerError.Error = "Forbidden"
+		util.WriteHttpResponse(w, http.StatusForbidden, brokerError)
+	case errors.Is(err, backend.ErrLimitExceeded):
+		brokerError.Error = "LimitExceeded"
+		util.WriteHttpResponse(w, http.StatusUnprocessableEntity, brokerError)
+	case errors.Is(err, registry.ErrSave):
+		util.WriteHttpResponse(w, http.StatusInternalServerError, brokerError)
+	case errors.Is(err, backend.ErrUnavailable):
+		brokerError.Error = "ServiceUnavailable"
+		brokerError.UpdateRepeatable = true
+		util.WriteHttpResponse(w, http.StatusServiceUnavailable, brokerError)
+	default:
+		util.WriteHttpResponse(w, http.StatusBadRequest, brokerError)
+	}
+}
+
+// validateBindingParameters - Validates the parameters of the service binding, returns the parameters or an error. The only allowed parameters are port or startPort/endPort (must be between 1024 and 65535),
+// protocol (must be "tcp", "udp" or "both") or a list of ports with their protocol
 func validateBindingParameters(serviceBinding model.ServiceBinding) (serviceBindingParms model.ServiceBindingParameters, err error) {
 	minvalue := 1024
 	maxValue := 65535
@@ -152,113 +695,185 @@ func validateBindingParameters(serviceBinding model.ServiceBinding) (serviceBind
 	if serviceBindingParms.Port != 0 && serviceBindingParms.Port <= minvalue || serviceBindingParms.Port >= maxValue {
 		return serviceBindingParms, fmt.Errorf("parameter \"port\":\"%d\" is invalid, should be an integer between 1024 and 65535", serviceBindingParms.Port)
 	}
-	if serviceBindingParms.Protocol != "" && serviceBindingParms.Protocol != conf.LabelValueProtocolTCP && serviceBindingParms.Protocol != conf.LabelValueProtocolUDP {
-		return serviceBindingParms, fmt.Errorf("parameter \"protocol\":\"%s\" is invalid, should be \"%s\" or \"%s\"", serviceBindingParms.Protocol, conf.LabelValueProtocolTCP, conf.LabelValueProtocolUDP)
+	if serviceBindingParms.StartPort != 0 || serviceBindingParms.EndPort != 0 {
+		if serviceBindingParms.Port != 0 {
+			return serviceBindingParms, fmt.Errorf("parameter \"port\" can not be combined with \"startPort\" and \"endPort\"")
+		}
+		if serviceBindingParms.StartPort <= minvalue || serviceBindingParms.StartPort >= maxValue || serviceBindingParms.EndPort <= minvalue || serviceBindingParms.EndPort >= maxValue {
+			return serviceBindingParms, fmt.Errorf("parameters \"startPort\":\"%d\" and \"endPort\":\"%d\" are invalid, both should be an integer between 1024 and 65535", serviceBindingParms.StartPort, serviceBindingParms.EndPort)
+		}
+		if serviceBindingParms.EndPort < serviceBindingParms.StartPort {
+			return serviceBindingParms, fmt.Errorf("parameter \"endPort\":\"%d\" is invalid, should not be lower than \"startPort\":\"%d\"", serviceBindingParms.EndPort, serviceBindingParms.StartPort)
+		}
+	}
+	if serviceBindingParms.InternalRouteHostname != "" {
+		if !serviceBindingParms.InternalRoute {
+			return serviceBindingParms, fmt.Errorf("parameter \"internalRouteHostname\" is only allowed with \"internalRoute\":true")
+		}
+		if !validHostname.MatchString(serviceBindingParms.InternalRouteHostname) {
+			return serviceBindingParms, fmt.Errorf("parameter \"internalRouteHostname\":\"%s\" is invalid, should be at most 63 lowercase letters, digits and hyphens", serviceBindingParms.InternalRouteHostname)
+		}
+	}
+	if !validProtocol(serviceBindingParms.Protocol) {
+		return serviceBindingParms, fmt.Errorf("parameter \"protocol\":\"%s\" is invalid, should be \"%s\", \"%s\" or \"%s\"", serviceBindingParms.Protocol, conf.LabelValueProtocolTCP, conf.LabelValueProtocolUDP, conf.ProtocolBoth)
+	}
+	if len(serviceBindingParms.Ports) > 0 {
+		if serviceBindingParms.Port != 0 || serviceBindingParms.StartPort != 0 || serviceBindingParms.EndPort != 0 {
+			return serviceBindingParms, fmt.Errorf("parameter \"ports\" can not be combined with \"port\", \"startPort\" or \"endPort\"")
+		}
+		for _, portProtocol := range serviceBindingParms.Ports {
+			if portProtocol.Port <= minvalue || portProtocol.Port >= maxValue {
+				return serviceBindingParms, fmt.Errorf("parameter \"ports\" has an invalid port %d, should be an integer between 1024 and 65535", portProtocol.Port)
+			}
+			if !validProtocol(portProtocol.Protocol) {
+				return serviceBindingParms, fmt.Errorf("parameter \"ports\" has an invalid protocol \"%s\" for port %d, should be \"%s\", \"%s\" or \"%s\"", portProtocol.Protocol, portProtocol.Port, conf.LabelValueProtocolTCP, conf.LabelValueProtocolUDP, conf.ProtocolBoth)
+			}
+		}
 	}
 	return serviceBindingParms, nil
 }
 
-// policies4Source - Returns the policy labels for the given source and app guid for the app that is being bound. The service instances are identified by the label source=srcName
-func policies4Source(srcName string, srcSpaceGuid string, srcAppGuid string) (policyLabels []model.NetworkPolicyLabels, err error) {
-	policyLabels = make([]model.NetworkPolicyLabels, 0)
-	// find all service instances with label source=srcName
-	labelSelector := client.LabelSelector{}
-	labelSelector.EqualTo(conf.LabelNameSourceName, srcName)
-	instanceListOption := client.ServiceInstanceListOptions{SpaceGUIDs: client.Filter{Values: []string{srcSpaceGuid}}, ListOptions: &client.ListOptions{LabelSel: labelSelector, PerPage: 5000}}
-	if instances, err := conf.CfClient.ServiceInstances.ListAll(conf.CfCtx, &instanceListOption); err != nil {
-		fmt.Printf("failed to list service instances with label %s=%s in space with guid %s: %s\n", conf.LabelNameSourceName, srcName, srcSpaceGuid, err)
-		return nil, err
-	} else {
-		// can be multiple (many) instances
-		if len(instances) < 1 {
-			util.PrintfIfDebug("could not find any service instances with label %s=%s in space with guid %s\n", conf.LabelNameSourceName, srcSpaceGuid, srcName)
-		} else {
-			serviceGUIDs := make([]string, 0)
-			for _, instance := range instances {
-				serviceGUIDs = append(serviceGUIDs, instance.GUID)
-			}
-			util.PrintfIfDebug("found %d source service instances with label %s=%s in space with guid %s\n", len(serviceGUIDs), conf.LabelNameSourceName, srcSpaceGuid, srcName)
-			credBindingListOption := client.ServiceCredentialBindingListOptions{ListOptions: &client.ListOptions{PerPage: 1000}, ServiceInstanceGUIDs: client.Filter{Values: serviceGUIDs}}
-			if bindings, err := conf.CfClient.ServiceCredentialBindings.ListAll(conf.CfCtx, &credBindingListOption); err != nil {
-				fmt.Printf("failed to list service bindings for source service instance %s: %s\n", instances[0].GUID, err)
-				return nil, err
-			} else {
-				if len(bindings) < 1 {
-					util.PrintfIfDebug("could not find any service bindings for %d source service instances with label %s:%s in space with guid %s\n", len(serviceGUIDs), conf.LabelNameSourceName, srcSpaceGuid, srcName)
-				} else {
-					for _, binding := range bindings {
-						destPort := 8080
-						if binding.Metadata.Labels[conf.LabelNamePort] != nil && *binding.Metadata.Labels[conf.LabelNamePort] != "0" {
-							destPort, _ = strconv.Atoi(*binding.Metadata.Labels[conf.LabelNamePort])
-						}
-						destProtocol := conf.LabelValueProtocolTCP
-						if binding.Metadata.Labels[conf.LabelNameProtocol] != nil && *binding.Metadata.Labels[conf.LabelNameProtocol] != "" {
-							destProtocol = *binding.Metadata.Labels[conf.LabelNameProtocol]
-						}
-						policy := model.NetworkPolicyLabels{Source: srcAppGuid, SourceName: util.Guid2AppName(srcAppGuid), Destination: binding.Relationships.App.Data.GUID, DestinationName: util.Guid2AppName(binding.Relationships.App.Data.GUID), Protocol: destProtocol, Port: destPort}
-						policyLabels = append(policyLabels, policy)
-					}
-				}
+func validProtocol(protocol string) bool {
+	return protocol == "" || protocol == conf.LabelValueProtocolTCP || protocol == conf.LabelValueProtocolUDP || protocol == conf.ProtocolBoth
+}
+
+// destinationPortsFromParameters - Returns the destination ports for the (validated) binding parameters, the default is 8080/tcp. Protocol "both" results in a tcp and an udp entry,
+// entries in the ports list without a protocol get the protocol parameter.
+func destinationPortsFromParameters(serviceBindingParms model.ServiceBindingParameters) []model.DestinationPort {
+	destinationPorts := make([]model.DestinationPort, 0)
+	add := func(ports model.Ports, protocol string) {
+		switch protocol {
+		case conf.ProtocolBoth:
+			destinationPorts = append(destinationPorts, model.DestinationPort{Ports: ports, Protocol: conf.LabelValueProtocolTCP}, model.DestinationPort{Ports: ports, Protocol: conf.LabelValueProtocolUDP})
+		case "":
+			destinationPorts = append(destinationPorts, model.DestinationPort{Ports: ports, Protocol: conf.LabelValueProtocolTCP})
+		default:
+			destinationPorts = append(destinationPorts, model.DestinationPort{Ports: ports, Protocol: protocol})
+		}
+	}
+	if len(serviceBindingParms.Ports) > 0 {
+		for _, portProtocol := range serviceBindingParms.Ports {
+			protocol := portProtocol.Protocol
+			if protocol == "" {
+				protocol = serviceBindingParms.Protocol
 			}
+			add(model.Ports{Start: portProtocol.Port, End: portProtocol.Port}, protocol)
+		}
+	} else if serviceBindingParms.StartPort != 0 {
+		add(model.Ports{Start: serviceBindingParms.StartPort, End: serviceBindingParms.EndPort}, serviceBindingParms.Protocol)
+	} else {
+		port := 8080
+		if serviceBindingParms.Port != 0 {
+			port = serviceBindingParms.Port
 		}
+		add(model.Ports{Start: port, End: port}, serviceBindingParms.Protocol)
 	}
-	return policyLabels, nil
+	return destinationPorts
 }
 
-// policies4Destination - Returns the policy labels for the service instance with the given name and app guid for the app that is being bound. The source service instance is identified by the label name=srcName
-func policies4Destination(srcName string, srcSpace string, srcOrg string, destAppGuid string, port int, protocol string) (policyLabels []model.NetworkPolicyLabels, err error) {
-	// first get the spaceGUID of the given org and space name
-	var spaceGuid, orgGuid string
-	orgListOptions := client.OrganizationListOptions{Names: client.Filter{Values: []string{srcOrg}}}
-	if org, err := conf.CfClient.Organizations.Single(conf.CfCtx, &orgListOptions); err != nil {
-		fmt.Printf("failed to get org with name %s: %s\n", srcOrg, err)
+// policies4Source - Returns the policy labels for the given source and app guid for the app that is being bound. The destination service instances (in other spaces) refer to the source
+// with the labels sourceName/sourceSpace/sourceOrg, or with the label npsb.dest.src.<hash> if they refer to more than one source.
+func policies4Source(srcName string, srcSpaceGuid string, srcAppGuid string) (policyLabels []model.NetworkPolicyLabels, err error) {
+	source, err := util.SourceReferenceOf(srcName, srcSpaceGuid)
+	if err != nil {
 		return nil, err
-	} else {
-		orgGuid = org.GUID
 	}
-	spaceListOptions := client.SpaceListOptions{Names: client.Filter{Values: []string{srcSpace}}, OrganizationGUIDs: client.Filter{Values: []string{orgGuid}}}
-	if space, err := conf.CfClient.Spaces.Single(conf.CfCtx, &spaceListOptions); err != nil {
-		fmt.Printf("failed to get space with name %s in org with name %s: %s\n", srcSpace, srcOrg, err)
+	destinations, err := destinationMembers(source)
+	if err != nil {
 		return nil, err
-	} else {
-		spaceGuid = space.GUID
 	}
-	policyLabels = make([]model.NetworkPolicyLabels, 0)
-	// find all service instances with label name=srcName
-	labelSelector := client.LabelSelector{}
-	labelSelector.EqualTo(conf.LabelNameName, srcName)
-	instanceListOption := client.ServiceInstanceListOptions{SpaceGUIDs: client.Filter{Values: []string{spaceGuid}}, ListOptions: &client.ListOptions{LabelSel: labelSelector}}
-	if instances, err := conf.CfClient.ServiceInstances.ListAll(conf.CfCtx, &instanceListOption); err != nil {
-		fmt.Printf("failed to list service instances with label %s=%s: %s\n", conf.LabelNameName, srcName, err)
+	policyLabels = make([]model.NetworkPolicyLabels, 0, len(destinations))
+	for _, destination := range destinations {
+		policy := model.NetworkPolicyLabels{Source: srcAppGuid, SourceName: util.Guid2AppName(srcAppGuid), Destination: destination.Id, DestinationName: util.Guid2AppName(destination.Id), Protocol: destination.Protocol, Port: destination.Ports.Start, EndPort: destination.Ports.End}
+		policyLabels = append(policyLabels, policy)
+	}
+	return policyLabels, nil
+}
+
+// destinationMembers - Returns the destination apps (with port and protocol) of all destination service instances that refer to the given source, the bound apps or the apps matching their app selector
+func destinationMembers(source model.SourceReference) ([]model.Destination, error) {
+	destinations := make([]model.Destination, 0)
+	// find all destination service instances that refer to this source, with the single source labels or with the label for this source
+	instances, err := util.ReferringDestinations(source)
+	if err != nil {
+		fmt.Println(err)
 		return nil, err
-	} else {
-		// this should always be a single instance or none
-		if len(instances) < 1 {
-			util.PrintfIfDebug("could not find any service instance with label %s=%s\n", conf.LabelNameName, srcName)
-		} else {
-			credBindingListOption := client.ServiceCredentialBindingListOptions{ListOptions: &client.ListOptions{PerPage: 1000}, ServiceInstanceGUIDs: client.Filter{Values: []string{instances[0].GUID}}}
-			if bindings, err := conf.CfClient.ServiceCredentialBindings.ListAll(conf.CfCtx, &credBindingListOption); err != nil {
-				fmt.Printf("failed to list service bindings for destination service instance %s: %s\n", instances[0].GUID, err)
-				return nil, err
-			} else {
-				if len(bindings) < 1 {
-					util.PrintfIfDebug("could not find any service bindings for service instance %s\n", instances[0].GUID)
-				} else {
-					for _, binding := range bindings {
-						destPort := 8080
-						if port != 0 {
-							destPort = port
-						}
-						destProtocol := conf.LabelValueProtocolTCP
-						if protocol != "" {
-							destProtocol = protocol
-						}
-						policy := model.NetworkPolicyLabels{Source: binding.Relationships.App.Data.GUID, SourceName: util.Guid2AppName(binding.Relationships.App.Data.GUID), Destination: destAppGuid, DestinationName: util.Guid2AppName(destAppGuid), Protocol: destProtocol, Port: destPort}
-						policyLabels = append(policyLabels, policy)
-					}
-				}
+	}
+	serviceGUIDs := make([]string, 0)
+	for _, instance := range instances {
+		// the apps matching the app selector of a destination are members with the ports of the instance, they have no bindings
+		if util.AppSelector(instance.Metadata) == "" {
+			serviceGUIDs = append(serviceGUIDs, instance.GUID)
+			continue
+		}
+		destAppGuids, err := util.MemberApps(instance)
+		if err != nil {
+			fmt.Printf("failed to get the apps of destination service instance %s: %s\n", instance.GUID, err)
+			return nil, err
+		}
+		for _, destAppGuid := range destAppGuids {
+			for _, destinationPort := range util.DestinationPortsFromMetadata(instance.Metadata) {
+				destinations = append(destinations, model.Destination{Id: destAppGuid, Protocol: destinationPort.Protocol, Ports: destinationPort.Ports})
 			}
 		}
 	}
+	// can be multiple (many) instances
+	if len(serviceGUIDs) < 1 {
+		util.PrintfIfDebug("could not find any destination service instances for source %s\n", source)
+		return destinations, nil
+	}
+	util.PrintfIfDebug("found %d destination service instances for source %s\n", len(serviceGUIDs), source)
+	credBindingListOption := client.ServiceCredentialBindingListOptions{ListOptions: &client.ListOptions{PerPage: 1000}, ServiceInstanceGUIDs: client.Filter{Values: serviceGUIDs}}
+	bindings, err := conf.CfClient.ServiceCredentialBindings.ListAll(conf.CfCtx, &credBindingListOption)
+	if err != nil {
+		fmt.Printf("failed to list service bindings for the destination service instances of source %s: %s\n", source, err)
+		return nil, err
+	}
+	if len(bindings) < 1 {
+		util.PrintfIfDebug("could not find any service bindings for %d destination service instances of source %s\n", len(serviceGUIDs), source)
+	}
+	for _, binding := range bindings {
+		for _, destinationPort := range util.DestinationPortsFromMetadata(binding.Metadata) {
+			destinations = append(destinations, model.Destination{Id: binding.Relationships.App.Data.GUID, Protocol: destinationPort.Protocol, Ports: destinationPort.Ports})
+		}
+	}
+	return destinations, nil
+}
+
+// policies4Destination - Returns the policy labels for the service instance with the given name and app guid for the app that is being bound. The source service instance is identified by the label name=srcName
+func policies4Destination(srcName string, srcSpace string, srcOrg string, destAppGuid string, destinationPorts []model.DestinationPort) (policyLabels []model.NetworkPolicyLabels, err error) {
+	sourceAppGuids, err := sourceMembers(model.SourceReference{Name: srcName, Space: srcSpace, Org: srcOrg})
+	if err != nil {
+		return nil, err
+	}
+	policyLabels = make([]model.NetworkPolicyLabels, 0)
+	for _, sourceAppGuid := range sourceAppGuids {
+		for _, destinationPort := range destinationPorts {
+			policy := model.NetworkPolicyLabels{Source: sourceAppGuid, SourceName: util.Guid2AppName(sourceAppGuid), Destination: destAppGuid, DestinationName: util.Guid2AppName(destAppGuid), Protocol: destinationPort.Protocol, Port: destinationPort.Ports.Start, EndPort: destinationPort.Ports.End}
+			policyLabels = append(policyLabels, policy)
+		}
+	}
 	return policyLabels, nil
 }
+
+// sourceMembers - Returns the guids of the member apps of the given source: the bound apps, all apps in its space for scope=space, or the apps matching its app selector
+func sourceMembers(source model.SourceReference) ([]string, error) {
+	instance, err := util.FindSourceInstance(source)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	if instance == nil {
+		util.PrintfIfDebug("could not find source service instance %s\n", source)
+		return make([]string, 0), nil
+	}
+	sourceAppGuids, err := util.MemberApps(instance)
+	if err != nil {
+		fmt.Printf("failed to get the apps of source service instance %s: %s\n", instance.GUID, err)
+		return nil, err
+	}
+	if len(sourceAppGuids) < 1 {
+		util.PrintfIfDebug("could not find any apps for source service instance %s\n", instance.GUID)
+	}
+	return sourceAppGuids, nil
+}
@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rabobank/npsb/backend"
+	"github.com/rabobank/npsb/conf"
+	"github.com/rabobank/npsb/model"
+	"github.com/rabobank/npsb/registry"
+)
+
+// fakeBackend - An in-memory policy backend, the calls with the numbers in failCalls (counting the Create and Delete calls from 1) fail
+type fakeBackend struct {
+	policies  map[string]model.NetworkPolicy
+	touched   map[string]bool // the keys of the policies that were created or deleted
+	calls     int
+	failCalls []int
+}
+
+func (b *fakeBackend) apply(policies []model.NetworkPolicy, create bool) error {
+	b.calls++
+	for _, failCall := range b.failCalls {
+		if b.calls == failCall {
+			return fmt.Errorf("%w: injected failure of call %d", backend.ErrUnavailable, b.calls)
+		}
+	}
+	for _, policy := range policies {
+		b.touched[policy.Key()] = true
+		if create {
+			b.policies[policy.Key()] = policy
+		} else {
+			delete(b.policies, policy.Key())
+		}
+	}
+	return nil
+}
+
+func (b *fakeBackend) Create(policies []model.NetworkPolicy) error {
+	return b.apply(policies, true)
+}
+
+func (b *fakeBackend) Delete(policies []model.NetworkPolicy) error {
+	return b.apply(policies, false)
+}
+
+func (b *fakeBackend) List(appGuids []string) ([]model.NetworkPolicy, error) {
+	policies := make([]model.NetworkPolicy, 0)
+	for _, policy := range b.policies {
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+func (b *fakeBackend) keys() []string {
+	keys := make([]string, 0, len(b.policies))
+	for key := range b.policies {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// setupApplyTest - Starts with an empty registry in a temporary file and a fake backend with the given policies
+func setupApplyTest(t *testing.T, existing []model.NetworkPolicy, failCalls ...int) *fakeBackend {
+	conf.RegistryFile = filepath.Join(t.TempDir(), "registry.json")
+	for _, entry := range registry.Entries(nil) {
+		registry.Forget([]model.NetworkPolicy{entry.Policy})
+	}
+	fake := &fakeBackend{policies: make(map[string]model.NetworkPolicy), touched: make(map[string]bool), failCalls: failCalls}
+	for _, policy := range existing {
+		fake.policies[policy.Key()] = policy
+	}
+	backend.Set(fake)
+	return fake
+}
+
+// testBindPolicies - Returns the given number of policies from one source app to destination apps, so they are applied in more than one chunk
+func testBindPolicies(count int) []model.NetworkPolicy {
+	policies := make([]model.NetworkPolicy, 0, count)
+	for ix := 0; ix < count; ix++ {
+		policies = append(policies, model.NetworkPolicy{Source: model.Source{Id: "src-app"}, Destination: model.Destination{Id: fmt.Sprintf("dst-app-%03d", ix), Protocol: conf.LabelValueProtocolTCP, Ports: model.Ports{Start: 8080, End: 8080}}})
+	}
+	return policies
+}
+
+func policyKeys(policies []model.NetworkPolicy) []string {
+	keys := make([]string, 0, len(policies))
+	for _, policy := range policies {
+		keys = append(keys, policy.Key())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func registryKeys(bindingGuid string) []string {
+	keys := make([]string, 0)
+	for _, entry := range registry.ForBinding(bindingGuid) {
+		keys = append(keys, entry.Policy.Key())
+	}
+	return keys
+}
+
+func TestApplyPoliciesBindRollback(t *testing.T) {
+	policies := testBindPolicies(2*conf.BindChunkSize + 10)
+	// the first policy was added by hand before the bind, it is in the first chunk
+	handMade := policies[:1]
+	fake := setupApplyTest(t, handMade, 2)
+
+	err := applyPolicies(conf.ActionBind, "instance-1", "binding-1", "user", policies, policies[1:], true, time.Time{}, nil)
+	if err == nil {
+		t.Fatalf("expected the failure of chunk 2")
+	}
+	// the new policies of chunk 1 are deleted again, the hand-made one is left alone
+	if !reflect.DeepEqual(fake.keys(), policyKeys(handMade)) {
+		t.Errorf("expected only the hand-made policy after the rollback, got %d policies", len(fake.policies))
+	}
+	if keys := registryKeys("binding-1"); len(keys) != 0 {
+		t.Errorf("expected no registered policies after the rollback, got %v", keys)
+	}
+}
+
+func TestApplyPoliciesBindSucceeds(t *testing.T) {
+	policies := testBindPolicies(2*conf.BindChunkSize + 10)
+	handMade := policies[:1]
+	fake := setupApplyTest(t, handMade)
+
+	var progress []int
+	if err := applyPolicies(conf.ActionBind, "instance-1", "binding-1", "user", policies, policies[1:], true, time.Time{}, func(applied int, total int) { progress = append(progress, applied) }); err != nil {
+		t.Fatalf("failed to apply policies: %s", err)
+	}
+	if !reflect.DeepEqual(fake.keys(), policyKeys(policies)) {
+		t.Errorf("expected %d policies, got %d", len(policies), len(fake.policies))
+	}
+	if !reflect.DeepEqual(progress, []int{conf.BindChunkSize, 2 * conf.BindChunkSize, len(policies)}) {
+		t.Errorf("unexpected progress %v", progress)
+	}
+	// only the new policies are registered, with the binding they were created for
+	if keys := registryKeys("binding-1"); !reflect.DeepEqual(keys, policyKeys(policies[1:])) {
+		t.Errorf("expected the %d new policies to be registered, got %d", len(policies)-1, len(keys))
+	}
+	if entry, found := registry.Get(policies[1]); !found || entry.InstanceGuid != "instance-1" || entry.User != "user" {
+		t.Errorf("policy %s registered as %+v", policies[1].Key(), entry)
+	}
+}
+
+func TestApplyPoliciesUnbindRollback(t *testing.T) {
+	policies := testBindPolicies(3*conf.BindChunkSize + 10)
+	// the first policy was added by hand, the others are created by the broker and registered
+	handMade, owned := policies[:1], policies[1:]
+	fake := setupApplyTest(t, policies, 2)
+	registry.Record(owned, "instance-1", "binding-1", "user")
+
+	err := applyPolicies(conf.ActionUnbind, "instance-1", "binding-1", "user", policies, nil, true, time.Time{}, nil)
+	if err == nil {
+		t.Fatalf("expected the failure of chunk 2")
+	}
+	// the deleted policies of chunk 1 are created again, the hand-made one was never deleted
+	if !reflect.DeepEqual(fake.keys(), policyKeys(policies)) {
+		t.Errorf("expected all %d policies after the rollback, got %d", len(policies), len(fake.policies))
+	}
+	// the hand-made policy is neither deleted nor recreated
+	if fake.touched[handMade[0].Key()] {
+		t.Errorf("hand-made policy %s should not be touched by the unbind or its rollback", handMade[0].Key())
+	}
+	if fake.calls != 3 {
+		t.Errorf("expected 2 chunks and 1 rollback call to the backend, got %d calls", fake.calls)
+	}
+	// the registry is unchanged, the hand-made policy is not recorded
+	if keys := registryKeys("binding-1"); !reflect.DeepEqual(keys, policyKeys(owned)) {
+		t.Errorf("expected the %d owned policies to stay registered, got %d", len(owned), len(keys))
+	}
+	if _, found := registry.Get(handMade[0]); found {
+		t.Errorf("hand-made policy %s should not be registered", handMade[0].Key())
+	}
+}
+
+func TestApplyPoliciesUnbindRollbackFails(t *testing.T) {
+	policies := testBindPolicies(2*conf.BindChunkSize + 10)
+	// chunk 2 fails, and the rollback of chunk 1 as well
+	fake := setupApplyTest(t, policies, 2, 3)
+	registry.Record(policies, "instance-1", "binding-1", "user")
+
+	if err := applyPolicies(conf.ActionUnbind, "instance-1", "binding-1", "user", policies, nil, true, time.Time{}, nil); err == nil {
+		t.Fatalf("expected the failure of chunk 2")
+	}
+	// the policies of chunk 1 are deleted and could not be recreated, they are no longer registered, the others are
+	if !reflect.DeepEqual(fake.keys(), policyKeys(policies[conf.BindChunkSize:])) {
+		t.Errorf("expected the policies after chunk 1 to exist, got %d policies", len(fake.policies))
+	}
+	if keys := registryKeys("binding-1"); !reflect.DeepEqual(keys, policyKeys(policies[conf.BindChunkSize:])) {
+		t.Errorf("expected the %d policies that still exist to stay registered, got %d", len(policies)-conf.BindChunkSize, len(keys))
+	}
+}
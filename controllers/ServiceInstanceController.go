@@ -6,13 +6,18 @@ import (
 	"fmt"
 	"github.com/cloudfoundry/go-cfclient/v3/client"
 	"github.com/cloudfoundry/go-cfclient/v3/resource"
+	"net"
 	"net/http"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/rabobank/npsb/backend"
 	"github.com/rabobank/npsb/conf"
 	"github.com/rabobank/npsb/model"
+	"github.com/rabobank/npsb/registry"
 	"github.com/rabobank/npsb/util"
 )
 
@@ -24,6 +29,10 @@ func Catalog(w http.ResponseWriter, r *http.Request) {
 func CreateOrUpdateServiceInstance(w http.ResponseWriter, r *http.Request) {
 	var err error
 	serviceInstanceId := mux.Vars(r)["service_instance_guid"]
+	if r.URL.Query().Get("accepts_incomplete") != "true" {
+		util.WriteHttpResponse(w, http.StatusUnprocessableEntity, model.BrokerError{Error: "AsyncRequired", Description: "this service broker only supports asynchronous provisioning, the request should have accepts_incomplete=true", InstanceUsable: false, UpdateRepeatable: false})
+		return
+	}
 	var serviceInstance model.ServiceInstance
 	err = util.ProvisionObjectFromRequest(r, &serviceInstance)
 	if err != nil {
@@ -39,46 +48,651 @@ func CreateOrUpdateServiceInstance(w http.ResponseWriter, r *http.Request) {
 
 	labels := make(map[string]*string)
 	labels[conf.LabelNameType] = &serviceInstanceParms.Type
+	annotations := make(map[string]*string)
 	if serviceInstanceParms.Type == conf.LabelValueTypeSrc {
 		labels[conf.LabelNameName] = &serviceInstanceParms.Name
+		// without the scope label only the bound apps are members
+		if serviceInstanceParms.Scope == conf.LabelValueScopeSpace {
+			labels[conf.LabelNameScope] = &serviceInstanceParms.Scope
+		} else {
+			labels[conf.LabelNameScope] = nil
+		}
+	} else if serviceInstanceParms.Type == conf.LabelValueTypeEgress {
+		destinations := strings.Join(serviceInstanceParms.Destinations, ",")
+		annotations[conf.AnnotationNameEgressDestinations] = &destinations
+		annotations[conf.AnnotationNameEgressPorts] = &serviceInstanceParms.Ports
+		annotations[conf.AnnotationNameEgressProtocol] = &serviceInstanceParms.Protocol
+	} else if len(serviceInstanceParms.Sources) > 0 {
+		// labels can not hold lists, the sources are in an annotation, and there is a label per source so the destinations of a source can be found with a label selector
+		sources := util.FormatSources(serviceInstanceParms.Sources)
+		annotations[conf.AnnotationNameSources] = &sources
+		labelValue := "true"
+		for _, source := range serviceInstanceParms.Sources {
+			labels[util.SourceLabelName(source)] = &labelValue
+		}
+		labels[conf.LabelNameSourceName] = nil
+		labels[conf.LabelNameSourceSpace] = nil
+		labels[conf.LabelNameSourceOrg] = nil
 	} else {
 		labels[conf.LabelNameSourceName] = &serviceInstanceParms.SourceName
 		labels[conf.LabelNameSourceSpace] = &serviceInstanceParms.SourceSpace
 		labels[conf.LabelNameSourceOrg] = &serviceInstanceParms.SourceOrg
 	}
-	annotations := make(map[string]*string)
 	annotations[conf.AnnotationNameDesc] = &serviceInstanceParms.Description
+	// labels can not hold a selector, the selector is in an annotation, the label only marks the instance so it can be found with a label selector
+	if serviceInstanceParms.AppSelector != "" {
+		labelValue := "true"
+		labels[conf.LabelNameAppSelector] = &labelValue
+		annotations[conf.AnnotationNameAppSelector] = &serviceInstanceParms.AppSelector
+		if serviceInstanceParms.Type == conf.LabelValueTypeDest {
+			ports := util.FormatDestinationPorts(destinationPortsFromParameters(model.ServiceBindingParameters{Ports: serviceInstanceParms.AppPorts}))
+			annotations[conf.AnnotationNamePorts] = &ports
+		}
+	} else if serviceInstanceParms.Type != conf.LabelValueTypeEgress {
+		labels[conf.LabelNameAppSelector] = nil
+		annotations[conf.AnnotationNameAppSelector] = nil
+		annotations[conf.AnnotationNamePorts] = nil
+	}
 
 	serviceInstanceUpdate := resource.ServiceInstanceManagedUpdate{Metadata: &resource.Metadata{Labels: labels, Annotations: annotations}}
 
-	go func() {
-		time.Sleep(3 * time.Second)
-		if _, si, err := conf.CfClient.ServiceInstances.UpdateManaged(conf.CfCtx, serviceInstanceId, &serviceInstanceUpdate); err != nil {
-			fmt.Printf("failed to update service instance %s: %s\n", serviceInstanceId, err)
+	// The labels are written by an asynchronous operation, the CC polls the last_operation endpoint until the labels are written or the operation failed.
+	// The CC can hold a lock on the instance while the operation is in progress, updating it then gets (CF-AsyncServiceInstanceOperationInProgress|60016),
+	// a failed attempt is retried with an increasing delay (see util.RunOperation), the operation only succeeds once the labels are written.
+	var securityGroupGuid string
+	operationId := util.RunOperation(serviceInstanceId, "provisioning service instance", func() (string, error) {
+		var err error
+		// for an egress instance the security group is created first, the instance is labelled with its guid
+		if serviceInstanceParms.Type == conf.LabelValueTypeEgress && securityGroupGuid == "" {
+			if securityGroupGuid, err = util.EnsureEgressSecurityGroup(serviceInstanceId, serviceInstance.Context.SpaceGuid, serviceInstanceParms); err != nil {
+				return "", err
+			}
+			labels[conf.LabelNameEgressSecurityGroup] = &securityGroupGuid
+		}
+		_, si, err := conf.CfClient.ServiceInstances.UpdateManaged(conf.CfCtx, serviceInstanceId, &serviceInstanceUpdate)
+		if err != nil {
+			if resource.IsAsyncServiceInstanceOperationInProgressError(err) {
+				return "", fmt.Errorf("the service instance is still locked by the CC: %s", err)
+			}
+			return "", err
+		}
+		labelsToPrint := ""
+		for _, labelName := range conf.AllLabelNames {
+			if labelValue, found := si.Metadata.Labels[labelName]; found && labelValue != nil && *labelValue != "" {
+				labelsToPrint = fmt.Sprintf("%s %s=%s", labelsToPrint, labelName, *labelValue)
+			}
+		}
+		fmt.Printf("service instance %s (%s) updated with labels %s\n", serviceInstanceId, si.Name, labelsToPrint)
+		return fmt.Sprintf("service instance labelled with%s", labelsToPrint), nil
+	})
+
+	util.WriteHttpResponse(w, http.StatusAccepted, model.CreateServiceInstanceResponse{ServiceId: serviceInstance.ServiceId, PlanId: serviceInstance.PlanId, Operation: operationId})
+	return
+}
+
+// UpdateServiceInstance - Updates the description or name of a source instance, or the source a destination instance refers to. The network policies for the current members of the instance
+// are rewired: the delta between the policies before and after the update is applied with the new labels, if any step fails the earlier steps are rolled back.
+func UpdateServiceInstance(w http.ResponseWriter, r *http.Request) {
+	serviceInstanceId := mux.Vars(r)["service_instance_guid"]
+	if r.URL.Query().Get("accepts_incomplete") != "true" {
+		util.WriteHttpResponse(w, http.StatusUnprocessableEntity, model.BrokerError{Error: "AsyncRequired", Description: "this service broker only supports asynchronous updates, the request should have accepts_incomplete=true", InstanceUsable: true, UpdateRepeatable: true})
+		return
+	}
+	var updateRequest model.UpdateServiceInstance
+	if err := util.ProvisionObjectFromRequest(r, &updateRequest); err != nil {
+		util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: err.Error(), InstanceUsable: true, UpdateRepeatable: false})
+		return
+	}
+	serviceInstance, err := conf.CfClient.ServiceInstances.Get(conf.CfCtx, serviceInstanceId)
+	if err != nil || serviceInstance.Metadata == nil || serviceInstance.Metadata.Labels[conf.LabelNameType] == nil {
+		util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: fmt.Sprintf("service instance %s not found or not labelled (error: %v)", serviceInstanceId, err), InstanceUsable: true, UpdateRepeatable: false})
+		return
+	}
+	labels, annotations, err := validateUpdateParameters(updateRequest, serviceInstance)
+	if err != nil {
+		util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: err.Error(), InstanceUsable: true, UpdateRepeatable: true})
+		return
+	}
+	user := originatingUser(r)
+
+	// the operation only succeeds when the policies are created, the labels are written (see CreateOrUpdateServiceInstance) and the policies that are no longer needed are deleted
+	rewire := &instanceRewire{serviceInstance: serviceInstance, labels: labels, annotations: annotations, user: user}
+	operationId := util.RunOperationWithRollback(serviceInstanceId, "updating service instance", rewire.run, rewire.rollback)
+	util.WriteHttpResponse(w, http.StatusAccepted, model.UpdateServiceInstanceResponse{Operation: operationId})
+}
+
+// validateUpdateParameters - Validates the parameters of an update, only the description and name of a source and the sourceName/sourceSpace/sourceOrg of a destination can be changed.
+// Returns the labels and annotations to update (a nil value removes a label or annotation).
+func validateUpdateParameters(updateRequest model.UpdateServiceInstance, serviceInstance *resource.ServiceInstance) (labels map[string]*string, annotations map[string]*string, err error) {
+	const (
+		ParmType     = "type"
+		ParmName     = "name"
+		ParmDesc     = "description"
+		ParmSrcName  = "sourceName"
+		ParmSrcSpace = "sourceSpace"
+		ParmSrcOrg   = "sourceOrg"
+	)
+	labels = make(map[string]*string)
+	annotations = make(map[string]*string)
+	if updateRequest.PlanId != "" && updateRequest.PreviousValues.PlanId != "" && updateRequest.PlanId != updateRequest.PreviousValues.PlanId {
+		return nil, nil, fmt.Errorf("the plan of a service instance can not be changed")
+	}
+	if len(updateRequest.Parameters) == 0 {
+		return labels, annotations, nil
+	}
+	instanceType := *serviceInstance.Metadata.Labels[conf.LabelNameType]
+	allowed := map[string]bool{ParmType: true}
+	if instanceType == conf.LabelValueTypeSrc {
+		allowed[ParmName], allowed[ParmDesc] = true, true
+	} else if instanceType == conf.LabelValueTypeDest {
+		allowed[ParmSrcName], allowed[ParmSrcSpace], allowed[ParmSrcOrg] = true, true, true
+	}
+	for parm := range updateRequest.Parameters {
+		if !allowed[parm] {
+			return nil, nil, fmt.Errorf("parameter \"%s\" can not be updated for type \"%s\" service instances", parm, instanceType)
+		}
+	}
+	var serviceInstanceParms model.ServiceInstanceParameters
+	body, _ := json.Marshal(updateRequest.Parameters)
+	if err = json.Unmarshal(body, &serviceInstanceParms); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal parameters: %s", err)
+	}
+	if serviceInstanceParms.Type != "" && serviceInstanceParms.Type != instanceType {
+		return nil, nil, fmt.Errorf("parameter \"%s\" can not be changed, the service instance has type \"%s\"", ParmType, instanceType)
+	}
+
+	// the checks on the name and the source refer to the space and org the instance is in
+	space := util.GetSpaceByGuidCached(serviceInstance.Relationships.Space.Data.GUID)
+	if space == nil {
+		return nil, nil, fmt.Errorf("failed to get space with guid %s", serviceInstance.Relationships.Space.Data.GUID)
+	}
+	org := util.GetOrgByGuidCached(space.Relationships.Organization.Data.GUID)
+	if org == nil {
+		return nil, nil, fmt.Errorf("failed to get org with guid %s", space.Relationships.Organization.Data.GUID)
+	}
+	instanceInContext := model.ServiceInstance{Context: model.InstanceContext{SpaceGuid: space.GUID, SpaceName: space.Name, OrganizationGuid: org.GUID, OrganizationName: org.Name}}
+
+	if _, found := updateRequest.Parameters[ParmDesc]; found {
+		if len(serviceInstanceParms.Description) > 128 {
+			return nil, nil, fmt.Errorf("parameter \"%s\" is invalid, maximum length is 128, you have %d", ParmDesc, len(serviceInstanceParms.Description))
+		}
+		annotations[conf.AnnotationNameDesc] = &serviceInstanceParms.Description
+	}
+	if _, found := updateRequest.Parameters[ParmName]; found {
+		if !parameterValueRegex.MatchString(serviceInstanceParms.Name) {
+			return nil, nil, fmt.Errorf("parameter \"%s\" is invalid, should match regex %s", ParmName, parameterValueRegex.String())
+		}
+		if currentName := serviceInstance.Metadata.Labels[conf.LabelNameName]; currentName == nil || *currentName != serviceInstanceParms.Name {
+			if instanceWithNameExists(serviceInstanceParms.Name, instanceInContext) {
+				return nil, nil, fmt.Errorf("a network-policies service with label \"%s\"=\"%s\" is already taken", conf.LabelNameName, serviceInstanceParms.Name)
+			}
+			labels[conf.LabelNameName] = &serviceInstanceParms.Name
+		}
+	}
+	if serviceInstanceParms.SourceName != "" || serviceInstanceParms.SourceSpace != "" || serviceInstanceParms.SourceOrg != "" {
+		source := model.SourceReference{Name: serviceInstanceParms.SourceName, Space: serviceInstanceParms.SourceSpace, Org: serviceInstanceParms.SourceOrg}
+		if err = validateSourceReference(source, instanceInContext, ParmSrcName, ParmSrcSpace, ParmSrcOrg); err != nil {
+			return nil, nil, err
+		}
+		labels[conf.LabelNameSourceName] = &serviceInstanceParms.SourceName
+		labels[conf.LabelNameSourceSpace] = &serviceInstanceParms.SourceSpace
+		labels[conf.LabelNameSourceOrg] = &serviceInstanceParms.SourceOrg
+		// the new source replaces all current sources, also the ones of the sources parameter and the dangling ones
+		if serviceInstance.Metadata.Annotations[conf.AnnotationNameSources] != nil {
+			if sources, err := util.ParseSources(*serviceInstance.Metadata.Annotations[conf.AnnotationNameSources]); err == nil {
+				for _, oldSource := range sources {
+					labels[util.SourceLabelName(oldSource)] = nil
+				}
+			}
+			annotations[conf.AnnotationNameSources] = nil
+		}
+		annotations[conf.AnnotationNameDanglingSources] = nil
+	}
+	return labels, annotations, nil
+}
+
+// instanceRewire - The rewiring of the network policies of an updated service instance: the policies that are needed after the update are created, the labels are written and
+// the policies that are no longer needed are deleted. The steps that are done are remembered, so a retry of the operation continues where the previous attempt failed.
+type instanceRewire struct {
+	serviceInstance    *resource.ServiceInstance
+	labels             map[string]*string
+	annotations        map[string]*string
+	user               string
+	newPolicies        []model.NetworkPolicy
+	registeredToDelete []model.NetworkPolicy
+	policiesCreated    bool
+	labelsWritten      bool
+}
+
+// run - Creates the policies, writes the labels and deletes the policies that are no longer needed
+func (rewire *instanceRewire) run() (string, error) {
+	serviceInstance := rewire.serviceInstance
+	if len(rewire.labels) == 0 && len(rewire.annotations) == 0 {
+		return "nothing to update", nil
+	}
+	if !rewire.policiesCreated {
+		if err := rewire.createPolicies(); err != nil {
+			return "", err
+		}
+		rewire.policiesCreated = true
+	}
+	if !rewire.labelsWritten {
+		serviceInstanceUpdate := resource.ServiceInstanceManagedUpdate{Metadata: &resource.Metadata{Labels: rewire.labels, Annotations: rewire.annotations}}
+		if _, _, err := conf.CfClient.ServiceInstances.UpdateManaged(conf.CfCtx, serviceInstance.GUID, &serviceInstanceUpdate); err != nil {
+			if resource.IsAsyncServiceInstanceOperationInProgressError(err) {
+				return "", fmt.Errorf("the service instance is still locked by the CC: %s", err)
+			}
+			return "", fmt.Errorf("failed to update the labels of service instance %s: %s", serviceInstance.GUID, err)
+		}
+		rewire.labelsWritten = true
+		// the new policies are registered in memory even if the registry can not be saved, a retry does not record them again
+		if err := registry.Record(rewire.newPolicies, serviceInstance.GUID, "", rewire.user); err != nil {
+			return "", err
+		}
+	}
+	if len(rewire.registeredToDelete) > 0 {
+		if err := backend.Delete(rewire.registeredToDelete); err != nil {
+			return "", fmt.Errorf("failed to delete %d network policies: %s", len(rewire.registeredToDelete), err)
+		}
+		if err := registry.Forget(rewire.registeredToDelete); err != nil {
+			return "", err
+		}
+	}
+	fmt.Printf("service instance %s (%s) updated, created %d and deleted %d network policies\n", serviceInstance.GUID, serviceInstance.Name, len(rewire.newPolicies), len(rewire.registeredToDelete))
+	return fmt.Sprintf("service instance updated, created %d and deleted %d network policies", len(rewire.newPolicies), len(rewire.registeredToDelete)), nil
+}
+
+// createPolicies - Computes the network policies for the current members of the instance before and after the update, and creates the missing ones
+func (rewire *instanceRewire) createPolicies() error {
+	serviceInstance := rewire.serviceInstance
+	updatedMetadata := &resource.Metadata{Labels: make(map[string]*string), Annotations: make(map[string]*string)}
+	for name, value := range serviceInstance.Metadata.Labels {
+		updatedMetadata.Labels[name] = value
+	}
+	for name, value := range serviceInstance.Metadata.Annotations {
+		updatedMetadata.Annotations[name] = value
+	}
+	for name, value := range rewire.labels {
+		if value == nil {
+			delete(updatedMetadata.Labels, name)
+		} else {
+			updatedMetadata.Labels[name] = value
+		}
+	}
+	for name, value := range rewire.annotations {
+		if value == nil {
+			delete(updatedMetadata.Annotations, name)
 		} else {
-			labelsToPrint := ""
-			for _, labelName := range conf.AllLabelNames {
-				if labelValue, found := si.Metadata.Labels[labelName]; found && labelValue != nil && *labelValue != "" {
-					labelsToPrint = fmt.Sprintf("%s %s=%s", labelsToPrint, labelName, *labelValue)
+			updatedMetadata.Annotations[name] = value
+		}
+	}
+
+	currentPolicies, err := instancePolicies(serviceInstance, serviceInstance.Metadata)
+	if err != nil {
+		return err
+	}
+	updatedPolicies, err := instancePolicies(serviceInstance, updatedMetadata)
+	if err != nil {
+		return err
+	}
+	toCreate, toDelete := policyDelta(currentPolicies, updatedPolicies)
+
+	// policies that already exist are not registered as created by the broker, and only the policies the broker created are deleted
+	appGuids := make([]string, 0)
+	seenApps := make(map[string]bool)
+	for _, policy := range toCreate {
+		if !seenApps[policy.Source.Id] {
+			seenApps[policy.Source.Id] = true
+			appGuids = append(appGuids, policy.Source.Id)
+		}
+	}
+	newPolicies := make([]model.NetworkPolicy, 0)
+	if len(toCreate) > 0 {
+		existingPolicies, err := backend.List(appGuids)
+		if err != nil {
+			return fmt.Errorf("failed to get existing policies: %s", err)
+		}
+		existing := make(map[string]bool)
+		for _, policy := range existingPolicies {
+			existing[policy.Key()] = true
+		}
+		for _, policy := range toCreate {
+			if !existing[policy.Key()] {
+				newPolicies = append(newPolicies, policy)
+			}
+		}
+	}
+	registeredToDelete := make([]model.NetworkPolicy, 0)
+	for _, policy := range toDelete {
+		if registry.Contains(policy) {
+			registeredToDelete = append(registeredToDelete, policy)
+		}
+	}
+
+	if len(newPolicies) > 0 {
+		if err = backend.Create(newPolicies); err != nil {
+			// the policy server creates in chunks, the chunks that were created are deleted again
+			if rollbackErr := backend.Delete(newPolicies); rollbackErr != nil {
+				fmt.Printf("failed to roll back the creation of %d network policies for service instance %s: %s\n", len(newPolicies), serviceInstance.GUID, rollbackErr)
+			}
+			return fmt.Errorf("failed to create %d network policies: %s", len(newPolicies), err)
+		}
+	}
+	rewire.newPolicies, rewire.registeredToDelete = newPolicies, registeredToDelete
+	return nil
+}
+
+// rollback - Undoes the update when it keeps failing: the previous labels are restored, the created policies are deleted and the policies that were (partly) deleted already
+// are created again.
+func (rewire *instanceRewire) rollback(err error) {
+	serviceInstance := rewire.serviceInstance
+	if rewire.labelsWritten {
+		// restore the previous labels, a nil value removes the ones that were added
+		previousLabels := make(map[string]*string)
+		for name := range rewire.labels {
+			previousLabels[name] = serviceInstance.Metadata.Labels[name]
+		}
+		previousAnnotations := make(map[string]*string)
+		for name := range rewire.annotations {
+			previousAnnotations[name] = serviceInstance.Metadata.Annotations[name]
+		}
+		restore := resource.ServiceInstanceManagedUpdate{Metadata: &resource.Metadata{Labels: previousLabels, Annotations: previousAnnotations}}
+		if _, _, restoreErr := conf.CfClient.ServiceInstances.UpdateManaged(conf.CfCtx, serviceInstance.GUID, &restore); restoreErr != nil {
+			fmt.Printf("failed to restore the labels of service instance %s: %s\n", serviceInstance.GUID, restoreErr)
+		}
+		if len(rewire.registeredToDelete) > 0 {
+			if createErr := backend.Create(rewire.registeredToDelete); createErr != nil {
+				fmt.Printf("failed to recreate %d network policies for service instance %s: %s\n", len(rewire.registeredToDelete), serviceInstance.GUID, createErr)
+			}
+		}
+	}
+	if len(rewire.newPolicies) > 0 {
+		if deleteErr := backend.Delete(rewire.newPolicies); deleteErr != nil {
+			fmt.Printf("failed to roll back the creation of %d network policies for service instance %s: %s\n", len(rewire.newPolicies), serviceInstance.GUID, deleteErr)
+		} else if rewire.labelsWritten {
+			if forgetErr := registry.Forget(rewire.newPolicies); forgetErr != nil {
+				fmt.Printf("failed to remove %d rolled back network policies of service instance %s from the registry: %s\n", len(rewire.newPolicies), serviceInstance.GUID, forgetErr)
+			}
+		}
+	}
+	fmt.Printf("service instance %s could not be updated, the update is rolled back: %s\n", serviceInstance.GUID, err)
+}
+
+// instancePolicies - Returns the network policies for the current members of the service instance, as they would be with the given labels and annotations
+func instancePolicies(serviceInstance *resource.ServiceInstance, metadata *resource.Metadata) ([]model.NetworkPolicy, error) {
+	policies := make([]model.NetworkPolicy, 0)
+	switch *serviceInstance.Metadata.Labels[conf.LabelNameType] {
+	case conf.LabelValueTypeSrc:
+		if metadata.Labels[conf.LabelNameName] == nil {
+			return policies, nil
+		}
+		source, err := util.SourceReferenceOf(*metadata.Labels[conf.LabelNameName], serviceInstance.Relationships.Space.Data.GUID)
+		if err != nil {
+			return nil, err
+		}
+		sourceAppGuids, err := util.MemberApps(serviceInstance)
+		if err != nil {
+			return nil, err
+		}
+		destinations, err := destinationMembers(source)
+		if err != nil {
+			return nil, err
+		}
+		for _, sourceAppGuid := range sourceAppGuids {
+			for _, destination := range destinations {
+				policies = append(policies, model.NetworkPolicy{Source: model.Source{Id: sourceAppGuid}, Destination: destination})
+			}
+		}
+	case conf.LabelValueTypeDest:
+		destinations, err := destinationInstanceMembers(serviceInstance)
+		if err != nil {
+			return nil, err
+		}
+		for _, source := range util.InstanceSources(metadata) {
+			sourceAppGuids, err := sourceMembers(source)
+			if err != nil {
+				return nil, err
+			}
+			for _, sourceAppGuid := range sourceAppGuids {
+				for _, destination := range destinations {
+					policies = append(policies, model.NetworkPolicy{Source: model.Source{Id: sourceAppGuid}, Destination: destination})
 				}
 			}
-			fmt.Printf("service instance %s (%s) updated with labels %s\n", serviceInstanceId, si.Name, labelsToPrint)
 		}
-	}()
+	}
+	return policies, nil
+}
 
-	// If we respond with StatusAccepted, the CC will poll the last_operation endpoint, but the above routine cannot update the instance, it gets (CF-AsyncServiceInstanceOperationInProgress|60016):
-	// So, we are cheating here and respond with StatusOk, and the CC will not poll the last_operation endpoint, and we take the small risk that the instance is not (properly) updated by the above routine.
-	util.WriteHttpResponse(w, http.StatusCreated, model.CreateServiceInstanceResponse{ServiceId: serviceInstance.ServiceId, PlanId: serviceInstance.PlanId})
-	return
+// destinationInstanceMembers - Returns the member apps (with port and protocol) of a destination instance, the bound apps or the apps matching its app selector
+func destinationInstanceMembers(serviceInstance *resource.ServiceInstance) ([]model.Destination, error) {
+	destinations := make([]model.Destination, 0)
+	if util.AppSelector(serviceInstance.Metadata) != "" {
+		destAppGuids, err := util.MemberApps(serviceInstance)
+		if err != nil {
+			return nil, err
+		}
+		for _, destAppGuid := range destAppGuids {
+			for _, destinationPort := range util.DestinationPortsFromMetadata(serviceInstance.Metadata) {
+				destinations = append(destinations, model.Destination{Id: destAppGuid, Protocol: destinationPort.Protocol, Ports: destinationPort.Ports})
+			}
+		}
+		return destinations, nil
+	}
+	credBindingListOption := client.ServiceCredentialBindingListOptions{ListOptions: &client.ListOptions{PerPage: 1000}, ServiceInstanceGUIDs: client.Filter{Values: []string{serviceInstance.GUID}}}
+	bindings, err := conf.CfClient.ServiceCredentialBindings.ListAll(conf.CfCtx, &credBindingListOption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list service bindings for service instance %s: %s", serviceInstance.GUID, err)
+	}
+	for _, binding := range bindings {
+		for _, destinationPort := range util.DestinationPortsFromMetadata(binding.Metadata) {
+			destinations = append(destinations, model.Destination{Id: binding.Relationships.App.Data.GUID, Protocol: destinationPort.Protocol, Ports: destinationPort.Ports})
+		}
+	}
+	return destinations, nil
 }
 
+// policyDelta - Returns the policies that are in updated but not in current (to create) and the ones that are in current but not in updated (to delete), both without duplicates
+func policyDelta(current []model.NetworkPolicy, updated []model.NetworkPolicy) (toCreate []model.NetworkPolicy, toDelete []model.NetworkPolicy) {
+	currentKeys := make(map[string]bool)
+	for _, policy := range current {
+		currentKeys[policy.Key()] = true
+	}
+	updatedKeys := make(map[string]bool)
+	for _, policy := range updated {
+		if !updatedKeys[policy.Key()] && !currentKeys[policy.Key()] {
+			toCreate = append(toCreate, policy)
+		}
+		updatedKeys[policy.Key()] = true
+	}
+	seen := make(map[string]bool)
+	for _, policy := range current {
+		if !updatedKeys[policy.Key()] && !seen[policy.Key()] {
+			toDelete = append(toDelete, policy)
+		}
+		seen[policy.Key()] = true
+	}
+	return toCreate, toDelete
+}
+
+// GetServiceInstance - Returns the parameters of the service instance, rebuilt from its npsb.* labels and annotations (for cf service --params)
+func GetServiceInstance(w http.ResponseWriter, r *http.Request) {
+	serviceInstanceId := mux.Vars(r)["service_instance_guid"]
+	serviceInstance, err := conf.CfClient.ServiceInstances.Get(conf.CfCtx, serviceInstanceId)
+	if err != nil || serviceInstance.Metadata == nil || serviceInstance.Metadata.Labels[conf.LabelNameType] == nil {
+		util.PrintfIfDebug("service instance %s not found or not labelled (error: %v)\n", serviceInstanceId, err)
+		util.WriteHttpResponse(w, http.StatusNotFound, model.BrokerError{Error: "NotFound", Description: fmt.Sprintf("service instance %s not found", serviceInstanceId)})
+		return
+	}
+	util.WriteHttpResponse(w, http.StatusOK, model.GetServiceInstanceResponse{ServiceId: conf.Catalog.Services[0].Id, PlanId: conf.Catalog.Services[0].Plans[0].Id, Parameters: instanceParameters(serviceInstance.Metadata)})
+}
+
+// instanceParameters - Rebuilds the create parameters of a service instance from its labels and annotations
+func instanceParameters(metadata *resource.Metadata) map[string]interface{} {
+	labelValue := func(name string) string {
+		if metadata.Labels[name] == nil {
+			return ""
+		}
+		return *metadata.Labels[name]
+	}
+	annotationValue := func(name string) string {
+		if metadata.Annotations[name] == nil {
+			return ""
+		}
+		return *metadata.Annotations[name]
+	}
+	parameters := make(map[string]interface{})
+	parameters["type"] = labelValue(conf.LabelNameType)
+	switch labelValue(conf.LabelNameType) {
+	case conf.LabelValueTypeSrc:
+		parameters["name"] = labelValue(conf.LabelNameName)
+		if description := annotationValue(conf.AnnotationNameDesc); description != "" {
+			parameters["description"] = description
+		}
+		if util.IsSpaceScoped(metadata) {
+			parameters["scope"] = conf.LabelValueScopeSpace
+		}
+	case conf.LabelValueTypeDest:
+		if sources := annotationValue(conf.AnnotationNameSources); sources != "" {
+			if parsed, err := util.ParseSources(sources); err == nil {
+				parameters["sources"] = parsed
+			}
+		} else {
+			parameters["sourceName"] = labelValue(conf.LabelNameSourceName)
+			parameters["sourceSpace"] = labelValue(conf.LabelNameSourceSpace)
+			parameters["sourceOrg"] = labelValue(conf.LabelNameSourceOrg)
+		}
+		if util.AppSelector(metadata) != "" {
+			appPorts := make([]model.PortProtocolParameter, 0)
+			for _, destinationPort := range util.DestinationPortsFromMetadata(metadata) {
+				appPorts = append(appPorts, model.PortProtocolParameter{Port: destinationPort.Ports.Start, Protocol: destinationPort.Protocol})
+			}
+			parameters["appPorts"] = appPorts
+		}
+	case conf.LabelValueTypeEgress:
+		if destinations := annotationValue(conf.AnnotationNameEgressDestinations); destinations != "" {
+			parameters["destinations"] = strings.Split(destinations, ",")
+		}
+		if ports := annotationValue(conf.AnnotationNameEgressPorts); ports != "" {
+			parameters["ports"] = ports
+		}
+		parameters["protocol"] = annotationValue(conf.AnnotationNameEgressProtocol)
+	}
+	if selector := util.AppSelector(metadata); selector != "" {
+		parameters["appSelector"] = selector
+	}
+	return parameters
+}
+
+// GetServiceInstanceLastOperation - Returns the state of the last (asynchronous) operation for the service instance, the CC polls this endpoint after we responded with StatusAccepted
+func GetServiceInstanceLastOperation(w http.ResponseWriter, r *http.Request) {
+	serviceInstanceId := mux.Vars(r)["service_instance_guid"]
+	operationId := r.URL.Query().Get("operation")
+	if operation, found := util.GetOperation(serviceInstanceId, operationId); found {
+		util.WriteHttpResponse(w, http.StatusOK, operation)
+		return
+	}
+
+	// we don't know the operation (i.e. the broker was restarted), the labels on the service instance tell us if it completed
+	if serviceInstance, err := conf.CfClient.ServiceInstances.Get(conf.CfCtx, serviceInstanceId); err != nil {
+		fmt.Printf("failed to get service instance %s: %s\n", serviceInstanceId, err)
+		util.WriteHttpResponse(w, http.StatusOK, model.Operation{State: conf.OperationStateFailed, Description: fmt.Sprintf("operation %s is unknown and service instance could not be found: %s", operationId, err)})
+	} else {
+		if serviceInstance.Metadata != nil && serviceInstance.Metadata.Labels[conf.LabelNameType] != nil {
+			util.WriteHttpResponse(w, http.StatusOK, model.Operation{State: conf.OperationStateSucceeded, Description: "service instance is labelled"})
+		} else {
+			util.WriteHttpResponse(w, http.StatusOK, model.Operation{State: conf.OperationStateFailed, Description: fmt.Sprintf("operation %s is unknown (the broker was probably restarted) and the service instance has no labels, please recreate the service instance", operationId)})
+		}
+	}
+}
+
+// DeleteServiceInstance - Deprovisions a service instance: the security group of an egress instance is deleted, for a source or destination instance the network policies the broker
+// created for it are deleted. The destinations that refer to a deleted source are marked as dangling, or (with REFUSE_REFERENCED_SOURCE_DELETE=true) the deletion is refused while
+// destinations with members refer to it.
 func DeleteServiceInstance(w http.ResponseWriter, r *http.Request) {
-	_ = r // prevent compiler warning
-	util.WriteHttpResponse(w, http.StatusOK, model.DeleteServiceInstanceResponse{})
+	serviceInstanceId := mux.Vars(r)["service_instance_guid"]
+	// only egress instances have a security group, for the other types this finds nothing
+	if deleted, err := util.DeleteEgressSecurityGroup(serviceInstanceId); err != nil {
+		fmt.Printf("failed to delete the security group of service instance %s: %s\n", serviceInstanceId, err)
+		util.WriteHttpResponse(w, http.StatusInternalServerError, model.BrokerError{Error: "FAILED", Description: err.Error(), InstanceUsable: true, UpdateRepeatable: false})
+		return
+	} else if deleted {
+		util.WriteHttpResponse(w, http.StatusOK, model.DeleteServiceInstanceResponse{Result: "security group deleted"})
+		return
+	}
+
+	serviceInstance, err := conf.CfClient.ServiceInstances.Get(conf.CfCtx, serviceInstanceId)
+	if err != nil || serviceInstance.Metadata == nil || serviceInstance.Metadata.Labels[conf.LabelNameType] == nil {
+		// without labels the broker never created policies for the instance, if it is already gone the sync deletes what is left through the registry
+		util.PrintfIfDebug("service instance %s has no labels, nothing to clean up (error: %v)\n", serviceInstanceId, err)
+		util.WriteHttpResponse(w, http.StatusOK, model.DeleteServiceInstanceResponse{})
+		return
+	}
+
+	// the peers are the instances that can have registered policies for the member apps of this instance
+	peerInstanceGuids := make([]string, 0)
+	result := ""
+	switch *serviceInstance.Metadata.Labels[conf.LabelNameType] {
+	case conf.LabelValueTypeSrc:
+		if serviceInstance.Metadata.Labels[conf.LabelNameName] == nil {
+			break
+		}
+		source, err := util.SourceReferenceOf(*serviceInstance.Metadata.Labels[conf.LabelNameName], serviceInstance.Relationships.Space.Data.GUID)
+		if err != nil {
+			fmt.Printf("failed to deprovision source service instance %s: %s\n", serviceInstanceId, err)
+			util.WriteHttpResponse(w, http.StatusInternalServerError, model.BrokerError{Error: "FAILED", Description: err.Error(), InstanceUsable: true, UpdateRepeatable: false})
+			return
+		}
+		destinations, err := util.ReferringDestinations(source)
+		if err != nil {
+			fmt.Printf("failed to deprovision source service instance %s: %s\n", serviceInstanceId, err)
+			util.WriteHttpResponse(w, http.StatusInternalServerError, model.BrokerError{Error: "FAILED", Description: err.Error(), InstanceUsable: true, UpdateRepeatable: false})
+			return
+		}
+		if conf.RefuseReferencedSourceDelete {
+			active := make([]string, 0)
+			for _, destination := range destinations {
+				if memberApps, err := util.MemberApps(destination); err != nil || len(memberApps) > 0 {
+					active = append(active, fmt.Sprintf("%s (%s)", destination.Name, destination.GUID))
+				}
+			}
+			if len(active) > 0 {
+				fmt.Printf("refusing to delete source service instance %s, it is referred to by %d active destination service instances\n", serviceInstanceId, len(active))
+				util.WriteHttpResponse(w, http.StatusBadRequest, model.BrokerError{Error: "FAILED", Description: fmt.Sprintf("source %s is still referred to by destination service instances with members: %s, delete those first", source, strings.Join(active, ", ")), InstanceUsable: true, UpdateRepeatable: false})
+				return
+			}
+		}
+		for _, destination := range destinations {
+			peerInstanceGuids = append(peerInstanceGuids, destination.GUID)
+			if err = util.MarkDangling(destination, source); err != nil {
+				fmt.Println(err)
+				util.WriteHttpResponse(w, http.StatusInternalServerError, model.BrokerError{Error: "FAILED", Description: err.Error(), InstanceUsable: true, UpdateRepeatable: false})
+				return
+			}
+		}
+		if len(destinations) > 0 {
+			result = fmt.Sprintf("marked %d destination service instances as dangling, ", len(destinations))
+		}
+	case conf.LabelValueTypeDest:
+		for _, source := range util.InstanceSources(serviceInstance.Metadata) {
+			if sourceInstance, err := util.FindSourceInstance(source); err != nil {
+				fmt.Printf("failed to find source %s of destination service instance %s: %s\n", source, serviceInstanceId, err)
+			} else if sourceInstance != nil {
+				peerInstanceGuids = append(peerInstanceGuids, sourceInstance.GUID)
+			}
+		}
+	}
+
+	// the policy backend requests of the deprovision give up in time to answer before the broker timeout of the CC
+	policies, err := util.DeleteInstancePolicies(serviceInstance, peerInstanceGuids, time.Now().Add(conf.PolicyServerSyncRequestTime))
+	if err != nil {
+		fmt.Printf("failed to deprovision service instance %s: %s\n", serviceInstanceId, err)
+		util.WriteHttpResponse(w, http.StatusInternalServerError, model.BrokerError{Error: "FAILED", Description: err.Error(), InstanceUsable: true, UpdateRepeatable: false})
+		return
+	}
+	util.WriteHttpResponse(w, http.StatusOK, model.DeleteServiceInstanceResponse{Result: fmt.Sprintf("%sdeleted %d network policies", result, len(policies))})
 }
 
 func validateInstanceParameters(serviceInstance model.ServiceInstance) (serviceInstanceParms model.ServiceInstanceParameters, err error) {
-	parameterValueRegex := regexp.MustCompile("^[a-zA-Z0-9._-]{1,64}$")
 	const (
 		ParmType     = "type"
 		ParmName     = "name"
@@ -86,6 +700,11 @@ func validateInstanceParameters(serviceInstance model.ServiceInstance) (serviceI
 		ParmSrcName  = "sourceName"
 		ParmSrcSpace = "sourceSpace"
 		ParmSrcOrg   = "sourceOrg"
+		ParmSources  = "sources"
+		ParmScope    = "scope"
+
+		ParmAppSelector = "appSelector"
+		ParmAppPorts    = "appPorts"
 	)
 
 	if serviceInstance.Parameters == nil {
@@ -98,8 +717,38 @@ func validateInstanceParameters(serviceInstance model.ServiceInstance) (serviceI
 	if serviceInstanceParms.Type == "" {
 		return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is missing", ParmType)
 	}
-	if serviceInstanceParms.Type != conf.LabelValueTypeSrc && serviceInstanceParms.Type != conf.LabelValueTypeDest {
-		return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is invalid, should be \"%s\" or \"%s\"", ParmType, conf.LabelValueTypeSrc, conf.LabelValueTypeDest)
+	if serviceInstanceParms.Type != conf.LabelValueTypeSrc && serviceInstanceParms.Type != conf.LabelValueTypeDest && serviceInstanceParms.Type != conf.LabelValueTypeEgress {
+		return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is invalid, should be \"%s\", \"%s\" or \"%s\"", ParmType, conf.LabelValueTypeSrc, conf.LabelValueTypeDest, conf.LabelValueTypeEgress)
+	}
+	if serviceInstanceParms.Type == conf.LabelValueTypeEgress {
+		if serviceInstanceParms.AppSelector != "" || len(serviceInstanceParms.AppPorts) > 0 {
+			return serviceInstanceParms, fmt.Errorf("parameters \"%s\" and \"%s\" are not allowed for type \"%s\"", ParmAppSelector, ParmAppPorts, conf.LabelValueTypeEgress)
+		}
+		return validateEgressParameters(serviceInstanceParms)
+	}
+	if serviceInstanceParms.AppSelector != "" {
+		if _, err = model.ParseLabelSelector(serviceInstanceParms.AppSelector); err != nil {
+			return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is invalid: %s", ParmAppSelector, err)
+		}
+		if serviceInstanceParms.Scope == conf.LabelValueScopeSpace {
+			return serviceInstanceParms, fmt.Errorf("parameter \"%s\" can not be combined with \"%s\":\"%s\"", ParmAppSelector, ParmScope, conf.LabelValueScopeSpace)
+		}
+	}
+	if len(serviceInstanceParms.AppPorts) > 0 {
+		if serviceInstanceParms.Type != conf.LabelValueTypeDest || serviceInstanceParms.AppSelector == "" {
+			return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is only allowed for type \"%s\" with \"%s\"", ParmAppPorts, conf.LabelValueTypeDest, ParmAppSelector)
+		}
+		for _, portProtocol := range serviceInstanceParms.AppPorts {
+			if portProtocol.Port <= 1024 || portProtocol.Port >= 65535 {
+				return serviceInstanceParms, fmt.Errorf("parameter \"%s\" has an invalid port %d, should be an integer between 1024 and 65535", ParmAppPorts, portProtocol.Port)
+			}
+			if !validProtocol(portProtocol.Protocol) {
+				return serviceInstanceParms, fmt.Errorf("parameter \"%s\" has an invalid protocol \"%s\" for port %d, should be \"%s\", \"%s\" or \"%s\"", ParmAppPorts, portProtocol.Protocol, portProtocol.Port, conf.LabelValueProtocolTCP, conf.LabelValueProtocolUDP, conf.ProtocolBoth)
+			}
+		}
+	}
+	if len(serviceInstanceParms.Destinations) > 0 || serviceInstanceParms.Ports != "" || serviceInstanceParms.Protocol != "" {
+		return serviceInstanceParms, fmt.Errorf("parameters \"%s\", \"%s\" and \"%s\" are only allowed for type \"%s\"", parmDestinations, parmPorts, parmProtocol, conf.LabelValueTypeEgress)
 	}
 	if serviceInstanceParms.Type == "source" {
 		if serviceInstanceParms.Name == "" {
@@ -111,49 +760,156 @@ func validateInstanceParameters(serviceInstance model.ServiceInstance) (serviceI
 		if len(serviceInstanceParms.Description) > 128 {
 			return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is invalid, maximum length is 128, you have %d", ParmDesc, len(serviceInstanceParms.Description))
 		}
+		if serviceInstanceParms.Scope != "" && serviceInstanceParms.Scope != conf.LabelValueScopeSpace && serviceInstanceParms.Scope != scopeBinding {
+			return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is invalid, should be \"%s\" or \"%s\"", ParmScope, scopeBinding, conf.LabelValueScopeSpace)
+		}
 		if instanceWithNameExists(serviceInstanceParms.Name, serviceInstance) {
 			return serviceInstanceParms, fmt.Errorf("a network-policies service with label \"%s\"=\"%s\" is already taken", conf.LabelNameName, serviceInstanceParms.Name)
 		}
 	}
 
+	if serviceInstanceParms.Type != conf.LabelValueTypeSrc && serviceInstanceParms.Scope != "" {
+		return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is only allowed for type \"%s\"", ParmScope, conf.LabelValueTypeSrc)
+	}
+
 	if serviceInstanceParms.Type == "destination" {
-		if serviceInstanceParms.SourceName == "" {
-			return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is missing", ParmSrcName)
+		if len(serviceInstanceParms.Sources) == 0 {
+			return serviceInstanceParms, validateSourceReference(model.SourceReference{Name: serviceInstanceParms.SourceName, Space: serviceInstanceParms.SourceSpace, Org: serviceInstanceParms.SourceOrg}, serviceInstance, ParmSrcName, ParmSrcSpace, ParmSrcOrg)
 		}
-		if !parameterValueRegex.MatchString(serviceInstanceParms.SourceName) {
-			return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is invalid, should match regex %s", ParmSrcName, parameterValueRegex.String())
+		if serviceInstanceParms.SourceName != "" || serviceInstanceParms.SourceSpace != "" || serviceInstanceParms.SourceOrg != "" {
+			return serviceInstanceParms, fmt.Errorf("parameter \"%s\" can not be combined with \"%s\", \"%s\" and \"%s\"", ParmSources, ParmSrcName, ParmSrcSpace, ParmSrcOrg)
+		}
+		if len(serviceInstanceParms.Sources) > conf.MaxSources {
+			return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is invalid, maximum number of sources is %d, you have %d", ParmSources, conf.MaxSources, len(serviceInstanceParms.Sources))
+		}
+		seenSources := make(map[string]bool)
+		for ix, source := range serviceInstanceParms.Sources {
+			if seenSources[source.String()] {
+				return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is invalid, source %s is listed more than once", ParmSources, source)
+			}
+			seenSources[source.String()] = true
+			if err = validateSourceReference(source, serviceInstance, fmt.Sprintf("%s[%d].name", ParmSources, ix), fmt.Sprintf("%s[%d].space", ParmSources, ix), fmt.Sprintf("%s[%d].org", ParmSources, ix)); err != nil {
+				return serviceInstanceParms, err
+			}
 		}
-		if serviceInstanceParms.SourceSpace == "" {
-			return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is missing", ParmSrcSpace)
+	} else if len(serviceInstanceParms.Sources) > 0 {
+		return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is only allowed for type \"%s\"", ParmSources, conf.LabelValueTypeDest)
+	}
+	return serviceInstanceParms, nil
+}
+
+// validateSourceReference - Validates the name, space and org of a source a destination instance refers to, and checks if the org and space exist. The parm* arguments are the parameter names used in the error messages.
+func validateSourceReference(source model.SourceReference, serviceInstance model.ServiceInstance, parmName string, parmSpace string, parmOrg string) error {
+	if source.Name == "" {
+		return fmt.Errorf("parameter \"%s\" is missing", parmName)
+	}
+	if !parameterValueRegex.MatchString(source.Name) {
+		return fmt.Errorf("parameter \"%s\" is invalid, should match regex %s", parmName, parameterValueRegex.String())
+	}
+	if source.Space == "" {
+		return fmt.Errorf("parameter \"%s\" is missing", parmSpace)
+	}
+	if !parameterValueRegex.MatchString(source.Space) {
+		return fmt.Errorf("parameter \"%s\" is invalid, should match regex %s", parmSpace, parameterValueRegex.String())
+	}
+	if source.Org == "" {
+		return fmt.Errorf("parameter \"%s\" is missing", parmOrg)
+	}
+	if !parameterValueRegex.MatchString(source.Org) {
+		return fmt.Errorf("parameter \"%s\" is invalid, should match regex %s", parmOrg, parameterValueRegex.String())
+	}
+	if source.Space == serviceInstance.Context.SpaceName && source.Org == serviceInstance.Context.OrganizationName {
+		return fmt.Errorf("you cannot use a source that is in the same org/space (%s/%s) as the target, for those cases use the standard \"cf add-network-policy\" commands", source.Org, source.Space)
+	}
+
+	// check if the source org/space exists:
+	var orgGuid string
+	orgListOptions := client.OrganizationListOptions{Names: client.Filter{Values: []string{source.Org}}}
+	if org, err := conf.CfClient.Organizations.Single(conf.CfCtx, &orgListOptions); err != nil {
+		errorMsg := fmt.Sprintf("failed to get org with name %s: %s\n", source.Org, err)
+		fmt.Println(errorMsg)
+		return errors.New(errorMsg)
+	} else {
+		orgGuid = org.GUID
+	}
+	spaceListOptions := client.SpaceListOptions{Names: client.Filter{Values: []string{source.Space}}, OrganizationGUIDs: client.Filter{Values: []string{orgGuid}}}
+	if _, err := conf.CfClient.Spaces.Single(conf.CfCtx, &spaceListOptions); err != nil {
+		errorMsg := fmt.Sprintf("failed to get space with name %s in org with name %s: %s\n", source.Space, source.Org, err)
+		fmt.Println(errorMsg)
+		return errors.New(errorMsg)
+	}
+	return nil
+}
+
+const (
+	parmDestinations = "destinations"
+	parmPorts        = "ports"
+	parmProtocol     = "protocol"
+)
+
+// scopeBinding - The default scope of a source instance, only the bound apps are members
+const scopeBinding = "binding"
+
+var parameterValueRegex = regexp.MustCompile("^[a-zA-Z0-9._-]{1,64}$")
+
+var egressPortsRegex = regexp.MustCompile("^[0-9]{1,5}(-[0-9]{1,5})?$")
+
+// validateEgressParameters - Validates the destinations (CIDRs or IP addresses, that should be within EGRESS_ALLOWED_CIDRS), ports and protocol of an egress instance.
+// The destinations are normalized to CIDRs, the protocol defaults to tcp.
+func validateEgressParameters(serviceInstanceParms model.ServiceInstanceParameters) (model.ServiceInstanceParameters, error) {
+	if len(serviceInstanceParms.Destinations) == 0 {
+		return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is missing", parmDestinations)
+	}
+	if len(conf.EgressAllowedCidrs) == 0 {
+		return serviceInstanceParms, fmt.Errorf("egress service instances are not enabled on this platform (EGRESS_ALLOWED_CIDRS is empty)")
+	}
+	destinations := make([]string, 0, len(serviceInstanceParms.Destinations))
+	for _, destination := range serviceInstanceParms.Destinations {
+		// a single IP address is a /32 (or /128) CIDR
+		if ip := net.ParseIP(destination); ip != nil {
+			if ip.To4() != nil {
+				destination = destination + "/32"
+			} else {
+				destination = destination + "/128"
+			}
 		}
-		if !parameterValueRegex.MatchString(serviceInstanceParms.SourceSpace) {
-			return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is invalid, should match regex %s", ParmSrcSpace, parameterValueRegex.String())
+		_, cidr, err := net.ParseCIDR(destination)
+		if err != nil {
+			return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is invalid, \"%s\" is not a CIDR or IP address", parmDestinations, destination)
 		}
-		if serviceInstanceParms.SourceOrg == "" {
-			return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is missing", ParmSrcOrg)
+		if !util.EgressCidrAllowed(cidr) {
+			return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is invalid, %s is not within the allowed CIDRs %s", parmDestinations, cidr.String(), conf.EgressAllowedCidrStr)
 		}
-		if !parameterValueRegex.MatchString(serviceInstanceParms.SourceOrg) {
-			return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is invalid, should match regex %s", ParmSrcOrg, parameterValueRegex.String())
+		destinations = append(destinations, cidr.String())
+	}
+	serviceInstanceParms.Destinations = destinations
+	if serviceInstanceParms.Protocol == "" {
+		serviceInstanceParms.Protocol = conf.LabelValueProtocolTCP
+	}
+	if serviceInstanceParms.Protocol != conf.LabelValueProtocolTCP && serviceInstanceParms.Protocol != conf.LabelValueProtocolUDP && serviceInstanceParms.Protocol != conf.EgressProtocolAll {
+		return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is invalid, should be \"%s\", \"%s\" or \"%s\"", parmProtocol, conf.LabelValueProtocolTCP, conf.LabelValueProtocolUDP, conf.EgressProtocolAll)
+	}
+	if serviceInstanceParms.Protocol == conf.EgressProtocolAll {
+		if serviceInstanceParms.Ports != "" {
+			return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is not allowed with protocol \"%s\"", parmPorts, conf.EgressProtocolAll)
 		}
-		if serviceInstanceParms.SourceSpace == serviceInstance.Context.SpaceName && serviceInstanceParms.SourceOrg == serviceInstance.Context.OrganizationName {
-			return serviceInstanceParms, fmt.Errorf("you cannot use a source that is in the same org/space (%s/%s) as the target, for those cases use the standard \"cf add-network-policy\" commands", serviceInstanceParms.SourceOrg, serviceInstanceParms.SourceSpace)
+		return serviceInstanceParms, nil
+	}
+	if serviceInstanceParms.Ports == "" {
+		return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is missing", parmPorts)
+	}
+	for _, portOrRange := range strings.Split(serviceInstanceParms.Ports, ",") {
+		if !egressPortsRegex.MatchString(portOrRange) {
+			return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is invalid, should be a port (443), a range (8000-8100) or a comma separated list of those", parmPorts)
 		}
-
-		// check if the source org/space exists:
-		var orgGuid string
-		orgListOptions := client.OrganizationListOptions{Names: client.Filter{Values: []string{serviceInstanceParms.SourceOrg}}}
-		if org, err := conf.CfClient.Organizations.Single(conf.CfCtx, &orgListOptions); err != nil {
-			errorMsg := fmt.Sprintf("failed to get org with name %s: %s\n", serviceInstanceParms.SourceOrg, err)
-			fmt.Println(errorMsg)
-			return serviceInstanceParms, errors.New(errorMsg)
-		} else {
-			orgGuid = org.GUID
+		startEnd := strings.SplitN(portOrRange, "-", 2)
+		start, _ := strconv.Atoi(startEnd[0])
+		end := start
+		if len(startEnd) == 2 {
+			end, _ = strconv.Atoi(startEnd[1])
 		}
-		spaceListOptions := client.SpaceListOptions{Names: client.Filter{Values: []string{serviceInstanceParms.SourceSpace}}, OrganizationGUIDs: client.Filter{Values: []string{orgGuid}}}
-		if _, err = conf.CfClient.Spaces.Single(conf.CfCtx, &spaceListOptions); err != nil {
-			errorMsg := fmt.Sprintf("failed to get space with name %s in org with name %s: %s\n", serviceInstanceParms.SourceSpace, serviceInstanceParms.SourceOrg, err)
-			fmt.Println(errorMsg)
-			return serviceInstanceParms, errors.New(errorMsg)
+		if start < 1 || end > 65535 || end < start {
+			return serviceInstanceParms, fmt.Errorf("parameter \"%s\" is invalid, %s is not a valid port or port range", parmPorts, portOrRange)
 		}
 	}
 	return serviceInstanceParms, nil
@@ -3,7 +3,9 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/rabobank/npsb/backend"
 	"github.com/rabobank/npsb/conf"
+	"github.com/rabobank/npsb/registry"
 	"github.com/rabobank/npsb/server"
 	"github.com/rabobank/npsb/util"
 	"os"
@@ -36,11 +38,26 @@ func initialize() {
 		os.Exit(8)
 	}
 
+	if err = registry.Load(); err != nil {
+		fmt.Println(err)
+		os.Exit(8)
+	}
+
+	if err = backend.Init(); err != nil {
+		fmt.Println(err)
+		os.Exit(8)
+	}
+
 	// start the routine that checks consistency between the service instance (labels) and the actual network policies:
 	go func() {
 		for {
-			util.SyncLabels2Policies()
+			_ = util.RunSync(util.SyncTriggerInterval, nil, conf.SyncDryRun)
 			time.Sleep(time.Duration(conf.SyncIntervalSecs) * time.Second)
 		}
 	}()
+
+	// between the full syncs, only the groups affected by recent CC audit events are synced
+	if conf.EventPollIntervalSecs > 0 {
+		go util.WatchAuditEvents()
+	}
 }
@@ -10,6 +10,7 @@ type SourceResponse struct {
 	Org         string `json:"org"`
 	Space       string `json:"space"`
 	Description string `json:"description"`
+	Scope       string `json:"scope"` // "binding" (only the bound apps) or "space" (all apps in the space)
 }
 
 // GenericRequest - a generic request object
@@ -0,0 +1,26 @@
+package model
+
+// AuditEventData - The parts of the data field of a CC audit event that we need to find the affected service instances and apps.
+// v3 requests carry relationships, older (v2 style) requests carry the guids directly.
+type AuditEventData struct {
+	Request struct {
+		Name                string `json:"name"`
+		AppGuid             string `json:"app_guid"`
+		ServiceInstanceGuid string `json:"service_instance_guid"`
+		Relationships       struct {
+			App struct {
+				Data struct {
+					Guid string `json:"guid"`
+				} `json:"data"`
+			} `json:"app"`
+			ServiceInstance struct {
+				Data struct {
+					Guid string `json:"guid"`
+				} `json:"data"`
+			} `json:"service_instance"`
+		} `json:"relationships"`
+		Metadata *struct {
+			Labels map[string]*string `json:"labels"`
+		} `json:"metadata"`
+	} `json:"request"`
+}
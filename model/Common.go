@@ -20,17 +20,19 @@ type Catalog struct {
 }
 
 type Service struct {
-	Name            string        `json:"name"`
-	Id              string        `json:"id"`
-	Description     string        `json:"description"`
-	Bindable        bool          `json:"bindable"`
-	MaxPollInterval int           `json:"maximum_polling_duration"`
-	PlanUpdateable  bool          `json:"plan_updateable,omitempty"`
-	Tags            []string      `json:"tags,omitempty"`
-	Requires        []string      `json:"requires,omitempty"`
-	Metadata        interface{}   `json:"metadata,omitempty"`
-	Plans           []ServicePlan `json:"plans"`
-	DashboardClient interface{}   `json:"dashboard_client"`
+	Name                 string        `json:"name"`
+	Id                   string        `json:"id"`
+	Description          string        `json:"description"`
+	Bindable             bool          `json:"bindable"`
+	MaxPollInterval      int           `json:"maximum_polling_duration"`
+	PlanUpdateable       bool          `json:"plan_updateable,omitempty"`
+	InstancesRetrievable bool          `json:"instances_retrievable,omitempty"`
+	BindingsRetrievable  bool          `json:"bindings_retrievable,omitempty"`
+	Tags                 []string      `json:"tags,omitempty"`
+	Requires             []string      `json:"requires,omitempty"`
+	Metadata             interface{}   `json:"metadata,omitempty"`
+	Plans                []ServicePlan `json:"plans"`
+	DashboardClient      interface{}   `json:"dashboard_client"`
 }
 
 type ServicePlan struct {
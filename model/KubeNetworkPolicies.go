@@ -0,0 +1,54 @@
+package model
+
+// KubeNetworkPolicy - A networking.k8s.io/v1 NetworkPolicy, only the fields the broker uses
+type KubeNetworkPolicy struct {
+	ApiVersion string                `json:"apiVersion"`
+	Kind       string                `json:"kind"`
+	Metadata   KubeObjectMeta        `json:"metadata"`
+	Spec       KubeNetworkPolicySpec `json:"spec"`
+}
+
+type KubeObjectMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type KubeNetworkPolicySpec struct {
+	PodSelector KubeLabelSelector              `json:"podSelector"`
+	PolicyTypes []string                       `json:"policyTypes"`
+	Ingress     []KubeNetworkPolicyIngressRule `json:"ingress"`
+}
+
+// KubeLabelSelector - An empty selector ({}) selects everything
+type KubeLabelSelector struct {
+	MatchLabels map[string]string `json:"matchLabels,omitempty"`
+}
+
+type KubeNetworkPolicyIngressRule struct {
+	From  []KubeNetworkPolicyPeer `json:"from"`
+	Ports []KubeNetworkPolicyPort `json:"ports"`
+}
+
+type KubeNetworkPolicyPeer struct {
+	PodSelector       *KubeLabelSelector `json:"podSelector,omitempty"`
+	NamespaceSelector *KubeLabelSelector `json:"namespaceSelector,omitempty"`
+}
+
+type KubeNetworkPolicyPort struct {
+	Protocol string `json:"protocol"`
+	Port     int    `json:"port"`
+	EndPort  int    `json:"endPort,omitempty"`
+}
+
+type KubeNetworkPolicyList struct {
+	Items []KubeNetworkPolicy `json:"items"`
+}
+
+// KubeStatus - The error response of the kubernetes api
+type KubeStatus struct {
+	Message string `json:"message"`
+	Reason  string `json:"reason"`
+	Code    int    `json:"code"`
+}
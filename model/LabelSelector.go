@@ -0,0 +1,95 @@
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/cloudfoundry/go-cfclient/v3/client"
+)
+
+var (
+	labelKeyRegex   = regexp.MustCompile(`^([a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*/)?[a-zA-Z0-9]([-_.a-zA-Z0-9]{0,61}[a-zA-Z0-9])?$`)
+	labelValueRegex = regexp.MustCompile(`^([a-zA-Z0-9]([-_.a-zA-Z0-9]{0,61}[a-zA-Z0-9])?)?$`)
+	setRequirement  = regexp.MustCompile(`^(\S+)\s+(in|notin)\s+\((.*)\)$`)
+)
+
+// ParseLabelSelector - Parses a label selector like "team=payments,tier=backend" (the app selector of an instance) into a client.LabelSelector.
+// Supported are key=value, key==value, key!=value, key, !key, key in (v1,v2) and key notin (v1,v2), every key can be used only once.
+func ParseLabelSelector(selector string) (client.LabelSelector, error) {
+	labelSelector := client.LabelSelector{}
+	requirements := splitRequirements(selector)
+	if len(requirements) == 0 {
+		return nil, fmt.Errorf("selector is empty")
+	}
+	for _, requirement := range requirements {
+		requirement = strings.TrimSpace(requirement)
+		if requirement == "" {
+			return nil, fmt.Errorf("selector %s has an empty requirement", selector)
+		}
+		var key string
+		var values []string
+		var not, existence bool
+		if matches := setRequirement.FindStringSubmatch(requirement); matches != nil {
+			key, not = matches[1], matches[2] == "notin"
+			for _, value := range strings.Split(matches[3], ",") {
+				values = append(values, strings.TrimSpace(value))
+			}
+		} else if k, v, found := strings.Cut(requirement, "!="); found {
+			key, values, not = strings.TrimSpace(k), []string{strings.TrimSpace(v)}, true
+		} else if k, v, found = strings.Cut(requirement, "=="); found {
+			key, values = strings.TrimSpace(k), []string{strings.TrimSpace(v)}
+		} else if k, v, found = strings.Cut(requirement, "="); found {
+			key, values = strings.TrimSpace(k), []string{strings.TrimSpace(v)}
+		} else if strings.HasPrefix(requirement, "!") {
+			key, not, existence = strings.TrimSpace(requirement[1:]), true, true
+		} else {
+			key, existence = requirement, true
+		}
+		if !labelKeyRegex.MatchString(key) {
+			return nil, fmt.Errorf("selector %s has an invalid label key \"%s\"", selector, key)
+		}
+		if _, found := labelSelector[key]; found {
+			return nil, fmt.Errorf("selector %s uses label key %s more than once", selector, key)
+		}
+		for _, value := range values {
+			if value == "" || !labelValueRegex.MatchString(value) {
+				return nil, fmt.Errorf("selector %s has an invalid label value \"%s\" for key %s", selector, value, key)
+			}
+		}
+		switch {
+		case existence && not:
+			labelSelector.NotExistence(key)
+		case existence:
+			labelSelector.Existence(key)
+		case not:
+			labelSelector.NotEqualTo(key, values...)
+		default:
+			labelSelector.EqualTo(key, values...)
+		}
+	}
+	return labelSelector, nil
+}
+
+// splitRequirements - Splits a label selector on the commas that are not within the parentheses of an in or notin requirement
+func splitRequirements(selector string) []string {
+	requirements := make([]string, 0)
+	if strings.TrimSpace(selector) == "" {
+		return requirements
+	}
+	depth, start := 0, 0
+	for ix, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				requirements = append(requirements, selector[start:ix])
+				start = ix + 1
+			}
+		}
+	}
+	return append(requirements, selector[start:])
+}
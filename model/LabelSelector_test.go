@@ -0,0 +1,60 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/cloudfoundry/go-cfclient/v3/client"
+)
+
+func TestParseLabelSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector string
+		expected client.LabelSelector
+	}{
+		{"equal", "team=payments", client.LabelSelector{"team": {Filter: client.Filter{Values: []string{"payments"}}}}},
+		{"double equal", "team == payments", client.LabelSelector{"team": {Filter: client.Filter{Values: []string{"payments"}}}}},
+		{"not equal", "tier!=frontend", client.LabelSelector{"tier": {Filter: client.Filter{Values: []string{"frontend"}}, Not: true}}},
+		{"in", "env in (dev, test)", client.LabelSelector{"env": {Filter: client.Filter{Values: []string{"dev", "test"}}}}},
+		{"notin", "env notin (prod)", client.LabelSelector{"env": {Filter: client.Filter{Values: []string{"prod"}}, Not: true}}},
+		{"existence", "example.com/team", client.LabelSelector{"example.com/team": {}}},
+		{"not existence", "!legacy", client.LabelSelector{"legacy": {Not: true}}},
+		{"combined", "team=payments,env in (dev,test),!legacy", client.LabelSelector{
+			"team":   {Filter: client.Filter{Values: []string{"payments"}}},
+			"env":    {Filter: client.Filter{Values: []string{"dev", "test"}}},
+			"legacy": {Not: true},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			labelSelector, err := ParseLabelSelector(test.selector)
+			if err != nil {
+				t.Fatalf("failed to parse selector %s: %s", test.selector, err)
+			}
+			if !reflect.DeepEqual(labelSelector, test.expected) {
+				t.Errorf("selector %s: expected %v, got %v", test.selector, test.expected, labelSelector)
+			}
+		})
+	}
+}
+
+func TestParseLabelSelectorRejectsMalformedInput(t *testing.T) {
+	for _, selector := range []string{
+		"",
+		" ",
+		"team=payments,",
+		"team=",
+		"=payments",
+		"team=pay ments",
+		"-team=payments",
+		"team=payments,team=billing",
+		"env in (dev,)",
+		"env in ()",
+		"!",
+	} {
+		if _, err := ParseLabelSelector(selector); err == nil {
+			t.Errorf("expected selector \"%s\" to be rejected", selector)
+		}
+	}
+}
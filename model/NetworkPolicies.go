@@ -2,19 +2,34 @@ package model
 
 import (
 	"fmt"
+	"strconv"
 )
 
 type NetworkPolicyLabels struct {
 	Source          string `json:"source"` // app guid
-	SourceName      string
+	SourceName      string `json:"source_name,omitempty"`
 	Destination     string `json:"destination"`
-	DestinationName string
+	DestinationName string `json:"destination_name,omitempty"`
 	Protocol        string `json:"protocol"`
 	Port            int    `json:"port"`
+	EndPort         int    `json:"end_port,omitempty"` // the end of a port range, 0 or the same as Port for a single port
 }
 
 func (np NetworkPolicyLabels) String() string {
-	return fmt.Sprintf("%s (%s) => %s (%s:%d(%s))", np.SourceName, np.Source, np.DestinationName, np.Destination, np.Port, np.Protocol)
+	return fmt.Sprintf("%s (%s) => %s (%s:%s(%s))", np.SourceName, np.Source, np.DestinationName, np.Destination, np.Ports(), np.Protocol)
+}
+
+// Ports - Returns the port range of the policy, for a single port start and end are the same
+func (np NetworkPolicyLabels) Ports() Ports {
+	if np.EndPort > np.Port {
+		return Ports{Start: np.Port, End: np.EndPort}
+	}
+	return Ports{Start: np.Port, End: np.Port}
+}
+
+// NetworkPolicy - Converts the policy labels to a network policy
+func (np NetworkPolicyLabels) NetworkPolicy() NetworkPolicy {
+	return NetworkPolicy{Source: Source{Id: np.Source}, Destination: Destination{Id: np.Destination, Protocol: np.Protocol, Ports: np.Ports()}}
 }
 
 type NetworkPolicies struct {
@@ -26,6 +41,11 @@ type NetworkPolicy struct {
 	Destination Destination `json:"destination"`
 }
 
+// Key - Returns a string that uniquely identifies the network policy (source, destination, port and protocol)
+func (np NetworkPolicy) Key() string {
+	return fmt.Sprintf("%s|%s|%s|%s", np.Source.Id, np.Destination.Id, np.Destination.Ports, np.Destination.Protocol)
+}
+
 type Source struct {
 	Id string `json:"id"`
 }
@@ -33,21 +53,52 @@ type Source struct {
 type Destination struct {
 	Id       string `json:"id"`
 	Protocol string `json:"protocol"`
-	Port     int    `json:"port"`
+	Ports    Ports  `json:"ports"`
+}
+
+// Ports - The destination port range of a network policy (as in the v1 policy server api), a single port has the same start and end
+type Ports struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+func (p Ports) String() string {
+	if p.Start == p.End {
+		return strconv.Itoa(p.Start)
+	}
+	return fmt.Sprintf("%d-%d", p.Start, p.End)
+}
+
+// DestinationPort - A destination port (range) with its protocol, a destination binding can have more than one
+type DestinationPort struct {
+	Ports    Ports  `json:"ports"`
+	Protocol string `json:"protocol"`
+}
+
+// String - The form that is stored in the npsb.dest.ports annotation of a service binding, like 8080/tcp or 7000-7010/udp
+func (dp DestinationPort) String() string {
+	return fmt.Sprintf("%s/%s", dp.Ports, dp.Protocol)
+}
+
+// BoundApp - An app bound to a service instance, with the guid of the service binding
+type BoundApp struct {
+	Destination
+	BindingGuid string `json:"binding_guid"`
 }
 
 type InstancesWithBinds struct {
-	BoundApps    []Destination `json:"bound_apps"`
-	SrcOrDst     string        `json:"src_or_dst"`
-	NameOrSource string        `json:"name_or_source"`
+	InstanceGuid string     `json:"instance_guid"`
+	BoundApps    []BoundApp `json:"bound_apps"`
+	SrcOrDst     string     `json:"src_or_dst"`
+	Groups       []string   `json:"groups"` // the source (org/space/name) of a source instance, or the sources a destination instance refers to
 }
 
 func (iwb InstancesWithBinds) String() string {
 	var bindStr string
 	for _, bind := range iwb.BoundApps {
-		bindStr += fmt.Sprintf("%s:%d(%s), ", bind.Id, bind.Port, bind.Protocol)
+		bindStr += fmt.Sprintf("%s:%s(%s), ", bind.Id, bind.Ports, bind.Protocol)
 	}
-	return fmt.Sprintf("type:%s, name/source: %s, #binds: %d : %s", iwb.SrcOrDst, iwb.NameOrSource, len(iwb.BoundApps), bindStr)
+	return fmt.Sprintf("type:%s, groups: %v, #binds: %d : %s", iwb.SrcOrDst, iwb.Groups, len(iwb.BoundApps), bindStr)
 }
 
 type PolicyServerGetResponse struct {
@@ -7,7 +7,36 @@ type ServiceBinding struct {
 }
 
 type CreateServiceBindingResponse struct {
-	Result string `json:"result"`
+	Result      string              `json:"result"`
+	Credentials *BindingCredentials `json:"credentials,omitempty"`
+	Operation   string              `json:"operation,omitempty"`
+}
+
+// BindingCredentials - The peers of the bound app, for a source binding the destinations it can reach, for a destination binding the sources that are allowed in
+type BindingCredentials struct {
+	Destinations []PeerDestination `json:"destinations,omitempty"`
+	Sources      []PeerSource      `json:"sources,omitempty"`
+}
+
+type PeerDestination struct {
+	AppGuid           string   `json:"app_guid"`
+	AppName           string   `json:"app_name"`
+	InternalHostnames []string `json:"internal_hostnames"`
+	Port              int      `json:"port"`
+	EndPort           int      `json:"end_port"`
+	Protocol          string   `json:"protocol"`
+}
+
+type PeerSource struct {
+	AppGuid string `json:"app_guid"`
+	AppName string `json:"app_name"`
+}
+
+// GetServiceBindingResponse - The response of an OSBAPI service binding fetch, with the parameters rebuilt from the labels of the binding and the network policies it currently produces
+type GetServiceBindingResponse struct {
+	Credentials *BindingCredentials    `json:"credentials,omitempty"`
+	Parameters  map[string]interface{} `json:"parameters"`
+	Policies    []NetworkPolicyLabels  `json:"policies"`
 }
 
 type DeleteServiceBindingResponse struct {
@@ -15,6 +44,18 @@ type DeleteServiceBindingResponse struct {
 }
 
 type ServiceBindingParameters struct {
+	Port      int                     `json:"port"`
+	StartPort int                     `json:"startPort"`
+	EndPort   int                     `json:"endPort"`
+	Protocol  string                  `json:"protocol"`
+	Ports     []PortProtocolParameter `json:"ports"`
+
+	InternalRoute         bool   `json:"internalRoute"`
+	InternalRouteHostname string `json:"internalRouteHostname"`
+}
+
+// PortProtocolParameter - One entry of the ports binding parameter
+type PortProtocolParameter struct {
 	Port     int    `json:"port"`
 	Protocol string `json:"protocol"`
 }
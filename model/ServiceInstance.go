@@ -1,6 +1,10 @@
 package model
 
-import "github.com/cloudfoundry/go-cfclient/v3/resource"
+import (
+	"fmt"
+
+	"github.com/cloudfoundry/go-cfclient/v3/resource"
+)
 
 type ServiceInstance struct {
 	ServiceId  string                 `json:"service_id"`
@@ -20,18 +24,65 @@ type InstanceContext struct {
 type CreateServiceInstanceResponse struct {
 	ServiceId string             `json:"service_id"`
 	PlanId    string             `json:"plan_id"`
+	Operation string             `json:"operation,omitempty"`
 	Metadata  *resource.Metadata `json:"metadata,omitempty"`
 }
 
+// UpdateServiceInstance - The body of an OSBAPI service instance update (PATCH) request
+type UpdateServiceInstance struct {
+	ServiceId      string                 `json:"service_id"`
+	PlanId         string                 `json:"plan_id,omitempty"`
+	Context        InstanceContext        `json:"context,omitempty"`
+	Parameters     map[string]interface{} `json:"parameters,omitempty"`
+	PreviousValues struct {
+		PlanId    string `json:"plan_id,omitempty"`
+		ServiceId string `json:"service_id,omitempty"`
+		OrgId     string `json:"organization_id,omitempty"`
+		SpaceId   string `json:"space_id,omitempty"`
+	} `json:"previous_values,omitempty"`
+}
+
+type UpdateServiceInstanceResponse struct {
+	Operation string `json:"operation,omitempty"`
+}
+
+// GetServiceInstanceResponse - The response of an OSBAPI service instance fetch, the parameters are rebuilt from the labels and annotations of the instance
+type GetServiceInstanceResponse struct {
+	ServiceId  string                 `json:"service_id"`
+	PlanId     string                 `json:"plan_id"`
+	Parameters map[string]interface{} `json:"parameters"`
+}
+
 type DeleteServiceInstanceResponse struct {
 	Result string `json:"result,omitempty"`
 }
 
+// SourceReference - Refers to a source service instance by its name label and the org and space it is in
+type SourceReference struct {
+	Name  string `json:"name"`
+	Space string `json:"space"`
+	Org   string `json:"org"`
+}
+
+func (sr SourceReference) String() string {
+	return fmt.Sprintf("%s/%s/%s", sr.Org, sr.Space, sr.Name)
+}
+
 type ServiceInstanceParameters struct {
-	Type        string `json:"type"`                  // source or destination
+	Type        string `json:"type"`                  // source, destination or egress
 	Name        string `json:"name,omitempty"`        // only valid for type=source
 	Description string `json:"description,omitempty"` // only valid for type=source
+	Scope       string `json:"scope,omitempty"`       // only valid for type=source, "space" makes all apps in the space members
 	SourceName  string `json:"sourceName,omitempty"`  // only valid for type=destination
 	SourceSpace string `json:"sourceSpace,omitempty"` // only valid for type=destination
 	SourceOrg   string `json:"sourceOrg,omitempty"`   // only valid for type=destination
+
+	Sources []SourceReference `json:"sources,omitempty"` // only valid for type=destination, instead of sourceName/sourceSpace/sourceOrg
+
+	AppSelector string                  `json:"appSelector,omitempty"` // only valid for type=source and type=destination, the apps in the space matching the label selector are members
+	AppPorts    []PortProtocolParameter `json:"appPorts,omitempty"`    // only valid for type=destination with an appSelector, the ports of the member apps
+
+	Destinations []string `json:"destinations,omitempty"` // only valid for type=egress
+	Ports        string   `json:"ports,omitempty"`        // only valid for type=egress
+	Protocol     string   `json:"protocol,omitempty"`     // only valid for type=egress
 }
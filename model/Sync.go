@@ -0,0 +1,53 @@
+package model
+
+import "time"
+
+// SyncReport - The diff between the network policies that should exist according to the labels and the actual network policies.
+// Extra policies are the ones that were created by the broker but are no longer justified by the labels. In dry-run mode nothing was changed.
+type SyncReport struct {
+	DryRun   bool                  `json:"dry_run"`
+	Started  time.Time             `json:"started"`
+	Finished time.Time             `json:"finished"`
+	Missing  []NetworkPolicyLabels `json:"missing"`
+	Extra    []NetworkPolicyLabels `json:"extra"`
+	Matching []NetworkPolicyLabels `json:"matching"`
+}
+
+// SyncRun - The result of one sync run, kept in memory so it can be queried through the /api/sync/runs endpoint
+type SyncRun struct {
+	Id              int         `json:"id"`
+	Trigger         string      `json:"trigger"`
+	InstanceGuids   []string    `json:"instance_guids,omitempty"`
+	DryRun          bool        `json:"dry_run"`
+	Started         time.Time   `json:"started"`
+	Finished        time.Time   `json:"finished"`
+	Instances       int         `json:"instances"`
+	Bindings        int         `json:"bindings"`
+	PoliciesCreated int         `json:"policies_created"`
+	PoliciesDeleted int         `json:"policies_deleted"`
+	RoutesCreated   int         `json:"routes_created"`
+	RoutesDeleted   int         `json:"routes_deleted"`
+	Errors          []SyncError `json:"errors"`
+	Report          *SyncReport `json:"report,omitempty"` // only for dry-run syncs
+}
+
+// SyncError - An error that occurred during a sync run, with the names of the apps involved (if any)
+type SyncError struct {
+	Message        string `json:"message"`
+	SourceApp      string `json:"source_app,omitempty"`
+	DestinationApp string `json:"destination_app,omitempty"`
+	Port           int    `json:"port,omitempty"`
+	EndPort        int    `json:"end_port,omitempty"`
+	Protocol       string `json:"protocol,omitempty"`
+}
+
+// SyncRequest - The (optional) request body for the /api/sync endpoint
+type SyncRequest struct {
+	InstanceGuid string `json:"instance_guid"`
+	DryRun       bool   `json:"dry_run"`
+}
+
+// SyncResponse - The response from the /api/sync endpoint
+type SyncResponse struct {
+	RunId int `json:"run_id"`
+}
@@ -0,0 +1,256 @@
+package policyserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rabobank/npsb/conf"
+	"github.com/rabobank/npsb/model"
+	"golang.org/x/oauth2"
+)
+
+var (
+	ErrValidation    = errors.New("network policies rejected by the policy server")
+	ErrForbidden     = errors.New("not allowed by the policy server")
+	ErrLimitExceeded = errors.New("network policy limit exceeded")
+	ErrUnavailable   = errors.New("policy server unavailable")
+)
+
+// Error - A failed policy server request, it wraps one of the Err* errors above so callers can check the kind of error with errors.Is
+type Error struct {
+	Kind       error
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("%s (response code %d): %s", e.Kind, e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Kind, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Kind
+}
+
+var httpClient *http.Client
+var httpClientOnce sync.Once
+var tokenSource oauth2.TokenSource
+var tokenSourceMutex sync.Mutex
+
+// Create - Creates the given network policies, in chunks of conf.PolicyServerChunkSize. Policies that already exist are ignored by the policy server.
+// If the deadline is not zero, the requests and their retries give up at the deadline.
+func Create(deadline time.Time, policies []model.NetworkPolicy) error {
+	return send(deadline, conf.ActionBind, "/networking/v1/external/policies", policies)
+}
+
+// Delete - Deletes the given network policies, in chunks of conf.PolicyServerChunkSize. Policies that do not exist are ignored by the policy server.
+// If the deadline is not zero, the requests and their retries give up at the deadline.
+func Delete(deadline time.Time, policies []model.NetworkPolicy) error {
+	return send(deadline, conf.ActionUnbind, "/networking/v1/external/policies/delete", policies)
+}
+
+// List - Returns the network policies that have one of the given apps as source or destination.
+// The apps are queried in batches (using the id filter), policies between apps in different batches are only returned once.
+// If the deadline is not zero, the requests and their retries give up at the deadline.
+func List(deadline time.Time, appGuids []string) ([]model.NetworkPolicy, error) {
+	policies := make([]model.NetworkPolicy, 0)
+	seen := make(map[string]bool)
+	for i := 0; i < len(appGuids); i += conf.PolicyServerQueryBatchSize {
+		end := min(i+conf.PolicyServerQueryBatchSize, len(appGuids))
+		body, err := do(deadline, http.MethodGet, "/networking/v1/external/policies?id="+url.QueryEscape(strings.Join(appGuids[i:end], ",")), nil)
+		if err != nil {
+			return nil, err
+		}
+		response := model.PolicyServerGetResponse{}
+		if err = json.Unmarshal(body, &response); err != nil {
+			return nil, fmt.Errorf("failed to parse GET response from policy server: %s", err)
+		}
+		for _, policy := range response.Policies {
+			if !seen[policy.Key()] {
+				seen[policy.Key()] = true
+				policies = append(policies, policy)
+			}
+		}
+	}
+	if conf.Debug {
+		fmt.Printf("found %d existing network policies for %d apps\n", len(policies), len(appGuids))
+	}
+	return policies, nil
+}
+
+// ChunkSlice - "chop" the give slice in smaller pieces and return them
+func ChunkSlice(slice []model.NetworkPolicy, chunkSize int) [][]model.NetworkPolicy {
+	var chunks [][]model.NetworkPolicy
+	for i := 0; i < len(slice); i += chunkSize {
+		end := i + chunkSize
+		if end > len(slice) {
+			end = len(slice)
+		}
+		chunks = append(chunks, slice[i:end])
+	}
+	return chunks
+}
+
+func send(deadline time.Time, action string, path string, policies []model.NetworkPolicy) error {
+	for ix, chunk := range ChunkSlice(policies, conf.PolicyServerChunkSize) {
+		policiesJson, err := json.Marshal(model.NetworkPolicies{Policies: chunk})
+		if err != nil {
+			return fmt.Errorf("failed to marshal policies to json: %s", err)
+		}
+		if conf.Debug {
+			fmt.Printf("chunk %d - sending %d policy %s action(s) to policy server:\n%v\n", ix, len(chunk), action, chunk)
+		} else {
+			fmt.Printf("chunk %d - sending %d policy %s action(s) to policy server\n", ix, len(chunk), action)
+		}
+		if _, err = do(deadline, http.MethodPost, path, policiesJson); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// do - Sends the request to the policy server and returns the response body. Timeouts, connection errors, 429 and 5xx responses are retried with exponential backoff and jitter,
+// a 401 is retried once with a fresh token. If the deadline is not zero, a request is cancelled at the deadline and no retry is started that would end after it.
+func do(deadline time.Time, method string, path string, body []byte) ([]byte, error) {
+	delay := conf.PolicyServerRetryDelay
+	tokenRefreshed := false
+	var lastErr error
+	for attempt := 1; attempt <= conf.PolicyServerMaxAttempts; attempt++ {
+		responseBody, err := doOnce(deadline, method, path, body)
+		if err == nil {
+			return responseBody, nil
+		}
+		lastErr = err
+		var policyServerError *Error
+		if errors.As(err, &policyServerError) && policyServerError.StatusCode == http.StatusUnauthorized && !tokenRefreshed {
+			tokenRefreshed = true
+			resetTokenSource()
+			continue
+		}
+		if !errors.Is(err, ErrUnavailable) {
+			return nil, err
+		}
+		if attempt < conf.PolicyServerMaxAttempts {
+			// add jitter, so multiple brokers (or syncs) do not retry at the same moment
+			sleep := time.Duration(rand.Int63n(int64(delay))) + delay/2
+			if !deadline.IsZero() && time.Now().Add(sleep).After(deadline) {
+				fmt.Printf("%s %s failed (attempt %d of %d), not retrying after the deadline: %s\n", method, path, attempt, conf.PolicyServerMaxAttempts, err)
+				return nil, lastErr
+			}
+			fmt.Printf("%s %s failed (attempt %d of %d), retrying in %s: %s\n", method, path, attempt, conf.PolicyServerMaxAttempts, sleep.Round(time.Millisecond), err)
+			time.Sleep(sleep)
+			delay = min(2*delay, conf.PolicyServerMaxRetryDelay)
+		}
+	}
+	return nil, lastErr
+}
+
+func doOnce(deadline time.Time, method string, path string, body []byte) ([]byte, error) {
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	token, err := getToken()
+	if err != nil {
+		return nil, &Error{Kind: ErrUnavailable, Message: fmt.Sprintf("failed to get a token for the policy server: %s", err)}
+	}
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, conf.CfApiURL+path, bodyReader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request for policy server: %s", err)
+	}
+	request.Header.Set("Authorization", token.Type()+" "+token.AccessToken)
+	request.Header.Set("Content-Type", "application/json")
+	startTime := time.Now()
+	response, err := getHttpClient().Do(request)
+	if err != nil {
+		return nil, &Error{Kind: ErrUnavailable, Message: err.Error()}
+	}
+	defer func() { _ = response.Body.Close() }()
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, &Error{Kind: ErrUnavailable, StatusCode: response.StatusCode, Message: fmt.Sprintf("failed to read response: %s", err)}
+	}
+	if conf.Debug {
+		fmt.Printf("response in %d ms from %s %s: Status code: %v: %s\n", time.Since(startTime).Milliseconds(), method, path, response.Status, responseBody)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, &Error{Kind: errorKind(response.StatusCode, string(responseBody)), StatusCode: response.StatusCode, Message: errorMessage(responseBody)}
+	}
+	return responseBody, nil
+}
+
+// errorKind - Maps the response code (and for 400/403 the error message) of the policy server to one of the Err* errors
+func errorKind(statusCode int, body string) error {
+	lowerBody := strings.ToLower(body)
+	switch {
+	case statusCode == http.StatusTooManyRequests || statusCode >= 500:
+		return ErrUnavailable
+	case strings.Contains(lowerBody, "quota") || strings.Contains(lowerBody, "maximum number of policies"):
+		return ErrLimitExceeded
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return ErrForbidden
+	default:
+		return ErrValidation
+	}
+}
+
+// errorMessage - The policy server returns errors as {"error": "..."}, if the body is something else we return it as is
+func errorMessage(body []byte) string {
+	var errorResponse struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &errorResponse); err == nil && errorResponse.Error != "" {
+		return errorResponse.Error
+	}
+	return string(body)
+}
+
+// getHttpClient - The one http client (and transport) that is used for all policy server requests
+func getHttpClient() *http.Client {
+	httpClientOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		if conf.SkipSslValidation {
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+		httpClient = &http.Client{Transport: transport, Timeout: conf.PolicyServerTimeout}
+	})
+	return httpClient
+}
+
+// getToken - Returns a valid token, the token source refreshes it when it is (about to be) expired
+func getToken() (*oauth2.Token, error) {
+	tokenSourceMutex.Lock()
+	defer tokenSourceMutex.Unlock()
+	if tokenSource == nil {
+		var err error
+		if tokenSource, err = conf.CfConfig.CreateOAuth2TokenSource(conf.CfCtx); err != nil {
+			return nil, err
+		}
+	}
+	return tokenSource.Token()
+}
+
+func resetTokenSource() {
+	tokenSourceMutex.Lock()
+	defer tokenSourceMutex.Unlock()
+	tokenSource = nil
+}
@@ -0,0 +1,210 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rabobank/npsb/conf"
+	"github.com/rabobank/npsb/model"
+)
+
+// Entry - A network policy that was created by the broker, with the service instance/binding it was created for
+type Entry struct {
+	Policy       model.NetworkPolicy `json:"policy"`
+	InstanceGuid string              `json:"instance_guid"`
+	BindingGuid  string              `json:"binding_guid"`
+	Created      time.Time           `json:"created"`
+	User         string              `json:"user"`
+}
+
+const SyncUser = "npsb-sync"
+
+// ErrSave - The registry could not be written to the registry file, the change is kept in memory and written with the next change
+var ErrSave = errors.New("failed to save the registry")
+
+var entries = make(map[string]Entry)
+var mutex sync.Mutex
+
+// rebuildNeeded - true if the registry file was not there, could not be parsed or was stale at startup, the first sync will then adopt all existing policies that are justified by the labels
+var rebuildNeeded = false
+
+// Load - Reads the registry file (conf.RegistryFile). The registry is rebuilt from the CC labels by the first sync if the file does not exist, if it can not be parsed (it is kept
+// as <file>.corrupt and we start with an empty registry) or if it was not written for more than conf.RegistryMaxAgeSecs (every complete sync writes it).
+// The file should be on a persistent volume, and only one broker instance should write it: the registry is kept in memory and the file is overwritten with every change.
+func Load() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	fileInfo, err := os.Stat(conf.RegistryFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("registry file %s not found, it will be rebuilt from the service instance labels\n", conf.RegistryFile)
+			rebuildNeeded = true
+			return nil
+		}
+		return fmt.Errorf("failed to read registry file %s: %s", conf.RegistryFile, err)
+	}
+	file, err := os.ReadFile(conf.RegistryFile)
+	if err != nil {
+		return fmt.Errorf("failed to read registry file %s: %s", conf.RegistryFile, err)
+	}
+	var loadedEntries []Entry
+	if err = json.Unmarshal(file, &loadedEntries); err != nil {
+		fmt.Printf("failed to parse registry file %s, it is kept as %s.corrupt and will be rebuilt from the service instance labels: %s\n", conf.RegistryFile, conf.RegistryFile, err)
+		if err = os.Rename(conf.RegistryFile, conf.RegistryFile+".corrupt"); err != nil {
+			return fmt.Errorf("failed to rename corrupt registry file %s: %s", conf.RegistryFile, err)
+		}
+		rebuildNeeded = true
+		return nil
+	}
+	for _, entry := range loadedEntries {
+		entries[entry.Policy.Key()] = entry
+	}
+	fmt.Printf("loaded %d network policies from registry file %s\n", len(entries), conf.RegistryFile)
+	if age := time.Since(fileInfo.ModTime()); conf.RegistryMaxAgeSecs > 0 && age > time.Duration(conf.RegistryMaxAgeSecs)*time.Second {
+		// the policies the broker created since the file was written are not in it, the first sync adopts them
+		fmt.Printf("registry file %s was last written %s ago, it will be completed from the service instance labels\n", conf.RegistryFile, age.Round(time.Second))
+		rebuildNeeded = true
+	}
+	return nil
+}
+
+// RebuildNeeded - Returns true if the registry has to be rebuilt from the CC labels
+func RebuildNeeded() bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return rebuildNeeded
+}
+
+// Rebuilt - Marks the registry as rebuilt and saves it
+func Rebuilt() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	rebuildNeeded = false
+	return save()
+}
+
+// Save - Writes the registry file, a complete sync calls it so the modification time of the file tells when the registry was last in sync with the CC labels
+func Save() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return save()
+}
+
+// Record - Registers the given network policies as created by the broker for the given service instance and binding
+func Record(policies []model.NetworkPolicy, instanceGuid string, bindingGuid string, user string) error {
+	if len(policies) == 0 {
+		return nil
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, policy := range policies {
+		entries[policy.Key()] = Entry{Policy: policy, InstanceGuid: instanceGuid, BindingGuid: bindingGuid, Created: time.Now(), User: user}
+	}
+	return save()
+}
+
+// Add - Registers the given entries, entries without a Created timestamp get the current time
+func Add(newEntries []Entry) error {
+	if len(newEntries) == 0 {
+		return nil
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, entry := range newEntries {
+		if entry.Created.IsZero() {
+			entry.Created = time.Now()
+		}
+		entries[entry.Policy.Key()] = entry
+	}
+	return save()
+}
+
+// Forget - Removes the given network policies from the registry
+func Forget(policies []model.NetworkPolicy) error {
+	if len(policies) == 0 {
+		return nil
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, policy := range policies {
+		delete(entries, policy.Key())
+	}
+	return save()
+}
+
+// Contains - Returns true if the given network policy was created by the broker
+func Contains(policy model.NetworkPolicy) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, found := entries[policy.Key()]
+	return found
+}
+
+// Get - Returns the registry entry of the given network policy, if it was created by the broker
+func Get(policy model.NetworkPolicy) (Entry, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	entry, found := entries[policy.Key()]
+	return entry, found
+}
+
+// Entries - Returns all registry entries that match the given filter (or all entries if the filter is nil), sorted by policy key
+func Entries(filter func(Entry) bool) []Entry {
+	mutex.Lock()
+	defer mutex.Unlock()
+	result := make([]Entry, 0)
+	for _, entry := range entries {
+		if filter == nil || filter(entry) {
+			result = append(result, entry)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Policy.Key() < result[j].Policy.Key() })
+	return result
+}
+
+// ForInstance - Returns the registry entries for the given service instance
+func ForInstance(instanceGuid string) []Entry {
+	return Entries(func(entry Entry) bool { return entry.InstanceGuid == instanceGuid })
+}
+
+// ForBinding - Returns the registry entries for the given service binding
+func ForBinding(bindingGuid string) []Entry {
+	return Entries(func(entry Entry) bool { return entry.BindingGuid == bindingGuid })
+}
+
+// save - Writes the registry to a temporary file and renames it to the registry file, so we never end up with a half written registry. The caller should hold the mutex.
+func save() error {
+	sortedEntries := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		sortedEntries = append(sortedEntries, entry)
+	}
+	sort.Slice(sortedEntries, func(i, j int) bool { return sortedEntries[i].Policy.Key() < sortedEntries[j].Policy.Key() })
+	data, err := json.MarshalIndent(sortedEntries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("%w: failed to marshal registry: %s", ErrSave, err)
+	}
+	tmpFile, err := os.CreateTemp(filepath.Dir(conf.RegistryFile), filepath.Base(conf.RegistryFile)+".tmp")
+	if err != nil {
+		return fmt.Errorf("%w: failed to create temporary registry file: %s", ErrSave, err)
+	}
+	if _, err = tmpFile.Write(data); err != nil {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+		return fmt.Errorf("%w: failed to write temporary registry file %s: %s", ErrSave, tmpFile.Name(), err)
+	}
+	if err = tmpFile.Close(); err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return fmt.Errorf("%w: failed to write temporary registry file %s: %s", ErrSave, tmpFile.Name(), err)
+	}
+	if err = os.Rename(tmpFile.Name(), conf.RegistryFile); err != nil {
+		_ = os.Remove(tmpFile.Name())
+		return fmt.Errorf("%w: failed to rename %s to registry file %s: %s", ErrSave, tmpFile.Name(), conf.RegistryFile, err)
+	}
+	return nil
+}
@@ -18,9 +18,14 @@ func StartServer() {
 	brokerRouter.Use(controllers.BasicAuthMiddleware)
 	brokerRouter.HandleFunc("/v2/catalog", controllers.Catalog).Methods("GET")
 	brokerRouter.HandleFunc("/v2/service_instances/{service_instance_guid}", controllers.CreateOrUpdateServiceInstance).Methods("PUT")
+	brokerRouter.HandleFunc("/v2/service_instances/{service_instance_guid}", controllers.UpdateServiceInstance).Methods("PATCH")
+	brokerRouter.HandleFunc("/v2/service_instances/{service_instance_guid}", controllers.GetServiceInstance).Methods("GET")
 	brokerRouter.HandleFunc("/v2/service_instances/{service_instance_guid}", controllers.DeleteServiceInstance).Methods("DELETE")
+	brokerRouter.HandleFunc("/v2/service_instances/{service_instance_guid}/last_operation", controllers.GetServiceInstanceLastOperation).Methods("GET")
 	brokerRouter.HandleFunc("/v2/service_instances/{service_instance_guid}/service_bindings/{service_binding_guid}", controllers.CreateServiceBinding).Methods("PUT")
+	brokerRouter.HandleFunc("/v2/service_instances/{service_instance_guid}/service_bindings/{service_binding_guid}", controllers.GetServiceBinding).Methods("GET")
 	brokerRouter.HandleFunc("/v2/service_instances/{service_instance_guid}/service_bindings/{service_binding_guid}", controllers.DeleteServiceBinding).Methods("DELETE")
+	brokerRouter.HandleFunc("/v2/service_instances/{service_instance_guid}/service_bindings/{service_binding_guid}/last_operation", controllers.GetServiceBindingLastOperation).Methods("GET")
 	http.Handle("/v2/", brokerRouter)
 
 	apiRouter := mux.NewRouter()
@@ -28,6 +33,8 @@ func StartServer() {
 	apiRouter.Use(controllers.AddHeadersMiddleware)
 	apiRouter.Use(controllers.CheckJWTMiddleware)
 	apiRouter.HandleFunc("/api/sources", controllers.GetSources).Methods(http.MethodGet)
+	apiRouter.HandleFunc("/api/sync", controllers.TriggerSync).Methods(http.MethodPost)
+	apiRouter.HandleFunc("/api/sync/runs", controllers.GetSyncRuns).Methods(http.MethodGet)
 	http.Handle("/api/", apiRouter)
 
 	fmt.Printf("server started, listening on port %d...\n", conf.ListenPort)
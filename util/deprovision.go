@@ -0,0 +1,74 @@
+package util
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cloudfoundry/go-cfclient/v3/resource"
+	"github.com/rabobank/npsb/backend"
+	"github.com/rabobank/npsb/conf"
+	"github.com/rabobank/npsb/model"
+	"github.com/rabobank/npsb/registry"
+)
+
+// MarkDangling - Adds the given (deleted) source to the npsb.dest.dangling.sources annotation of the destination instance, so the destination no longer refers to it
+// and does not silently match a new source with the same name. The annotation is visible to the users of the destination instance.
+func MarkDangling(destination *resource.ServiceInstance, source model.SourceReference) error {
+	value := source.String()
+	if destination.Metadata != nil && destination.Metadata.Annotations[conf.AnnotationNameDanglingSources] != nil && *destination.Metadata.Annotations[conf.AnnotationNameDanglingSources] != "" {
+		if dangling, err := ParseSources(*destination.Metadata.Annotations[conf.AnnotationNameDanglingSources] + "," + value); err == nil {
+			value = FormatSources(dangling)
+		}
+	}
+	update := resource.ServiceInstanceManagedUpdate{Metadata: &resource.Metadata{Annotations: map[string]*string{conf.AnnotationNameDanglingSources: &value}}}
+	if _, _, err := conf.CfClient.ServiceInstances.UpdateManaged(conf.CfCtx, destination.GUID, &update); err != nil {
+		return fmt.Errorf("failed to mark source %s as dangling on destination service instance %s: %s", source, destination.GUID, err)
+	}
+	fmt.Printf("marked source %s as dangling on destination service instance %s (%s)\n", source, destination.GUID, destination.Name)
+	return nil
+}
+
+// DeleteInstancePolicies - Deletes the network policies the broker created for the given (source or destination) instance that is being deprovisioned: the policies registered for the
+// instance itself, and the policies registered for its peers (the destinations of a source, the sources of a destination) that involve its member apps.
+// Policies that are still justified by other instances are recreated by the next sync. The policy backend request gives up at the deadline. Returns the deleted policies.
+func DeleteInstancePolicies(instance *resource.ServiceInstance, peerInstanceGuids []string, deadline time.Time) ([]model.NetworkPolicy, error) {
+	members := make(map[string]bool)
+	if appGuids, err := MemberApps(instance); err != nil {
+		fmt.Printf("failed to get the apps of service instance %s, only deleting the policies registered for the instance: %s\n", instance.GUID, err)
+	} else {
+		for _, appGuid := range appGuids {
+			members[appGuid] = true
+		}
+	}
+	peers := make(map[string]bool)
+	for _, peerInstanceGuid := range peerInstanceGuids {
+		peers[peerInstanceGuid] = true
+	}
+	isSource := instance.Metadata != nil && instance.Metadata.Labels[conf.LabelNameType] != nil && *instance.Metadata.Labels[conf.LabelNameType] == conf.LabelValueTypeSrc
+	policies := make([]model.NetworkPolicy, 0)
+	for _, entry := range registry.Entries(func(entry registry.Entry) bool {
+		if entry.InstanceGuid == instance.GUID {
+			return true
+		}
+		if !peers[entry.InstanceGuid] {
+			return false
+		}
+		if isSource {
+			return members[entry.Policy.Source.Id]
+		}
+		return members[entry.Policy.Destination.Id]
+	}) {
+		policies = append(policies, entry.Policy)
+	}
+	if len(policies) == 0 {
+		return policies, nil
+	}
+	if err := backend.WithDeadline(deadline).Delete(policies); err != nil {
+		return nil, fmt.Errorf("failed to delete %d network policies of service instance %s: %s", len(policies), instance.GUID, err)
+	}
+	if err := registry.Forget(policies); err != nil {
+		return nil, err
+	}
+	fmt.Printf("deleted %d network policies of service instance %s (%s)\n", len(policies), instance.GUID, instance.Name)
+	return policies, nil
+}
@@ -0,0 +1,122 @@
+package util
+
+import (
+	"fmt"
+
+	"github.com/cloudfoundry/go-cfclient/v3/client"
+	"github.com/cloudfoundry/go-cfclient/v3/resource"
+	"github.com/rabobank/npsb/conf"
+	"github.com/rabobank/npsb/model"
+)
+
+// IsSpaceScoped - Returns true if all apps in the space of the (source) instance are members, instead of only the bound apps
+func IsSpaceScoped(metadata *resource.Metadata) bool {
+	return metadata != nil && metadata.Labels[conf.LabelNameScope] != nil && *metadata.Labels[conf.LabelNameScope] == conf.LabelValueScopeSpace
+}
+
+// AppSelector - Returns the app label selector of a source or destination instance, or an empty string if the instance has none
+func AppSelector(metadata *resource.Metadata) string {
+	if metadata == nil || metadata.Annotations[conf.AnnotationNameAppSelector] == nil {
+		return ""
+	}
+	return *metadata.Annotations[conf.AnnotationNameAppSelector]
+}
+
+// HasImplicitMembers - Returns true if the members of the instance are not the bound apps, but all apps in its space (scope=space) or the apps in its space that match its app selector
+func HasImplicitMembers(metadata *resource.Metadata) bool {
+	return IsSpaceScoped(metadata) || AppSelector(metadata) != ""
+}
+
+// MemberApps - Returns the guids of the apps that are members of the given instance: all apps in its space for scope=space, the apps in its space that match its app selector,
+// otherwise the bound apps
+func MemberApps(instance *resource.ServiceInstance) ([]string, error) {
+	appGuids := make([]string, 0)
+	spaceGuid := instance.Relationships.Space.Data.GUID
+	if IsSpaceScoped(instance.Metadata) {
+		spaceApps, err := ListSpaceApps([]string{spaceGuid})
+		if err != nil {
+			return nil, err
+		}
+		return append(appGuids, spaceApps[spaceGuid]...), nil
+	}
+	if selector := AppSelector(instance.Metadata); selector != "" {
+		return ListSelectorApps(spaceGuid, selector)
+	}
+	credBindingListOption := client.ServiceCredentialBindingListOptions{ListOptions: &client.ListOptions{PerPage: 1000}, ServiceInstanceGUIDs: client.Filter{Values: []string{instance.GUID}}}
+	bindings, err := conf.CfClient.ServiceCredentialBindings.ListAll(conf.CfCtx, &credBindingListOption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list service bindings for service instance %s: %s", instance.GUID, err)
+	}
+	for _, binding := range bindings {
+		appGuids = append(appGuids, binding.Relationships.App.Data.GUID)
+	}
+	return appGuids, nil
+}
+
+// ImplicitMemberApps - Returns the guids of the member apps of the instances with implicit members (see HasImplicitMembers), by instance guid.
+// The apps of all space scoped instances are listed with one request, for every app selector there is a request. An instance for which the apps could not be listed is
+// left out of the result, the errors are returned.
+func ImplicitMemberApps(instances []*resource.ServiceInstance) (map[string][]string, []error) {
+	memberApps := make(map[string][]string)
+	errs := make([]error, 0)
+	scopedSpaceGuids := make([]string, 0)
+	for _, instance := range instances {
+		if IsSpaceScoped(instance.Metadata) {
+			scopedSpaceGuids = append(scopedSpaceGuids, instance.Relationships.Space.Data.GUID)
+		}
+	}
+	spaceApps, err := ListSpaceApps(scopedSpaceGuids)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	for _, instance := range instances {
+		spaceGuid := instance.Relationships.Space.Data.GUID
+		if IsSpaceScoped(instance.Metadata) {
+			if err == nil {
+				memberApps[instance.GUID] = append(make([]string, 0), spaceApps[spaceGuid]...)
+			}
+		} else if selector := AppSelector(instance.Metadata); selector != "" {
+			if appGuids, selectorErr := ListSelectorApps(spaceGuid, selector); selectorErr != nil {
+				errs = append(errs, fmt.Errorf("service instance %s: %s", instance.GUID, selectorErr))
+			} else {
+				memberApps[instance.GUID] = appGuids
+			}
+		}
+	}
+	return memberApps, errs
+}
+
+// ListSpaceApps - Returns the guids of the apps in the given spaces, by space guid
+func ListSpaceApps(spaceGuids []string) (map[string][]string, error) {
+	spaceApps := make(map[string][]string)
+	if len(spaceGuids) == 0 {
+		return spaceApps, nil
+	}
+	appListOptions := client.AppListOptions{ListOptions: &client.ListOptions{PerPage: 5000}, SpaceGUIDs: client.Filter{Values: spaceGuids}}
+	apps, err := conf.CfClient.Applications.ListAll(conf.CfCtx, &appListOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the apps in %d spaces: %s", len(spaceGuids), err)
+	}
+	for _, app := range apps {
+		spaceApps[app.Relationships.Space.Data.GUID] = append(spaceApps[app.Relationships.Space.Data.GUID], app.GUID)
+	}
+	return spaceApps, nil
+}
+
+// ListSelectorApps - Returns the guids of the apps in the given space that match the given app label selector
+func ListSelectorApps(spaceGuid string, selector string) ([]string, error) {
+	labelSelector, err := model.ParseLabelSelector(selector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid app selector: %s", err)
+	}
+	appListOptions := client.AppListOptions{ListOptions: &client.ListOptions{LabelSel: labelSelector, PerPage: 5000}, SpaceGUIDs: client.Filter{Values: []string{spaceGuid}}}
+	apps, err := conf.CfClient.Applications.ListAll(conf.CfCtx, &appListOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the apps in space %s with selector %s: %s", spaceGuid, selector, err)
+	}
+	appGuids := make([]string, 0, len(apps))
+	for _, app := range apps {
+		appGuids = append(appGuids, app.GUID)
+	}
+	return appGuids, nil
+}
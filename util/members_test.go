@@ -0,0 +1,57 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/cloudfoundry/go-cfclient/v3/resource"
+	"github.com/rabobank/npsb/conf"
+)
+
+func TestIsSpaceScoped(t *testing.T) {
+	space, other := conf.LabelValueScopeSpace, "instance"
+	tests := []struct {
+		name     string
+		metadata *resource.Metadata
+		expected bool
+	}{
+		{"no metadata", nil, false},
+		{"no scope", &resource.Metadata{Labels: map[string]*string{}}, false},
+		{"scope space", &resource.Metadata{Labels: map[string]*string{conf.LabelNameScope: &space}}, true},
+		{"other scope", &resource.Metadata{Labels: map[string]*string{conf.LabelNameScope: &other}}, false},
+		{"scope space as annotation", &resource.Metadata{Annotations: map[string]*string{conf.LabelNameScope: &space}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if scoped := IsSpaceScoped(test.metadata); scoped != test.expected {
+				t.Errorf("expected %t, got %t", test.expected, scoped)
+			}
+			if implicit := HasImplicitMembers(test.metadata); implicit != test.expected {
+				t.Errorf("expected implicit members %t, got %t", test.expected, implicit)
+			}
+		})
+	}
+}
+
+func TestAppSelector(t *testing.T) {
+	selector := "team=payments"
+	tests := []struct {
+		name     string
+		metadata *resource.Metadata
+		expected string
+	}{
+		{"no metadata", nil, ""},
+		{"no annotation", &resource.Metadata{Annotations: map[string]*string{}}, ""},
+		{"annotation", &resource.Metadata{Annotations: map[string]*string{conf.AnnotationNameAppSelector: &selector}}, selector},
+		{"label", &resource.Metadata{Labels: map[string]*string{conf.AnnotationNameAppSelector: &selector}}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if appSelector := AppSelector(test.metadata); appSelector != test.expected {
+				t.Errorf("expected selector \"%s\", got \"%s\"", test.expected, appSelector)
+			}
+			if implicit := HasImplicitMembers(test.metadata); implicit != (test.expected != "") {
+				t.Errorf("expected implicit members %t, got %t", test.expected != "", implicit)
+			}
+		})
+	}
+}
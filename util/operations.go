@@ -0,0 +1,122 @@
+package util
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rabobank/npsb/conf"
+	"github.com/rabobank/npsb/model"
+)
+
+// trackedOperation - the state of an asynchronous operation, as reported to the Cloud Controller through the last_operation endpoint
+type trackedOperation struct {
+	id          string
+	state       string
+	description string
+	updated     time.Time
+}
+
+var operations = make(map[string]*trackedOperation)
+var operationsMutex sync.Mutex
+
+// RunOperation - Starts an asynchronous operation for the given key (a service instance or binding guid) and returns its operation id.
+// The work function is retried with an increasing delay until it succeeds or conf.OperationMaxAttempts is reached, the outcome can be queried with GetOperation.
+func RunOperation(key string, description string, work func() (string, error)) string {
+	return RunOperationWithProgress(key, description, func(progress func(string)) (string, error) { return work() })
+}
+
+// RunOperationWithProgress - Like RunOperation, but the work function gets a progress function it can call (i.e. "120/300 policies applied"),
+// the progress is reported as the description of the operation while it is in progress.
+func RunOperationWithProgress(key string, description string, work func(progress func(string)) (string, error)) string {
+	return startOperation(key, description, work, nil)
+}
+
+// RunOperationWithRollback - Like RunOperation, but if the work keeps failing the rollback function is called with the error, so it can undo what the work did.
+// The operation stays in progress until the rollback is done, and then reports failed.
+func RunOperationWithRollback(key string, description string, work func() (string, error), rollback func(error)) string {
+	return startOperation(key, description, func(progress func(string)) (string, error) { return work() }, rollback)
+}
+
+func startOperation(key string, description string, work func(progress func(string)) (string, error), rollback func(error)) string {
+	operation := &trackedOperation{id: newOperationId(), state: conf.OperationStateInProgress, description: description, updated: time.Now()}
+	operationsMutex.Lock()
+	cleanOperations()
+	operations[key] = operation
+	operationsMutex.Unlock()
+
+	progress := func(message string) {
+		setOperationState(key, operation.id, conf.OperationStateInProgress, message)
+	}
+	go func() {
+		result, err := retryOperation(key, operation.id, description, func() (string, error) { return work(progress) })
+		if err != nil {
+			if rollback != nil {
+				setOperationState(key, operation.id, conf.OperationStateInProgress, fmt.Sprintf("rolling back: %s", err))
+				rollback(err)
+			}
+			setOperationState(key, operation.id, conf.OperationStateFailed, err.Error())
+			return
+		}
+		setOperationState(key, operation.id, conf.OperationStateSucceeded, result)
+	}()
+	return operation.id
+}
+
+// retryOperation - Calls the given function with an increasing delay until it succeeds or conf.OperationMaxAttempts is reached
+func retryOperation(key string, operationId string, description string, attempt func() (string, error)) (string, error) {
+	delay := conf.OperationRetryDelay
+	for attemptNr := 1; ; attemptNr++ {
+		result, err := attempt()
+		if err == nil {
+			return result, nil
+		}
+		fmt.Printf("operation %s for %s failed (attempt %d of %d): %s\n", operationId, key, attemptNr, conf.OperationMaxAttempts, err)
+		if attemptNr >= conf.OperationMaxAttempts {
+			return "", fmt.Errorf("%s failed after %d attempts: %s", description, attemptNr, err)
+		}
+		setOperationState(key, operationId, conf.OperationStateInProgress, fmt.Sprintf("%s (attempt %d failed, retrying): %s", description, attemptNr, err))
+		time.Sleep(delay)
+		if delay *= 2; delay > conf.OperationMaxRetryDelay {
+			delay = conf.OperationMaxRetryDelay
+		}
+	}
+}
+
+// GetOperation - Returns the state of the last operation for the given key, if operationId is not empty it should match the id of that operation
+func GetOperation(key string, operationId string) (model.Operation, bool) {
+	operationsMutex.Lock()
+	defer operationsMutex.Unlock()
+	if operation, found := operations[key]; found && (operationId == "" || operationId == operation.id) {
+		return model.Operation{State: operation.state, Description: operation.description}, true
+	}
+	return model.Operation{}, false
+}
+
+func setOperationState(key string, operationId string, state string, description string) {
+	operationsMutex.Lock()
+	defer operationsMutex.Unlock()
+	if operation, found := operations[key]; found && operation.id == operationId {
+		operation.state = state
+		operation.description = description
+		operation.updated = time.Now()
+	}
+}
+
+// cleanOperations - remove finished operations that the Cloud Controller had plenty of time to pick up, the caller should hold the operationsMutex
+func cleanOperations() {
+	for key, operation := range operations {
+		if operation.state != conf.OperationStateInProgress && time.Since(operation.updated) > 1*time.Hour {
+			delete(operations, key)
+			PrintfIfDebug("cleaned operation %s for %s\n", operation.id, key)
+		}
+	}
+}
+
+func newOperationId() string {
+	randomBytes := make([]byte, 8)
+	_, _ = rand.Read(randomBytes)
+	return hex.EncodeToString(randomBytes)
+}
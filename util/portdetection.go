@@ -0,0 +1,86 @@
+package util
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry/go-cfclient/v3/client"
+	"github.com/rabobank/npsb/conf"
+)
+
+// DetectAppPort - Detects the port the given (destination) app listens on.
+// The routes on an internal domain (apps.internal) are the strongest signal, if they all point to the same port that port is used.
+// Otherwise the destination ports of the other routes and the health check port of the web process are the candidates, and there should be exactly one.
+// If the port can not be detected, or the choice is ambiguous, the error lists the candidate ports so the port parameter can be specified.
+func DetectAppPort(appGuid string) (int, error) {
+	routes, internalDomains, err := listAppRoutes(appGuid)
+	if err != nil {
+		return 0, err
+	}
+	internalPorts := make(map[int]bool)
+	otherPorts := make(map[int]bool)
+	for _, route := range routes {
+		for _, destination := range route.Destinations {
+			if destination.App.GUID == nil || *destination.App.GUID != appGuid {
+				continue
+			}
+			// a destination without a port uses the default port of the app
+			port := 8080
+			if destination.Port != nil {
+				port = *destination.Port
+			}
+			if internalDomains[route.Relationships.Domain.Data.GUID] {
+				internalPorts[port] = true
+			} else {
+				otherPorts[port] = true
+			}
+		}
+	}
+	if len(internalPorts) == 1 {
+		return sortedPorts(internalPorts)[0], nil
+	}
+	if len(internalPorts) > 1 {
+		return 0, fmt.Errorf("app %s has internal routes to more than one port (%s), please specify the port parameter", Guid2AppName(appGuid), portList(internalPorts))
+	}
+
+	// the port and http health checks of the web process check the first port of the app instance
+	if process, err := conf.CfClient.Processes.SingleForApp(conf.CfCtx, appGuid, &client.ProcessListOptions{ListOptions: &client.ListOptions{}, Types: client.Filter{Values: []string{"web"}}}); err != nil {
+		PrintfIfDebug("could not get the web process of app %s: %s\n", appGuid, err)
+	} else if process.HealthCheck.Type == "port" || process.HealthCheck.Type == "http" {
+		if stats, err := conf.CfClient.Processes.GetStats(conf.CfCtx, process.GUID); err != nil {
+			PrintfIfDebug("could not get the stats of the web process of app %s: %s\n", appGuid, err)
+		} else {
+			for _, stat := range stats.Stats {
+				if len(stat.InstancePorts) > 0 && stat.InstancePorts[0]["internal"] != 0 {
+					otherPorts[stat.InstancePorts[0]["internal"]] = true
+					break
+				}
+			}
+		}
+	}
+	if len(otherPorts) == 1 {
+		return sortedPorts(otherPorts)[0], nil
+	}
+	if len(otherPorts) > 1 {
+		return 0, fmt.Errorf("could not choose the port of app %s, the candidate ports are %s, please specify the port parameter", Guid2AppName(appGuid), portList(otherPorts))
+	}
+	return 0, fmt.Errorf("could not detect the port of app %s (it has no routes and no running web process with a port health check), please specify the port parameter", Guid2AppName(appGuid))
+}
+
+func sortedPorts(ports map[int]bool) []int {
+	result := make([]int, 0, len(ports))
+	for port := range ports {
+		result = append(result, port)
+	}
+	sort.Ints(result)
+	return result
+}
+
+func portList(ports map[int]bool) string {
+	portStrings := make([]string, 0, len(ports))
+	for _, port := range sortedPorts(ports) {
+		portStrings = append(portStrings, fmt.Sprintf("%d", port))
+	}
+	return strings.Join(portStrings, ", ")
+}
@@ -0,0 +1,191 @@
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry/go-cfclient/v3/client"
+	"github.com/cloudfoundry/go-cfclient/v3/resource"
+	"github.com/rabobank/npsb/conf"
+)
+
+var invalidHostnameChars = regexp.MustCompile("[^a-z0-9-]+")
+
+// listAppRoutes - Returns the routes of the given app, and the guids of the internal domains (like apps.internal) of those routes
+func listAppRoutes(appGuid string) (routes []*resource.Route, internalDomains map[string]bool, err error) {
+	routeListOptions := client.RouteListOptions{ListOptions: &client.ListOptions{PerPage: 100}, AppGUIDs: client.Filter{Values: []string{appGuid}}}
+	routes, domains, err := conf.CfClient.Routes.ListIncludeDomainsAll(conf.CfCtx, &routeListOptions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list routes for app %s: %s", appGuid, err)
+	}
+	internalDomains = make(map[string]bool)
+	for _, domain := range domains {
+		if domain.Internal {
+			internalDomains[domain.GUID] = true
+		}
+	}
+	return routes, internalDomains, nil
+}
+
+// InternalHostnames - Returns the (sorted) hostnames of the routes on an internal domain of the given app, like myapp.apps.internal. Errors are logged, they result in an empty list.
+func InternalHostnames(appGuid string) []string {
+	hostnames := make([]string, 0)
+	routes, internalDomains, err := listAppRoutes(appGuid)
+	if err != nil {
+		fmt.Println(err)
+		return hostnames
+	}
+	for _, route := range routes {
+		if internalDomains[route.Relationships.Domain.Data.GUID] {
+			hostnames = append(hostnames, route.URL)
+		}
+	}
+	sort.Strings(hostnames)
+	return hostnames
+}
+
+// DefaultInternalHostname - Returns the hostname for an internal route of an app, derived from the app name (lowercase, only letters, digits and hyphens)
+func DefaultInternalHostname(appName string) string {
+	hostname := strings.Trim(invalidHostnameChars.ReplaceAllString(strings.ToLower(appName), "-"), "-")
+	if len(hostname) > 63 {
+		hostname = strings.Trim(hostname[:63], "-")
+	}
+	return hostname
+}
+
+// EnsureInternalRoute - Makes sure the given app has a route with the given hostname on the internal domain (conf.InternalDomain).
+// If the route does not exist yet, it is created with the label npsb.binding.guid, so it can be removed on unbind, and the app is mapped to it.
+// An existing route (that was not created by the broker) is only mapped to the app. Returns the url of the route and true if the route was created.
+func EnsureInternalRoute(appGuid string, bindingGuid string, hostname string) (string, bool, error) {
+	app, err := conf.CfClient.Applications.Get(conf.CfCtx, appGuid)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get app %s: %s", appGuid, err)
+	}
+	if hostname == "" {
+		hostname = DefaultInternalHostname(app.Name)
+	}
+	domain, err := conf.CfClient.Domains.Single(conf.CfCtx, &client.DomainListOptions{ListOptions: &client.ListOptions{}, Names: client.Filter{Values: []string{conf.InternalDomain}}})
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get internal domain %s: %s", conf.InternalDomain, err)
+	}
+	spaceGuid := app.Relationships.Space.Data.GUID
+	routeListOptions := client.RouteListOptions{ListOptions: &client.ListOptions{}, DomainGUIDs: client.Filter{Values: []string{domain.GUID}}, Hosts: client.Filter{Values: []string{hostname}}}
+	routes, err := conf.CfClient.Routes.ListAll(conf.CfCtx, &routeListOptions)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to list routes for %s.%s: %s", hostname, conf.InternalDomain, err)
+	}
+	var route *resource.Route
+	created := false
+	if len(routes) > 0 {
+		route = routes[0]
+		if route.Relationships.Space.Data.GUID != spaceGuid {
+			return "", false, fmt.Errorf("internal route %s is already taken by another space, please specify another internalRouteHostname", route.URL)
+		}
+		for _, destination := range route.Destinations {
+			if destination.App.GUID != nil && *destination.App.GUID == appGuid {
+				PrintfIfDebug("internal route %s is already mapped to app %s\n", route.URL, app.Name)
+				return route.URL, false, nil
+			}
+		}
+	} else {
+		routeCreate := resource.RouteCreate{
+			Relationships: resource.RouteRelationships{Space: resource.ToOneRelationship{Data: &resource.Relationship{GUID: spaceGuid}}, Domain: resource.ToOneRelationship{Data: &resource.Relationship{GUID: domain.GUID}}},
+			Host:          &hostname,
+			Metadata:      &resource.Metadata{Labels: map[string]*string{conf.LabelNameBindingGuid: &bindingGuid}},
+		}
+		if route, err = conf.CfClient.Routes.Create(conf.CfCtx, &routeCreate); err != nil {
+			return "", false, fmt.Errorf("failed to create internal route %s.%s: %s", hostname, conf.InternalDomain, err)
+		}
+		created = true
+		fmt.Printf("created internal route %s for app %s\n", route.URL, app.Name)
+	}
+	if _, err = conf.CfClient.Routes.InsertDestinations(conf.CfCtx, route.GUID, []*resource.RouteDestinationInsertOrReplace{{App: resource.RouteDestinationApp{GUID: &appGuid}}}); err != nil {
+		return route.URL, created, fmt.Errorf("failed to map internal route %s to app %s: %s", route.URL, app.Name, err)
+	}
+	fmt.Printf("mapped internal route %s to app %s\n", route.URL, app.Name)
+	return route.URL, created, nil
+}
+
+// DeleteInternalRoutes - Deletes the internal routes that were created by the broker for the given service binding (the routes with label npsb.binding.guid=bindingGuid).
+// A route that another binding (of an app mapped to it) still needs is not deleted, it is handed over to that binding. Returns the number of deleted routes.
+func DeleteInternalRoutes(bindingGuid string) (int, error) {
+	labelSelector := client.LabelSelector{}
+	labelSelector.EqualTo(conf.LabelNameBindingGuid, bindingGuid)
+	routes, err := conf.CfClient.Routes.ListAll(conf.CfCtx, &client.RouteListOptions{ListOptions: &client.ListOptions{LabelSel: labelSelector}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list internal routes for service binding %s: %s", bindingGuid, err)
+	}
+	deleted := 0
+	for _, route := range routes {
+		routeDeleted, err := ReleaseInternalRoute(route, bindingGuid)
+		if err != nil {
+			return deleted, err
+		}
+		if routeDeleted {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// ReleaseInternalRoute - Releases an internal route that was created by the broker for the given service binding, which is (being) deleted.
+// The route is only deleted if no other binding with npsb.dest.internal.route=true of an app mapped to the route wants the same hostname, otherwise the npsb.binding.guid label
+// is moved to that binding, so the route is deleted when the last binding that needs it is deleted. Returns true if the route was deleted.
+func ReleaseInternalRoute(route *resource.Route, bindingGuid string) (bool, error) {
+	otherBindingGuid, err := otherRouteBinding(route, bindingGuid)
+	if err != nil {
+		return false, err
+	}
+	if otherBindingGuid != "" {
+		routeUpdate := resource.RouteUpdate{Metadata: &resource.Metadata{Labels: map[string]*string{conf.LabelNameBindingGuid: &otherBindingGuid}}}
+		if _, err = conf.CfClient.Routes.Update(conf.CfCtx, route.GUID, &routeUpdate); err != nil {
+			return false, fmt.Errorf("failed to hand over internal route %s to service binding %s: %s", route.URL, otherBindingGuid, err)
+		}
+		fmt.Printf("internal route %s of service binding %s is still needed by service binding %s, handed it over\n", route.URL, bindingGuid, otherBindingGuid)
+		return false, nil
+	}
+	if _, err = conf.CfClient.Routes.Delete(conf.CfCtx, route.GUID); err != nil {
+		return false, fmt.Errorf("failed to delete internal route %s: %s", route.URL, err)
+	}
+	fmt.Printf("deleted internal route %s of service binding %s\n", route.URL, bindingGuid)
+	return true, nil
+}
+
+// otherRouteBinding - Returns the guid of a service binding (other than bindingGuid) with npsb.dest.internal.route=true of an app that is mapped to the route,
+// that wants the hostname of the route (its npsb.dest.internal.hostname annotation, or the default hostname for the app). Returns an empty string if there is none.
+func otherRouteBinding(route *resource.Route, bindingGuid string) (string, error) {
+	appGuids := make([]string, 0)
+	for _, destination := range route.Destinations {
+		if destination.App.GUID != nil {
+			appGuids = append(appGuids, *destination.App.GUID)
+		}
+	}
+	if len(appGuids) == 0 {
+		return "", nil
+	}
+	labelSelector := client.LabelSelector{}
+	labelSelector.EqualTo(conf.LabelNameInternalRoute, "true")
+	bindingListOptions := client.ServiceCredentialBindingListOptions{ListOptions: &client.ListOptions{LabelSel: labelSelector}, AppGUIDs: client.Filter{Values: appGuids}}
+	bindings, err := conf.CfClient.ServiceCredentialBindings.ListAll(conf.CfCtx, &bindingListOptions)
+	if err != nil {
+		return "", fmt.Errorf("failed to list the service bindings of the apps of internal route %s: %s", route.URL, err)
+	}
+	for _, binding := range bindings {
+		if binding.GUID == bindingGuid || binding.Relationships.App.Data == nil {
+			continue
+		}
+		hostname := ""
+		if binding.Metadata != nil && binding.Metadata.Annotations[conf.AnnotationNameInternalHost] != nil {
+			hostname = *binding.Metadata.Annotations[conf.AnnotationNameInternalHost]
+		}
+		if hostname == "" {
+			hostname = DefaultInternalHostname(Guid2AppName(binding.Relationships.App.Data.GUID))
+		}
+		if hostname == route.Host {
+			return binding.GUID, nil
+		}
+	}
+	return "", nil
+}
@@ -0,0 +1,84 @@
+package util
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/cloudfoundry/go-cfclient/v3/client"
+	"github.com/cloudfoundry/go-cfclient/v3/resource"
+	"github.com/rabobank/npsb/conf"
+	"github.com/rabobank/npsb/model"
+)
+
+// EgressSecurityGroupName - The name of the security group of an egress service instance, it is derived from the instance guid so we can always find it back
+func EgressSecurityGroupName(instanceGuid string) string {
+	return conf.EgressSecurityGroupPrefix + instanceGuid
+}
+
+// EgressCidrAllowed - Checks if the given CIDR is completely within one of the CIDRs in EGRESS_ALLOWED_CIDRS
+func EgressCidrAllowed(cidr *net.IPNet) bool {
+	requestedOnes, requestedBits := cidr.Mask.Size()
+	for _, allowed := range conf.EgressAllowedCidrs {
+		allowedOnes, allowedBits := allowed.Mask.Size()
+		if allowedBits == requestedBits && allowedOnes <= requestedOnes && allowed.Contains(cidr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// EnsureEgressSecurityGroup - Creates (or updates the rules of) the security group for the given egress service instance, and binds it to the space of the instance for running apps.
+// Returns the guid of the security group. Apps in the space have to be restarted before the rules apply.
+func EnsureEgressSecurityGroup(instanceGuid string, spaceGuid string, parms model.ServiceInstanceParameters) (string, error) {
+	rules := make([]*resource.SecurityGroupRule, 0, len(parms.Destinations))
+	for _, destination := range parms.Destinations {
+		rule := &resource.SecurityGroupRule{Protocol: parms.Protocol, Destination: destination}
+		if parms.Protocol != conf.EgressProtocolAll {
+			rule.WithPorts(parms.Ports)
+		}
+		rules = append(rules, rule.WithDescription(fmt.Sprintf("npsb egress service instance %s", instanceGuid)))
+	}
+	name := EgressSecurityGroupName(instanceGuid)
+	securityGroups, err := conf.CfClient.SecurityGroups.ListAll(conf.CfCtx, &client.SecurityGroupListOptions{ListOptions: &client.ListOptions{}, Names: client.Filter{Values: []string{name}}})
+	if err != nil {
+		return "", fmt.Errorf("failed to list security groups with name %s: %s", name, err)
+	}
+	var securityGroup *resource.SecurityGroup
+	if len(securityGroups) > 0 {
+		if securityGroup, err = conf.CfClient.SecurityGroups.Update(conf.CfCtx, securityGroups[0].GUID, &resource.SecurityGroupUpdate{Rules: rules}); err != nil {
+			return "", fmt.Errorf("failed to update security group %s: %s", name, err)
+		}
+		fmt.Printf("updated security group %s with %d rules\n", name, len(rules))
+	} else {
+		if securityGroup, err = conf.CfClient.SecurityGroups.Create(conf.CfCtx, &resource.SecurityGroupCreate{Name: name, Rules: rules}); err != nil {
+			return "", fmt.Errorf("failed to create security group %s: %s", name, err)
+		}
+		fmt.Printf("created security group %s with %d rules\n", name, len(rules))
+	}
+	for _, runningSpace := range securityGroup.Relationships.RunningSpaces.Data {
+		if runningSpace.GUID == spaceGuid {
+			return securityGroup.GUID, nil
+		}
+	}
+	if _, err = conf.CfClient.SecurityGroups.BindRunningSecurityGroup(conf.CfCtx, securityGroup.GUID, []string{spaceGuid}); err != nil {
+		return securityGroup.GUID, fmt.Errorf("failed to bind security group %s to space %s: %s", name, spaceGuid, err)
+	}
+	fmt.Printf("bound security group %s to space %s\n", name, spaceGuid)
+	return securityGroup.GUID, nil
+}
+
+// DeleteEgressSecurityGroup - Deletes the security group of the given egress service instance (if any), this also unbinds it from the space. Returns true if a security group was deleted.
+func DeleteEgressSecurityGroup(instanceGuid string) (bool, error) {
+	name := EgressSecurityGroupName(instanceGuid)
+	securityGroups, err := conf.CfClient.SecurityGroups.ListAll(conf.CfCtx, &client.SecurityGroupListOptions{ListOptions: &client.ListOptions{}, Names: client.Filter{Values: []string{name}}})
+	if err != nil {
+		return false, fmt.Errorf("failed to list security groups with name %s: %s", name, err)
+	}
+	for _, securityGroup := range securityGroups {
+		if _, err = conf.CfClient.SecurityGroups.Delete(conf.CfCtx, securityGroup.GUID); err != nil {
+			return false, fmt.Errorf("failed to delete security group %s: %s", name, err)
+		}
+		fmt.Printf("deleted security group %s\n", name)
+	}
+	return len(securityGroups) > 0, nil
+}
@@ -0,0 +1,154 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry/go-cfclient/v3/client"
+	"github.com/cloudfoundry/go-cfclient/v3/resource"
+	"github.com/rabobank/npsb/conf"
+	"github.com/rabobank/npsb/model"
+)
+
+// SourceLabelName - Returns the name of the label that marks a destination instance as referring to the given source, npsb.dest.src.<hash of org/space/name>.
+// Labels can not hold lists, but with a label per source the destination instances of a source can be found with a label selector.
+func SourceLabelName(source model.SourceReference) string {
+	hash := sha256.Sum256([]byte(source.String()))
+	return conf.LabelNameSourcePrefix + hex.EncodeToString(hash[:])[:16]
+}
+
+// InstanceSources - Returns the sources a destination instance refers to, from the npsb.dest.sources annotation or (for a single source) the npsb.dest.source.* labels.
+// Dangling sources (deleted after the destination referred to them) are left out, so a new source with the same name does not silently match.
+func InstanceSources(metadata *resource.Metadata) []model.SourceReference {
+	sources := make([]model.SourceReference, 0)
+	if metadata == nil {
+		return sources
+	}
+	dangling := DanglingSources(metadata)
+	if metadata.Annotations[conf.AnnotationNameSources] != nil && *metadata.Annotations[conf.AnnotationNameSources] != "" {
+		if parsed, err := ParseSources(*metadata.Annotations[conf.AnnotationNameSources]); err != nil {
+			fmt.Printf("ignoring invalid annotation %s=%s: %s\n", conf.AnnotationNameSources, *metadata.Annotations[conf.AnnotationNameSources], err)
+		} else {
+			for _, source := range parsed {
+				if !dangling[source.String()] {
+					sources = append(sources, source)
+				}
+			}
+			return sources
+		}
+	}
+	if metadata.Labels[conf.LabelNameSourceName] != nil && metadata.Labels[conf.LabelNameSourceSpace] != nil && metadata.Labels[conf.LabelNameSourceOrg] != nil {
+		source := model.SourceReference{Name: *metadata.Labels[conf.LabelNameSourceName], Space: *metadata.Labels[conf.LabelNameSourceSpace], Org: *metadata.Labels[conf.LabelNameSourceOrg]}
+		if !dangling[source.String()] {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+// DanglingSources - Returns the sources (org/space/name) in the npsb.dest.dangling.sources annotation of a destination instance, the sources that were deleted while the destination referred to them
+func DanglingSources(metadata *resource.Metadata) map[string]bool {
+	dangling := make(map[string]bool)
+	if metadata == nil || metadata.Annotations[conf.AnnotationNameDanglingSources] == nil || *metadata.Annotations[conf.AnnotationNameDanglingSources] == "" {
+		return dangling
+	}
+	parsed, err := ParseSources(*metadata.Annotations[conf.AnnotationNameDanglingSources])
+	if err != nil {
+		fmt.Printf("ignoring invalid annotation %s=%s: %s\n", conf.AnnotationNameDanglingSources, *metadata.Annotations[conf.AnnotationNameDanglingSources], err)
+		return dangling
+	}
+	for _, source := range parsed {
+		dangling[source.String()] = true
+	}
+	return dangling
+}
+
+// ReferringDestinations - Returns the destination instances (in all spaces) that refer to the given source, with the npsb.dest.source.* labels or with the label npsb.dest.src.<hash>.
+// Destinations for which the source is dangling are left out.
+func ReferringDestinations(source model.SourceReference) ([]*resource.ServiceInstance, error) {
+	labelSelector := client.LabelSelector{}
+	labelSelector.EqualTo(conf.LabelNameSourceName, source.Name)
+	labelSelector.EqualTo(conf.LabelNameSourceSpace, source.Space)
+	labelSelector.EqualTo(conf.LabelNameSourceOrg, source.Org)
+	sourceLabelSelector := client.LabelSelector{}
+	sourceLabelSelector.Existence(SourceLabelName(source))
+	destinations := make([]*resource.ServiceInstance, 0)
+	for _, selector := range []client.LabelSelector{labelSelector, sourceLabelSelector} {
+		instanceListOption := client.ServiceInstanceListOptions{ListOptions: &client.ListOptions{LabelSel: selector, PerPage: 5000}}
+		instances, err := conf.CfClient.ServiceInstances.ListAll(conf.CfCtx, &instanceListOption)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list destination service instances for source %s: %s", source, err)
+		}
+		for _, instance := range instances {
+			if !DanglingSources(instance.Metadata)[source.String()] {
+				destinations = append(destinations, instance)
+			}
+		}
+	}
+	return destinations, nil
+}
+
+// SourceReferenceOf - Returns the reference (org/space/name) of the source with the given name in the space with the given guid
+func SourceReferenceOf(name string, spaceGuid string) (model.SourceReference, error) {
+	space := GetSpaceByGuidCached(spaceGuid)
+	if space == nil {
+		return model.SourceReference{}, fmt.Errorf("failed to get space with guid %s", spaceGuid)
+	}
+	org := GetOrgByGuidCached(space.Relationships.Organization.Data.GUID)
+	if org == nil {
+		return model.SourceReference{}, fmt.Errorf("failed to get org with guid %s", space.Relationships.Organization.Data.GUID)
+	}
+	return model.SourceReference{Name: name, Space: space.Name, Org: org.Name}, nil
+}
+
+// FindSourceInstance - Returns the source instance with the given org, space and name, or nil if there is none
+func FindSourceInstance(source model.SourceReference) (*resource.ServiceInstance, error) {
+	orgListOptions := client.OrganizationListOptions{Names: client.Filter{Values: []string{source.Org}}}
+	org, err := conf.CfClient.Organizations.Single(conf.CfCtx, &orgListOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get org with name %s: %s", source.Org, err)
+	}
+	spaceListOptions := client.SpaceListOptions{Names: client.Filter{Values: []string{source.Space}}, OrganizationGUIDs: client.Filter{Values: []string{org.GUID}}}
+	space, err := conf.CfClient.Spaces.Single(conf.CfCtx, &spaceListOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get space with name %s in org with name %s: %s", source.Space, source.Org, err)
+	}
+	labelSelector := client.LabelSelector{}
+	labelSelector.EqualTo(conf.LabelNameName, source.Name)
+	instanceListOption := client.ServiceInstanceListOptions{SpaceGUIDs: client.Filter{Values: []string{space.GUID}}, ListOptions: &client.ListOptions{LabelSel: labelSelector}}
+	instances, err := conf.CfClient.ServiceInstances.ListAll(conf.CfCtx, &instanceListOption)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list service instances with label %s=%s: %s", conf.LabelNameName, source.Name, err)
+	}
+	// this should always be a single instance or none
+	if len(instances) < 1 {
+		return nil, nil
+	}
+	return instances[0], nil
+}
+
+// ParseSources - Parses the value of the npsb.dest.sources annotation, a comma separated list of org/space/name
+func ParseSources(value string) ([]model.SourceReference, error) {
+	sources := make([]model.SourceReference, 0)
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.Split(strings.TrimSpace(entry), "/")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("entry %s should be <org>/<space>/<name>", entry)
+		}
+		sources = append(sources, model.SourceReference{Org: parts[0], Space: parts[1], Name: parts[2]})
+	}
+	return sources, nil
+}
+
+// FormatSources - Returns the value for the npsb.dest.sources annotation, sorted so it does not change if the order of the parameters changes
+func FormatSources(sources []model.SourceReference) string {
+	entries := make([]string, 0, len(sources))
+	for _, source := range sources {
+		entries = append(entries, source.String())
+	}
+	sort.Strings(entries)
+	return strings.Join(entries, ",")
+}
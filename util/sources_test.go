@@ -0,0 +1,86 @@
+package util
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry/go-cfclient/v3/resource"
+	"github.com/rabobank/npsb/conf"
+	"github.com/rabobank/npsb/model"
+)
+
+func TestParseSources(t *testing.T) {
+	sources, err := ParseSources("org-a/space-a/source-a, org-b/space-b/source-b")
+	if err != nil {
+		t.Fatalf("failed to parse sources: %s", err)
+	}
+	expected := []model.SourceReference{{Org: "org-a", Space: "space-a", Name: "source-a"}, {Org: "org-b", Space: "space-b", Name: "source-b"}}
+	if !reflect.DeepEqual(sources, expected) {
+		t.Errorf("expected %v, got %v", expected, sources)
+	}
+}
+
+func TestParseSourcesRejectsMalformedInput(t *testing.T) {
+	for _, value := range []string{"", "org/space", "org/space/name/extra", "org//name", "/space/name", "org/space/", "org/space/name,"} {
+		if _, err := ParseSources(value); err == nil {
+			t.Errorf("expected sources \"%s\" to be rejected", value)
+		}
+	}
+}
+
+func TestFormatSources(t *testing.T) {
+	sources := []model.SourceReference{{Org: "org-b", Space: "space-b", Name: "source-b"}, {Org: "org-a", Space: "space-a", Name: "source-a"}}
+	value := FormatSources(sources)
+	// the value is sorted, so it does not change if the order of the parameters changes
+	if value != "org-a/space-a/source-a,org-b/space-b/source-b" {
+		t.Errorf("unexpected formatted sources %s", value)
+	}
+	parsed, err := ParseSources(value)
+	if err != nil {
+		t.Fatalf("failed to parse formatted sources %s: %s", value, err)
+	}
+	if FormatSources(parsed) != value {
+		t.Errorf("expected %s after parsing and formatting, got %s", value, FormatSources(parsed))
+	}
+}
+
+func TestSourceLabelName(t *testing.T) {
+	source := model.SourceReference{Org: "org-a", Space: "space-a", Name: "source-a"}
+	name := SourceLabelName(source)
+	if !strings.HasPrefix(name, conf.LabelNameSourcePrefix) || len(name) != len(conf.LabelNameSourcePrefix)+16 {
+		t.Errorf("unexpected label name %s", name)
+	}
+	if SourceLabelName(source) != name {
+		t.Errorf("expected the same label name for the same source")
+	}
+	if other := SourceLabelName(model.SourceReference{Org: "org-a", Space: "space-a", Name: "source-b"}); other == name {
+		t.Errorf("expected a different label name for a different source, got %s for both", name)
+	}
+}
+
+func TestInstanceSources(t *testing.T) {
+	annotation := "org-a/space-a/source-a,org-b/space-b/source-b"
+	dangling := "org-b/space-b/source-b"
+	sourceName, sourceSpace, sourceOrg := "source-c", "space-c", "org-c"
+	tests := []struct {
+		name     string
+		metadata *resource.Metadata
+		expected []model.SourceReference
+	}{
+		{"no metadata", nil, []model.SourceReference{}},
+		{"labels", &resource.Metadata{Labels: map[string]*string{conf.LabelNameSourceName: &sourceName, conf.LabelNameSourceSpace: &sourceSpace, conf.LabelNameSourceOrg: &sourceOrg}},
+			[]model.SourceReference{{Org: "org-c", Space: "space-c", Name: "source-c"}}},
+		{"annotation", &resource.Metadata{Annotations: map[string]*string{conf.AnnotationNameSources: &annotation}},
+			[]model.SourceReference{{Org: "org-a", Space: "space-a", Name: "source-a"}, {Org: "org-b", Space: "space-b", Name: "source-b"}}},
+		{"dangling", &resource.Metadata{Annotations: map[string]*string{conf.AnnotationNameSources: &annotation, conf.AnnotationNameDanglingSources: &dangling}},
+			[]model.SourceReference{{Org: "org-a", Space: "space-a", Name: "source-a"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if sources := InstanceSources(test.metadata); !reflect.DeepEqual(sources, test.expected) {
+				t.Errorf("expected %v, got %v", test.expected, sources)
+			}
+		})
+	}
+}
@@ -0,0 +1,675 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cloudfoundry/go-cfclient/v3/client"
+	"github.com/cloudfoundry/go-cfclient/v3/resource"
+	"github.com/rabobank/npsb/backend"
+	"github.com/rabobank/npsb/conf"
+	"github.com/rabobank/npsb/model"
+	"github.com/rabobank/npsb/policyserver"
+	"github.com/rabobank/npsb/registry"
+)
+
+const (
+	SyncTriggerInterval = "interval"
+	SyncTriggerApi      = "api"
+	maxSyncRunsKept     = 100
+	listGuidsChunkSize  = 100
+)
+
+// syncMutex - makes sure that only one sync runs at a time, whether it is started by the interval loop or by the api
+var syncMutex sync.Mutex
+var syncRuns []model.SyncRun
+var syncRunsMutex sync.Mutex
+var lastSyncRunId int
+
+// RunSync - Runs a sync and waits for it to finish. If another sync is running, it waits for that one to finish first.
+func RunSync(trigger string, instanceGuids []string, dryRun bool) model.SyncRun {
+	syncMutex.Lock()
+	defer syncMutex.Unlock()
+	return recordSyncRun(SyncLabels2Policies(nextSyncRunId(), trigger, instanceGuids, dryRun))
+}
+
+// TriggerSync - Starts a sync in the background and returns its id, returns false if another sync is already running
+func TriggerSync(trigger string, instanceGuids []string, dryRun bool) (int, bool) {
+	if !syncMutex.TryLock() {
+		return 0, false
+	}
+	runId := nextSyncRunId()
+	go func() {
+		defer syncMutex.Unlock()
+		recordSyncRun(SyncLabels2Policies(runId, trigger, instanceGuids, dryRun))
+	}()
+	return runId, true
+}
+
+// GetSyncRuns - Returns the last count sync runs, the most recent one first
+func GetSyncRuns(count int) []model.SyncRun {
+	syncRunsMutex.Lock()
+	defer syncRunsMutex.Unlock()
+	runs := make([]model.SyncRun, 0)
+	for ix := len(syncRuns) - 1; ix >= 0 && len(runs) < count; ix-- {
+		runs = append(runs, syncRuns[ix])
+	}
+	return runs
+}
+
+func nextSyncRunId() int {
+	syncRunsMutex.Lock()
+	defer syncRunsMutex.Unlock()
+	lastSyncRunId++
+	return lastSyncRunId
+}
+
+func recordSyncRun(run model.SyncRun) model.SyncRun {
+	syncRunsMutex.Lock()
+	defer syncRunsMutex.Unlock()
+	syncRuns = append(syncRuns, run)
+	if len(syncRuns) > maxSyncRunsKept {
+		syncRuns = syncRuns[len(syncRuns)-maxSyncRunsKept:]
+	}
+	return run
+}
+
+// SyncLabels2Policies - Find all ServiceInstances and their bound apps, figure out what network policies they represent, check if they exist, and if not, report and create them.
+// If instanceGuids is not empty, only the source and destination instances that belong to the same groups (source org/space/name) as those instances are synced,
+// and only the registry entries of those (possibly deleted) instances are candidates for deletion. Only those instances and their bindings are listed (see scopedInstances).
+// In dryRun mode nothing is changed, the report in the returned run (also printed as json) shows the missing, extra and matching network policies.
+// Do not call this directly, use RunSync or TriggerSync so syncs never overlap.
+func SyncLabels2Policies(runId int, trigger string, instanceGuids []string, dryRun bool) (run model.SyncRun) {
+	PrintfIfDebug("syncing labels to network policies (run: %d, trigger: %s, instances: %v, dry-run: %t)...\n", runId, trigger, instanceGuids, dryRun)
+	startTime := time.Now()
+	run = model.SyncRun{Id: runId, Trigger: trigger, InstanceGuids: instanceGuids, DryRun: dryRun, Started: startTime, Errors: make([]model.SyncError, 0)}
+	report := model.SyncReport{DryRun: dryRun, Started: startTime, Missing: make([]model.NetworkPolicyLabels, 0), Extra: make([]model.NetworkPolicyLabels, 0), Matching: make([]model.NetworkPolicyLabels, 0)}
+	defer func() {
+		run.Finished = time.Now()
+		if dryRun {
+			report.Finished = run.Finished
+			run.Report = &report
+		}
+	}()
+	var allInstancesWithBinds []model.InstancesWithBinds
+	var bindings []*resource.ServiceCredentialBinding
+	// we only delete stale policies if we have a complete picture of all instances and bindings
+	complete := true
+
+	//
+	// find all Instances with their binds, both source and destination, or for a scoped sync only the given instances and their counterparts
+	var instances []*resource.ServiceInstance
+	var err error
+	if len(instanceGuids) > 0 {
+		var errs []error
+		instances, errs = scopedInstances(instanceGuids)
+		for _, err = range errs {
+			fmt.Println(err)
+			run.Errors = append(run.Errors, model.SyncError{Message: err.Error()})
+			complete = false
+		}
+	} else {
+		labelSelector := client.LabelSelector{}
+		labelSelector.Existence(conf.LabelNameType)
+		instanceListOption := client.ServiceInstanceListOptions{ListOptions: &client.ListOptions{LabelSel: labelSelector, PerPage: 5000}}
+		if instances, err = conf.CfClient.ServiceInstances.ListAll(conf.CfCtx, &instanceListOption); err != nil {
+			fmt.Printf("failed to list all service instances with label %s: %s\n", conf.LabelNameType, err)
+			run.Errors = append(run.Errors, model.SyncError{Message: fmt.Sprintf("failed to list all service instances with label %s: %s", conf.LabelNameType, err)})
+			return run
+		}
+	}
+	if len(instances) < 1 {
+		PrintfIfDebug("could not find any service instances with label %s\n", conf.LabelNameType)
+	} else {
+		//
+		// get the "npsb" service bindings (by filtering on the presence of the label npsb.dest.port), of all instances or only of the instances of a scoped sync
+		if bindings, err = listBindings(instances, len(instanceGuids) > 0); err != nil {
+			fmt.Println(err)
+			run.Errors = append(run.Errors, model.SyncError{Message: err.Error()})
+			complete = false
+		} else {
+			run.Bindings = len(bindings)
+			// all apps in the space of a space scoped source, or the apps matching an app selector, are members without binding
+			memberApps, errs := ImplicitMemberApps(instances)
+			for _, err = range errs {
+				fmt.Println(err)
+				run.Errors = append(run.Errors, model.SyncError{Message: err.Error()})
+				complete = false
+			}
+			if allInstancesWithBinds, errs = indexInstancesWithBinds(instances, bindings, memberApps); len(errs) > 0 {
+				for _, err = range errs {
+					fmt.Println(err)
+					run.Errors = append(run.Errors, model.SyncError{Message: err.Error()})
+				}
+				complete = false
+			}
+		}
+	}
+	PrintfIfDebug("found %d instances with label %s\n", len(instances), conf.LabelNameType)
+
+	//
+	// if we sync only some instances, limit the instances to the groups (source org/space/name) of those instances
+	inScope := func(registry.Entry) bool { return true }
+	if len(instanceGuids) > 0 {
+		scopeInstanceGuids := make(map[string]bool)
+		for _, guid := range instanceGuids {
+			scopeInstanceGuids[guid] = true
+		}
+		groups := make(map[string]bool)
+		for _, instanceWithBinds := range allInstancesWithBinds {
+			if scopeInstanceGuids[instanceWithBinds.InstanceGuid] {
+				for _, group := range instanceWithBinds.Groups {
+					groups[group] = true
+				}
+			}
+		}
+		// a destination instance can be in more than one group, those groups are synced as well (until no more groups are added)
+		for added := true; added; {
+			added = false
+			for _, instanceWithBinds := range allInstancesWithBinds {
+				if !scopeInstanceGuids[instanceWithBinds.InstanceGuid] && inGroups(instanceWithBinds, groups) {
+					scopeInstanceGuids[instanceWithBinds.InstanceGuid] = true
+					for _, group := range instanceWithBinds.Groups {
+						if !groups[group] {
+							groups[group] = true
+							added = true
+						}
+					}
+				}
+			}
+		}
+		groupInstances := make([]model.InstancesWithBinds, 0)
+		for _, instanceWithBinds := range allInstancesWithBinds {
+			if inGroups(instanceWithBinds, groups) {
+				groupInstances = append(groupInstances, instanceWithBinds)
+				scopeInstanceGuids[instanceWithBinds.InstanceGuid] = true
+			}
+		}
+		allInstancesWithBinds = groupInstances
+		inScope = func(entry registry.Entry) bool { return scopeInstanceGuids[entry.InstanceGuid] }
+		PrintfIfDebug("limited sync to %d instances of %d groups\n", len(allInstancesWithBinds), len(groups))
+		run.Instances = len(allInstancesWithBinds)
+		run.Bindings = 0
+		for _, instanceWithBinds := range allInstancesWithBinds {
+			run.Bindings += len(instanceWithBinds.BoundApps)
+		}
+	} else {
+		run.Instances = len(instances)
+	}
+
+	//
+	// generate the required network policies objects, and diff them with the existing network policies
+	requiredNetworkPolicies, requiredOwners := requiredPolicies(allInstancesWithBinds)
+	PrintfIfDebug("found %d network policies that should exist according to labels\n", len(requiredNetworkPolicies))
+	existingNetworkPolicies, err := backend.List(involvedApps(allInstancesWithBinds, inScope))
+	if err != nil {
+		// without the existing policies everything would look missing (and nothing stale), so we do not change anything
+		fmt.Printf("failed to get the existing network policies, aborting sync: %s\n", err)
+		run.Errors = append(run.Errors, model.SyncError{Message: fmt.Sprintf("failed to get the existing network policies: %s", err)})
+		return run
+	}
+	missingNetworkPolicies, matchingNetworkPolicies := diffPolicies(requiredNetworkPolicies, existingNetworkPolicies)
+	if dryRun {
+		for _, policy := range missingNetworkPolicies {
+			report.Missing = append(report.Missing, reportedPolicy(policy, true))
+		}
+		for _, policy := range matchingNetworkPolicies {
+			report.Matching = append(report.Matching, reportedPolicy(policy, false))
+		}
+	}
+
+	var registryEntries []registry.Entry
+	rebuildRegistry := registry.RebuildNeeded() && complete && !dryRun && len(instanceGuids) == 0
+	if rebuildRegistry {
+		// the registry was lost, adopt the existing policies that are justified by the labels
+		for _, policy := range matchingNetworkPolicies {
+			if !registry.Contains(policy) {
+				owner := requiredOwners[policy.Key()]
+				registryEntries = append(registryEntries, registry.Entry{Policy: policy, InstanceGuid: owner.instanceGuid, BindingGuid: owner.bindingGuid, User: registry.SyncUser})
+			}
+		}
+	}
+
+	//
+	// create the missing network policies, in chunks to limit the number of requests to the policy backend
+	if !dryRun {
+		for _, chunk := range policyserver.ChunkSlice(missingNetworkPolicies, conf.PolicyServerChunkSize) {
+			fmt.Printf("%d network policies do not exist, creating them\n", len(chunk))
+			if err := backend.Create(chunk); err != nil {
+				fmt.Printf("failed to create %d network policies: %s\n", len(chunk), err)
+				run.Errors = append(run.Errors, chunkError("failed to create", chunk, err))
+			} else {
+				for _, policy := range chunk {
+					owner := requiredOwners[policy.Key()]
+					registryEntries = append(registryEntries, registry.Entry{Policy: policy, InstanceGuid: owner.instanceGuid, BindingGuid: owner.bindingGuid, User: registry.SyncUser})
+				}
+				run.PoliciesCreated += len(chunk)
+			}
+		}
+	}
+	if err := registry.Add(registryEntries); err != nil {
+		fmt.Printf("failed to register %d network policies: %s\n", len(registryEntries), err)
+		run.Errors = append(run.Errors, model.SyncError{Message: fmt.Sprintf("failed to register %d network policies: %s", len(registryEntries), err)})
+	}
+	if rebuildRegistry {
+		if err := registry.Rebuilt(); err != nil {
+			fmt.Printf("failed to save the rebuilt registry: %s\n", err)
+			run.Errors = append(run.Errors, model.SyncError{Message: fmt.Sprintf("failed to save the rebuilt registry: %s", err)})
+		}
+	}
+
+	//
+	// delete the network policies that were created by the broker, but are no longer justified by the labels
+	if complete {
+		stale := stalePolicies(requiredNetworkPolicies, existingNetworkPolicies, inScope, startTime)
+		if dryRun {
+			for _, policy := range stale {
+				report.Extra = append(report.Extra, reportedPolicy(policy, true))
+			}
+		} else if conf.SyncDeleteStale {
+			for _, chunk := range policyserver.ChunkSlice(stale, conf.PolicyServerChunkSize) {
+				fmt.Printf("%d network policies are no longer required, deleting them\n", len(chunk))
+				if err := backend.Delete(chunk); err != nil {
+					fmt.Printf("failed to delete %d network policies: %s\n", len(chunk), err)
+					run.Errors = append(run.Errors, chunkError("failed to delete", chunk, err))
+				} else {
+					if err = registry.Forget(chunk); err != nil {
+						fmt.Printf("failed to remove %d deleted network policies from the registry: %s\n", len(chunk), err)
+						run.Errors = append(run.Errors, model.SyncError{Message: fmt.Sprintf("failed to remove %d deleted network policies from the registry: %s", len(chunk), err)})
+					}
+					run.PoliciesDeleted += len(chunk)
+				}
+			}
+		}
+		if !dryRun && len(instanceGuids) == 0 {
+			// the modification time of the registry file tells a restarted broker if the registry is recent enough (see REGISTRY_MAX_AGE_SECS)
+			if err := registry.Save(); err != nil {
+				fmt.Printf("failed to save the registry: %s\n", err)
+				run.Errors = append(run.Errors, model.SyncError{Message: fmt.Sprintf("failed to save the registry: %s", err)})
+			}
+		}
+	}
+
+	//
+	// make sure the internal routes requested by the destination bindings exist, and remove the ones the broker created for bindings that are gone
+	syncInternalRoutes(&run, bindings, allInstancesWithBinds, complete && len(instanceGuids) == 0 && len(instances) > 0, dryRun)
+
+	endTime := time.Now()
+	if dryRun {
+		report.Finished = endTime
+		if reportJson, err := json.MarshalIndent(report, "", "  "); err != nil {
+			fmt.Printf("failed to marshal sync report: %s\n", err)
+		} else {
+			fmt.Printf("sync report (dry-run, nothing changed):\n%s\n", reportJson)
+		}
+		fmt.Printf("checked %d service instances, checked %d binds, found %d missing, %d extra and %d matching network policies in %d ms (dry-run)\n", run.Instances, run.Bindings, len(report.Missing), len(report.Extra), len(report.Matching), endTime.Sub(startTime).Milliseconds())
+	} else {
+		fmt.Printf("checked %d service instances, checked %d binds, fixed %d missing network policies, deleted %d stale network policies, created %d and deleted %d internal routes in %d ms\n", run.Instances, run.Bindings, run.PoliciesCreated, run.PoliciesDeleted, run.RoutesCreated, run.RoutesDeleted, endTime.Sub(startTime).Milliseconds())
+	}
+	return run
+}
+
+// syncInternalRoutes - Creates the missing internal routes of the (in scope) destination bindings with label npsb.dest.internal.route=true.
+// If deleteOrphans is true (a complete sync of all instances), the routes created by the broker for service bindings that no longer exist are deleted (only if SYNC_DELETE_STALE is true),
+// unless another binding still needs them (see ReleaseInternalRoute).
+func syncInternalRoutes(run *model.SyncRun, bindings []*resource.ServiceCredentialBinding, allInstancesWithBinds []model.InstancesWithBinds, deleteOrphans bool, dryRun bool) {
+	labelSelector := client.LabelSelector{}
+	labelSelector.Existence(conf.LabelNameBindingGuid)
+	routes, err := conf.CfClient.Routes.ListAll(conf.CfCtx, &client.RouteListOptions{ListOptions: &client.ListOptions{LabelSel: labelSelector, PerPage: 5000}})
+	if err != nil {
+		fmt.Printf("failed to list all routes with label %s: %s\n", conf.LabelNameBindingGuid, err)
+		run.Errors = append(run.Errors, model.SyncError{Message: fmt.Sprintf("failed to list all routes with label %s: %s", conf.LabelNameBindingGuid, err)})
+		return
+	}
+	routesByBinding := make(map[string][]*resource.Route)
+	for _, route := range routes {
+		if route.Metadata != nil && route.Metadata.Labels[conf.LabelNameBindingGuid] != nil {
+			bindingGuid := *route.Metadata.Labels[conf.LabelNameBindingGuid]
+			routesByBinding[bindingGuid] = append(routesByBinding[bindingGuid], route)
+		}
+	}
+	destinationInstances := make(map[string]bool)
+	for _, instanceWithBinds := range allInstancesWithBinds {
+		if instanceWithBinds.SrcOrDst == conf.LabelValueTypeDest {
+			destinationInstances[instanceWithBinds.InstanceGuid] = true
+		}
+	}
+	existingBindings := make(map[string]bool)
+	for _, binding := range bindings {
+		existingBindings[binding.GUID] = true
+		if !destinationInstances[binding.Relationships.ServiceInstance.Data.GUID] || binding.Metadata.Labels[conf.LabelNameInternalRoute] == nil || *binding.Metadata.Labels[conf.LabelNameInternalRoute] != "true" || len(routesByBinding[binding.GUID]) > 0 {
+			continue
+		}
+		hostname := ""
+		if binding.Metadata.Annotations[conf.AnnotationNameInternalHost] != nil {
+			hostname = *binding.Metadata.Annotations[conf.AnnotationNameInternalHost]
+		}
+		if dryRun {
+			fmt.Printf("internal route for service binding %s (app %s) is missing (dry-run)\n", binding.GUID, Guid2AppName(binding.Relationships.App.Data.GUID))
+			continue
+		}
+		if _, created, err := EnsureInternalRoute(binding.Relationships.App.Data.GUID, binding.GUID, hostname); err != nil {
+			fmt.Printf("failed to create internal route for service binding %s: %s\n", binding.GUID, err)
+			run.Errors = append(run.Errors, model.SyncError{Message: fmt.Sprintf("failed to create internal route for service binding %s: %s", binding.GUID, err), DestinationApp: Guid2AppName(binding.Relationships.App.Data.GUID)})
+		} else if created {
+			run.RoutesCreated++
+		}
+	}
+	if !deleteOrphans {
+		return
+	}
+	for bindingGuid, orphanRoutes := range routesByBinding {
+		if existingBindings[bindingGuid] {
+			continue
+		}
+		for _, route := range orphanRoutes {
+			if dryRun || !conf.SyncDeleteStale {
+				fmt.Printf("internal route %s was created for service binding %s that no longer exists\n", route.URL, bindingGuid)
+			} else if deleted, err := ReleaseInternalRoute(route, bindingGuid); err != nil {
+				fmt.Println(err)
+				run.Errors = append(run.Errors, model.SyncError{Message: err.Error()})
+			} else if deleted {
+				run.RoutesDeleted++
+			}
+		}
+	}
+}
+
+// chunkError - Creates a sync error for a chunk of network policies, for a single policy it includes the names of the apps involved
+func chunkError(message string, chunk []model.NetworkPolicy, err error) model.SyncError {
+	if len(chunk) == 1 {
+		policy := chunk[0]
+		return model.SyncError{Message: fmt.Sprintf("%s network policy: %s", message, err), SourceApp: Guid2AppName(policy.Source.Id), DestinationApp: Guid2AppName(policy.Destination.Id), Port: policy.Destination.Ports.Start, EndPort: endPort(policy.Destination.Ports), Protocol: policy.Destination.Protocol}
+	}
+	return model.SyncError{Message: fmt.Sprintf("%s %d network policies: %s", message, len(chunk), err)}
+}
+
+// indexInstancesWithBinds - Combines the service instances with their bindings. The bindings are indexed by service instance guid first, so this is linear in the number of instances and bindings.
+// For instances with implicit members (space scoped sources and instances with an app selector) the member apps (memberApps, by instance guid) are the bound apps,
+// a destination member app gets the ports of the instance.
+// The groups are the source references (org/space/name), for a source instance derived from its space, so a destination is only wired to the source in the org and space it refers to.
+// A source instance of which the space or org can not be found is left out, the errors are returned.
+func indexInstancesWithBinds(instances []*resource.ServiceInstance, bindings []*resource.ServiceCredentialBinding, memberApps map[string][]string) ([]model.InstancesWithBinds, []error) {
+	bindingsByInstance := make(map[string][]*resource.ServiceCredentialBinding)
+	for _, binding := range bindings {
+		instanceGuid := binding.Relationships.ServiceInstance.Data.GUID
+		bindingsByInstance[instanceGuid] = append(bindingsByInstance[instanceGuid], binding)
+	}
+	allInstancesWithBinds := make([]model.InstancesWithBinds, 0, len(instances))
+	errs := make([]error, 0)
+	for _, instance := range instances {
+		sources, err := instanceGroups(instance)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("source service instance %s: %s", instance.GUID, err))
+			continue
+		}
+		groups := make([]string, 0, len(sources))
+		for _, source := range sources {
+			groups = append(groups, source.String())
+		}
+		instanceWithBinds := model.InstancesWithBinds{
+			InstanceGuid: instance.GUID,
+			BoundApps:    make([]model.BoundApp, 0, len(bindingsByInstance[instance.GUID])),
+			SrcOrDst:     *instance.Metadata.Labels[conf.LabelNameType],
+			Groups:       groups,
+		}
+		if HasImplicitMembers(instance.Metadata) {
+			for _, appGuid := range memberApps[instance.GUID] {
+				if instanceWithBinds.SrcOrDst == conf.LabelValueTypeSrc {
+					instanceWithBinds.BoundApps = append(instanceWithBinds.BoundApps, model.BoundApp{Destination: model.Destination{Id: appGuid}})
+					continue
+				}
+				for _, destinationPort := range DestinationPortsFromMetadata(instance.Metadata) {
+					instanceWithBinds.BoundApps = append(instanceWithBinds.BoundApps, model.BoundApp{Destination: model.Destination{Id: appGuid, Protocol: destinationPort.Protocol, Ports: destinationPort.Ports}})
+				}
+			}
+			allInstancesWithBinds = append(allInstancesWithBinds, instanceWithBinds)
+			continue
+		}
+		for _, binding := range bindingsByInstance[instance.GUID] {
+			if instanceWithBinds.SrcOrDst == conf.LabelValueTypeSrc {
+				// if it is a type=source, we only need the app name
+				instanceWithBinds.BoundApps = append(instanceWithBinds.BoundApps, model.BoundApp{Destination: model.Destination{Id: binding.Relationships.App.Data.GUID}, BindingGuid: binding.GUID})
+			} else {
+				// a destination binding can have more than one port/protocol, each of them is a bound app (with the same binding guid)
+				for _, destinationPort := range DestinationPortsFromMetadata(binding.Metadata) {
+					instanceWithBinds.BoundApps = append(instanceWithBinds.BoundApps, model.BoundApp{Destination: model.Destination{Id: binding.Relationships.App.Data.GUID, Protocol: destinationPort.Protocol, Ports: destinationPort.Ports}, BindingGuid: binding.GUID})
+				}
+			}
+		}
+		allInstancesWithBinds = append(allInstancesWithBinds, instanceWithBinds)
+	}
+	return allInstancesWithBinds, errs
+}
+
+// scopedInstances - Returns the given service instances and their counterparts: for every group (source org/space/name) of an instance the source instance and the destination
+// instances that refer to it, until no more groups are added (a destination can refer to more than one source). Only these instances are listed, not all instances.
+// The groups that could not be resolved are left out, the errors are returned.
+func scopedInstances(instanceGuids []string) ([]*resource.ServiceInstance, []error) {
+	errs := make([]error, 0)
+	labelSelector := client.LabelSelector{}
+	labelSelector.Existence(conf.LabelNameType)
+	instanceListOption := client.ServiceInstanceListOptions{ListOptions: &client.ListOptions{LabelSel: labelSelector, PerPage: 5000}, GUIDs: client.Filter{Values: instanceGuids}}
+	instances, err := conf.CfClient.ServiceInstances.ListAll(conf.CfCtx, &instanceListOption)
+	if err != nil {
+		return nil, append(errs, fmt.Errorf("failed to list service instances %v: %s", instanceGuids, err))
+	}
+	found := make(map[string]bool)
+	for _, instance := range instances {
+		found[instance.GUID] = true
+	}
+	groups := make(map[string]bool)
+	for pending := instances; len(pending) > 0; {
+		sources := make([]model.SourceReference, 0)
+		for _, instance := range pending {
+			instanceSources, err := instanceGroups(instance)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("source service instance %s: %s", instance.GUID, err))
+				continue
+			}
+			for _, source := range instanceSources {
+				if !groups[source.String()] {
+					groups[source.String()] = true
+					sources = append(sources, source)
+				}
+			}
+		}
+		pending = make([]*resource.ServiceInstance, 0)
+		for _, source := range sources {
+			counterparts, err := ReferringDestinations(source)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if sourceInstance, err := FindSourceInstance(source); err != nil {
+				errs = append(errs, fmt.Errorf("failed to find source service instance %s: %s", source, err))
+			} else if sourceInstance != nil {
+				counterparts = append(counterparts, sourceInstance)
+			}
+			for _, instance := range counterparts {
+				if !found[instance.GUID] && instance.Metadata != nil && instance.Metadata.Labels[conf.LabelNameType] != nil {
+					found[instance.GUID] = true
+					pending = append(pending, instance)
+					instances = append(instances, instance)
+				}
+			}
+		}
+	}
+	return instances, errs
+}
+
+// listBindings - Returns the service bindings with label npsb.dest.port, if onlyInstances is true only those of the given instances (in chunks, to keep the urls short)
+func listBindings(instances []*resource.ServiceInstance, onlyInstances bool) ([]*resource.ServiceCredentialBinding, error) {
+	labelSelector := client.LabelSelector{}
+	labelSelector.Existence(conf.LabelNamePort)
+	if !onlyInstances {
+		bindListOption := client.ServiceCredentialBindingListOptions{ListOptions: &client.ListOptions{LabelSel: labelSelector, PerPage: 5000}}
+		bindings, err := conf.CfClient.ServiceCredentialBindings.ListAll(conf.CfCtx, &bindListOption)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list all service bindings with label %s: %s", conf.LabelNamePort, err)
+		}
+		return bindings, nil
+	}
+	bindings := make([]*resource.ServiceCredentialBinding, 0)
+	for start := 0; start < len(instances); start += listGuidsChunkSize {
+		instanceGuids := make([]string, 0, listGuidsChunkSize)
+		for _, instance := range instances[start:min(start+listGuidsChunkSize, len(instances))] {
+			instanceGuids = append(instanceGuids, instance.GUID)
+		}
+		bindListOption := client.ServiceCredentialBindingListOptions{ListOptions: &client.ListOptions{LabelSel: labelSelector, PerPage: 5000}, ServiceInstanceGUIDs: client.Filter{Values: instanceGuids}}
+		chunk, err := conf.CfClient.ServiceCredentialBindings.ListAll(conf.CfCtx, &bindListOption)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list service bindings with label %s of %d service instances: %s", conf.LabelNamePort, len(instanceGuids), err)
+		}
+		bindings = append(bindings, chunk...)
+	}
+	return bindings, nil
+}
+
+// instanceGroups - Returns the groups (source org/space/name) of an instance: for a source instance derived from its space, for a destination instance the sources it refers to
+func instanceGroups(instance *resource.ServiceInstance) ([]model.SourceReference, error) {
+	groups := make([]model.SourceReference, 0)
+	if instance.Metadata.Labels[conf.LabelNameName] != nil && *instance.Metadata.Labels[conf.LabelNameName] != "" {
+		source, err := SourceReferenceOf(*instance.Metadata.Labels[conf.LabelNameName], instance.Relationships.Space.Data.GUID)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, source)
+	}
+	// a destination instance can refer to more than one source
+	seenGroups := make(map[string]bool)
+	for _, source := range InstanceSources(instance.Metadata) {
+		if !seenGroups[source.String()] {
+			seenGroups[source.String()] = true
+			groups = append(groups, source)
+		}
+	}
+	return groups, nil
+}
+
+// policyOwner - The destination instance and binding that justify a required network policy, these are registered as the owners of the policy
+type policyOwner struct {
+	instanceGuid string
+	bindingGuid  string
+}
+
+// requiredPolicies - Returns the network policies that should exist according to the labels, with their owners keyed by policy key.
+// The destination instances are grouped by source (org/space/name) first, so apart from the source apps x destination apps within a group this is linear in the number of instances.
+// It does not talk to CC or the policy server, so it can be benchmarked with synthetic data.
+func requiredPolicies(allInstancesWithBinds []model.InstancesWithBinds) ([]model.NetworkPolicy, map[string]policyOwner) {
+	destinationsByGroup := make(map[string][]model.InstancesWithBinds)
+	for _, instanceWithBinds := range allInstancesWithBinds {
+		if instanceWithBinds.SrcOrDst == conf.LabelValueTypeDest {
+			for _, group := range instanceWithBinds.Groups {
+				destinationsByGroup[group] = append(destinationsByGroup[group], instanceWithBinds)
+			}
+		}
+	}
+	required := make([]model.NetworkPolicy, 0)
+	owners := make(map[string]policyOwner)
+	for _, sourceInstance := range allInstancesWithBinds {
+		if sourceInstance.SrcOrDst == conf.LabelValueTypeSrc {
+			for _, group := range sourceInstance.Groups {
+				for _, destinationInstance := range destinationsByGroup[group] {
+					for _, sourceApp := range sourceInstance.BoundApps {
+						for _, destinationApp := range destinationInstance.BoundApps {
+							networkPolicy := model.NetworkPolicy{Source: model.Source{Id: sourceApp.Id}, Destination: model.Destination{Id: destinationApp.Id, Ports: destinationApp.Ports, Protocol: destinationApp.Protocol}}
+							// the same policy can be justified by more than one binding, the first one becomes the owner
+							if _, found := owners[networkPolicy.Key()]; !found {
+								required = append(required, networkPolicy)
+								owners[networkPolicy.Key()] = policyOwner{instanceGuid: destinationInstance.InstanceGuid, bindingGuid: destinationApp.BindingGuid}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return required, owners
+}
+
+// inGroups - Returns true if the instance is in one of the given groups
+func inGroups(instanceWithBinds model.InstancesWithBinds, groups map[string]bool) bool {
+	for _, group := range instanceWithBinds.Groups {
+		if groups[group] {
+			return true
+		}
+	}
+	return false
+}
+
+// involvedApps - Returns the (sorted) guids of the apps that are bound to the given instances or that are part of a registered policy in scope, these are the apps we need the existing policies for
+func involvedApps(allInstancesWithBinds []model.InstancesWithBinds, inScope func(registry.Entry) bool) []string {
+	apps := make(map[string]bool)
+	for _, instanceWithBinds := range allInstancesWithBinds {
+		for _, boundApp := range instanceWithBinds.BoundApps {
+			apps[boundApp.Id] = true
+		}
+	}
+	for _, entry := range registry.Entries(inScope) {
+		apps[entry.Policy.Source.Id] = true
+		apps[entry.Policy.Destination.Id] = true
+	}
+	appGuids := make([]string, 0, len(apps))
+	for appGuid := range apps {
+		appGuids = append(appGuids, appGuid)
+	}
+	sort.Strings(appGuids)
+	return appGuids
+}
+
+// diffPolicies - Splits the required network policies in the ones that are missing and the ones that already exist, using a set of the existing policy keys
+func diffPolicies(requiredPolicies []model.NetworkPolicy, existingPolicies []model.NetworkPolicy) (missing []model.NetworkPolicy, matching []model.NetworkPolicy) {
+	existing := make(map[string]bool, len(existingPolicies))
+	for _, policy := range existingPolicies {
+		existing[policy.Key()] = true
+	}
+	for _, policy := range requiredPolicies {
+		if existing[policy.Key()] {
+			matching = append(matching, policy)
+		} else {
+			missing = append(missing, policy)
+		}
+	}
+	return missing, matching
+}
+
+// reportedPolicy - Converts a network policy to its reported form, optionally resolving the app names
+func reportedPolicy(policy model.NetworkPolicy, withNames bool) model.NetworkPolicyLabels {
+	reported := model.NetworkPolicyLabels{Source: policy.Source.Id, Destination: policy.Destination.Id, Protocol: policy.Destination.Protocol, Port: policy.Destination.Ports.Start, EndPort: endPort(policy.Destination.Ports)}
+	if withNames {
+		reported.SourceName = Guid2AppName(policy.Source.Id)
+		reported.DestinationName = Guid2AppName(policy.Destination.Id)
+	}
+	return reported
+}
+
+// endPort - Returns the end of the port range, or 0 for a single port
+func endPort(ports model.Ports) int {
+	if ports.End > ports.Start {
+		return ports.End
+	}
+	return 0
+}
+
+// stalePolicies - Returns the network policies that were created by the broker (according to the registry, limited to the entries that are in scope) and still exist, but are not in the given required policies.
+// The entries that were registered after the sync started are skipped, they can belong to a bind that happened after the labels were read.
+func stalePolicies(requiredPolicies []model.NetworkPolicy, existingPolicies []model.NetworkPolicy, inScope func(registry.Entry) bool, startTime time.Time) (stale []model.NetworkPolicy) {
+	required := make(map[string]bool)
+	for _, policy := range requiredPolicies {
+		required[policy.Key()] = true
+	}
+	existing := make(map[string]bool)
+	for _, policy := range existingPolicies {
+		existing[policy.Key()] = true
+	}
+	for _, entry := range registry.Entries(inScope) {
+		if key := entry.Policy.Key(); existing[key] && !required[key] && !entry.Created.After(startTime) {
+			stale = append(stale, entry.Policy)
+		}
+	}
+	return stale
+}
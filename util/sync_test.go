@@ -0,0 +1,99 @@
+package util
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rabobank/npsb/conf"
+	"github.com/rabobank/npsb/model"
+	"github.com/rabobank/npsb/registry"
+)
+
+const (
+	benchInstances     = 10000
+	benchGroups        = 1000
+	benchAppsPerSource = 3
+	benchAppsPerDest   = 2
+)
+
+// syntheticInstancesWithBinds - Generates the given number of instances, half of them sources and half destinations, spread over groups (so every group has the same
+// number of sources and destinations). Every destination app gets a port range and a single port.
+func syntheticInstancesWithBinds(instances int, groups int) []model.InstancesWithBinds {
+	allInstancesWithBinds := make([]model.InstancesWithBinds, 0, instances)
+	for ix := 0; ix < instances; ix++ {
+		// a source and the next destination are in the same group
+		group := fmt.Sprintf("org-%d/space-%d/source-%d", ix/2%groups, ix/2%groups, ix/2%groups)
+		instanceWithBinds := model.InstancesWithBinds{InstanceGuid: fmt.Sprintf("instance-%d", ix), Groups: []string{group}}
+		if ix%2 == 0 {
+			instanceWithBinds.SrcOrDst = conf.LabelValueTypeSrc
+			for app := 0; app < benchAppsPerSource; app++ {
+				instanceWithBinds.BoundApps = append(instanceWithBinds.BoundApps, model.BoundApp{Destination: model.Destination{Id: fmt.Sprintf("src-app-%d-%d", ix, app)}, BindingGuid: fmt.Sprintf("binding-%d-%d", ix, app)})
+			}
+		} else {
+			instanceWithBinds.SrcOrDst = conf.LabelValueTypeDest
+			for app := 0; app < benchAppsPerDest; app++ {
+				appGuid, bindingGuid := fmt.Sprintf("dst-app-%d-%d", ix, app), fmt.Sprintf("binding-%d-%d", ix, app)
+				instanceWithBinds.BoundApps = append(instanceWithBinds.BoundApps,
+					model.BoundApp{Destination: model.Destination{Id: appGuid, Protocol: conf.LabelValueProtocolTCP, Ports: model.Ports{Start: 8080, End: 8080}}, BindingGuid: bindingGuid},
+					model.BoundApp{Destination: model.Destination{Id: appGuid, Protocol: conf.LabelValueProtocolTCP, Ports: model.Ports{Start: 9000, End: 9010}}, BindingGuid: bindingGuid})
+			}
+		}
+		allInstancesWithBinds = append(allInstancesWithBinds, instanceWithBinds)
+	}
+	return allInstancesWithBinds
+}
+
+func BenchmarkRequiredPolicies(b *testing.B) {
+	allInstancesWithBinds := syntheticInstancesWithBinds(benchInstances, benchGroups)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for ix := 0; ix < b.N; ix++ {
+		required, _ := requiredPolicies(allInstancesWithBinds)
+		// every group has 5 sources with 3 apps and 5 destinations with 2 apps on 2 ports
+		if expected := benchGroups * 5 * benchAppsPerSource * 5 * benchAppsPerDest * 2; len(required) != expected {
+			b.Fatalf("expected %d required policies, got %d", expected, len(required))
+		}
+	}
+}
+
+func BenchmarkDiffPolicies(b *testing.B) {
+	required, _ := requiredPolicies(syntheticInstancesWithBinds(benchInstances, benchGroups))
+	// half of the required policies exist already, plus the same number of policies that are not required
+	existing := make([]model.NetworkPolicy, 0, len(required))
+	for ix, policy := range required {
+		if ix%2 == 0 {
+			existing = append(existing, policy)
+		} else {
+			existing = append(existing, model.NetworkPolicy{Source: model.Source{Id: "other-" + policy.Source.Id}, Destination: policy.Destination})
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for ix := 0; ix < b.N; ix++ {
+		missing, matching := diffPolicies(required, existing)
+		if len(missing)+len(matching) != len(required) || len(matching) != (len(required)+1)/2 {
+			b.Fatalf("expected %d matching of %d required policies, got %d matching and %d missing", (len(required)+1)/2, len(required), len(matching), len(missing))
+		}
+	}
+}
+
+func TestStalePoliciesSkipsEntriesRegisteredAfterStart(t *testing.T) {
+	conf.RegistryFile = filepath.Join(t.TempDir(), "registry.json")
+	policies := make([]model.NetworkPolicy, 0)
+	for ix := 0; ix < 3; ix++ {
+		policies = append(policies, model.NetworkPolicy{Source: model.Source{Id: fmt.Sprintf("src-app-%d", ix)}, Destination: model.Destination{Id: "dst-app", Protocol: conf.LabelValueProtocolTCP, Ports: model.Ports{Start: 8080, End: 8080}}})
+	}
+	startTime := time.Now()
+	// policy 0 is required, policy 1 is no longer required, policy 2 was created by a bind after the sync read the labels
+	registry.Add([]registry.Entry{
+		{Policy: policies[0], InstanceGuid: "instance-1", Created: startTime.Add(-time.Hour)},
+		{Policy: policies[1], InstanceGuid: "instance-1", Created: startTime.Add(-time.Hour)},
+		{Policy: policies[2], InstanceGuid: "instance-1", Created: startTime.Add(time.Second)},
+	})
+	stale := stalePolicies(policies[:1], policies, nil, startTime)
+	if len(stale) != 1 || stale[0].Key() != policies[1].Key() {
+		t.Errorf("expected only policy %s to be stale, got %v", policies[1].Key(), stale)
+	}
+}
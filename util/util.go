@@ -3,7 +3,6 @@ package util
 import (
 	"bytes"
 	"crypto/subtle"
-	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,6 +15,7 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cloudfoundry/go-cfclient/v3/client"
@@ -25,9 +25,11 @@ import (
 )
 
 var guid2appNameCache = make(map[string]CacheEntry)
-var cacheCleanerStarted = false
+var guid2appNameMutex sync.Mutex
+var cacheCleanerOnce sync.Once
 var spaceCache = make(map[string]*resource.Space)
 var orgCache = make(map[string]*resource.Organization)
+var spaceOrgCacheMutex sync.Mutex
 
 type CacheEntry struct {
 	created time.Time
@@ -125,22 +127,28 @@ func ProvisionObjectFromRequest(r *http.Request, object interface{}) error {
 	return nil
 }
 
+// Guid2AppName - Returns the name of the app with the given guid, the names are cached for a minute. The cache is used by the request handlers, the sync and the audit event watcher,
+// so it is guarded by guid2appNameMutex (the CC is not called while holding it).
 func Guid2AppName(guid string) string {
-	if !cacheCleanerStarted {
-		cacheCleanerStarted = true
+	cacheCleanerOnce.Do(func() {
 		go func() {
 			for {
 				time.Sleep(5 * time.Second)
+				guid2appNameMutex.Lock()
 				for key, value := range guid2appNameCache {
 					if time.Since(value.created) > 1*time.Minute {
 						delete(guid2appNameCache, key)
 						PrintfIfDebug("cleaned cache entry for key %s\n", key)
 					}
 				}
+				guid2appNameMutex.Unlock()
 			}
 		}()
-	}
-	if cacheEntry, found := guid2appNameCache[guid]; found {
+	})
+	guid2appNameMutex.Lock()
+	cacheEntry, found := guid2appNameCache[guid]
+	guid2appNameMutex.Unlock()
+	if found {
 		PrintfIfDebug("cache hit for guid %s\n", guid)
 		return cacheEntry.name
 	}
@@ -148,34 +156,124 @@ func Guid2AppName(guid string) string {
 		fmt.Printf("failed to get app by name %s, error: %s\n", guid, err)
 		return ""
 	} else {
+		guid2appNameMutex.Lock()
 		guid2appNameCache[guid] = CacheEntry{created: time.Now(), name: app.Name}
+		guid2appNameMutex.Unlock()
 		return app.Name
 	}
 }
 
+// InvalidateAppName - Removes the cached name of the app with the given guid, i.e. after the app was renamed
+func InvalidateAppName(guid string) {
+	guid2appNameMutex.Lock()
+	defer guid2appNameMutex.Unlock()
+	delete(guid2appNameCache, guid)
+}
+
+// PortsFromLabels - Returns the destination port range from the labels of a service binding, the default is port 8080.
+// The start (or single) port is in the npsb.dest.port label, the end of a range in the npsb.dest.port.end label.
+func PortsFromLabels(labels map[string]*string) model.Ports {
+	ports := model.Ports{Start: 8080, End: 8080}
+	if labels[conf.LabelNamePort] != nil && *labels[conf.LabelNamePort] != "" && *labels[conf.LabelNamePort] != "0" {
+		ports.Start, _ = strconv.Atoi(*labels[conf.LabelNamePort])
+		ports.End = ports.Start
+	}
+	if labels[conf.LabelNamePortEnd] != nil && *labels[conf.LabelNamePortEnd] != "" {
+		if end, err := strconv.Atoi(*labels[conf.LabelNamePortEnd]); err == nil && end > ports.Start {
+			ports.End = end
+		}
+	}
+	return ports
+}
+
+// DestinationPortsFromMetadata - Returns the destination ports of a service binding. A binding with more than one port (or protocol) has them all in the npsb.dest.ports annotation,
+// otherwise the port and protocol come from the labels.
+func DestinationPortsFromMetadata(metadata *resource.Metadata) []model.DestinationPort {
+	if metadata == nil {
+		return []model.DestinationPort{{Ports: model.Ports{Start: 8080, End: 8080}, Protocol: conf.LabelValueProtocolTCP}}
+	}
+	if metadata.Annotations[conf.AnnotationNamePorts] != nil && *metadata.Annotations[conf.AnnotationNamePorts] != "" {
+		if destinationPorts, err := ParseDestinationPorts(*metadata.Annotations[conf.AnnotationNamePorts]); err != nil {
+			fmt.Printf("ignoring invalid annotation %s=%s: %s\n", conf.AnnotationNamePorts, *metadata.Annotations[conf.AnnotationNamePorts], err)
+		} else {
+			return destinationPorts
+		}
+	}
+	protocol := conf.LabelValueProtocolTCP
+	if metadata.Labels[conf.LabelNameProtocol] != nil && *metadata.Labels[conf.LabelNameProtocol] != "" {
+		protocol = *metadata.Labels[conf.LabelNameProtocol]
+	}
+	return []model.DestinationPort{{Ports: PortsFromLabels(metadata.Labels), Protocol: protocol}}
+}
+
+// ParseDestinationPorts - Parses the value of the npsb.dest.ports annotation, a comma separated list like 8080/tcp,9090/tcp,7000-7010/udp
+func ParseDestinationPorts(value string) ([]model.DestinationPort, error) {
+	destinationPorts := make([]model.DestinationPort, 0)
+	for _, entry := range strings.Split(value, ",") {
+		portsStr, protocol, found := strings.Cut(strings.TrimSpace(entry), "/")
+		if !found || (protocol != conf.LabelValueProtocolTCP && protocol != conf.LabelValueProtocolUDP) {
+			return nil, fmt.Errorf("entry %s should be <port>/<protocol> with protocol %s or %s", entry, conf.LabelValueProtocolTCP, conf.LabelValueProtocolUDP)
+		}
+		startStr, endStr, isRange := strings.Cut(portsStr, "-")
+		start, err := strconv.Atoi(startStr)
+		if err != nil {
+			return nil, fmt.Errorf("entry %s has an invalid port: %s", entry, err)
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(endStr); err != nil || end < start {
+				return nil, fmt.Errorf("entry %s has an invalid port range", entry)
+			}
+		}
+		destinationPorts = append(destinationPorts, model.DestinationPort{Ports: model.Ports{Start: start, End: end}, Protocol: protocol})
+	}
+	return destinationPorts, nil
+}
+
+// FormatDestinationPorts - Returns the value for the npsb.dest.ports annotation
+func FormatDestinationPorts(destinationPorts []model.DestinationPort) string {
+	entries := make([]string, 0, len(destinationPorts))
+	for _, destinationPort := range destinationPorts {
+		entries = append(entries, destinationPort.String())
+	}
+	return strings.Join(entries, ",")
+}
+
 func GetSpaceByGuidCached(guid string) (space *resource.Space) {
 	var err error
 	var found bool
-	if space, found = spaceCache[guid]; found {
+	spaceOrgCacheMutex.Lock()
+	space, found = spaceCache[guid]
+	spaceOrgCacheMutex.Unlock()
+	if found {
 		return space
 	}
 	if space, err = conf.CfClient.Spaces.Get(conf.CfCtx, guid); err != nil {
 		fmt.Printf("failed to get space by guid %s, error: %s\n", guid, err)
+		return nil
 	}
+	spaceOrgCacheMutex.Lock()
 	spaceCache[guid] = space
+	spaceOrgCacheMutex.Unlock()
 	return space
 }
 
 func GetOrgByGuidCached(guid string) (org *resource.Organization) {
 	var err error
 	var found bool
-	if org, found = orgCache[guid]; found {
+	spaceOrgCacheMutex.Lock()
+	org, found = orgCache[guid]
+	spaceOrgCacheMutex.Unlock()
+	if found {
 		return org
 	}
 	if org, err = conf.CfClient.Organizations.Get(conf.CfCtx, guid); err != nil {
 		fmt.Printf("failed to get org by guid %s, error: %s\n", guid, err)
+		return nil
 	}
+	spaceOrgCacheMutex.Lock()
 	orgCache[guid] = org
+	spaceOrgCacheMutex.Unlock()
 	return org
 }
 
@@ -200,77 +298,6 @@ func IsUserAuthorisedForSpace(token jwt.Token, spaceGuid string) bool {
 	}
 }
 
-// Send2PolicyServer - Send the give network policies to the cf policy server (actual update/add of the network policy). If a policy already exists, it will be ignored.
-func Send2PolicyServer(action string, policies model.NetworkPolicies) error {
-	tokenSource, _ := conf.CfConfig.CreateOAuth2TokenSource(conf.CfCtx)
-	token, _ := tokenSource.Token()
-	var httpClient http.Client
-	if conf.SkipSslValidation {
-		// Create new Transport that ignores untrusted CA's
-		clientAllowUntrusted := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
-		httpClient = http.Client{Transport: clientAllowUntrusted, Timeout: 30 * time.Second}
-	} else {
-		httpClient = http.Client{Timeout: 30 * time.Second}
-	}
-	policyServerEndpoint := conf.CfApiURL + "/networking/v0/external/policies"
-	if action == conf.ActionUnbind {
-		policyServerEndpoint = conf.CfApiURL + "/networking/v0/external/policies/delete"
-	}
-	chunks := chunkSlice(policies.Policies, 500)
-	for ix, chunk := range chunks {
-		var policiesJsonBA []byte
-		policiesJsonBA, err := json.Marshal(model.NetworkPolicies{Policies: chunk})
-		if err != nil {
-			return fmt.Errorf("failed to marshal policies to json: %s", err)
-		} else {
-			if conf.Debug {
-				fmt.Printf("chunk %d - sending %d policy %s action(s) to policy server:\n%v\n", ix, len(chunk), action, chunk)
-			} else {
-				fmt.Printf("chunk %d - sending %d policy %s action(s) to policy server\n", ix, len(chunk), action)
-			}
-			request, err := http.NewRequest("POST", policyServerEndpoint, bytes.NewBuffer(policiesJsonBA))
-			if err != nil {
-				return fmt.Errorf("The HTTP NewRequest failed with error %s\n", err)
-			} else {
-				request.Header.Set("Authorization", token.AccessToken)
-				request.Header.Set("Content-type", "application/json")
-				startTime := time.Now().UnixNano() / int64(time.Millisecond)
-				response, err := httpClient.Do(request)
-				endTime := time.Now().UnixNano() / int64(time.Millisecond)
-				if err != nil || response.StatusCode != http.StatusOK {
-					if response != nil {
-						if response.StatusCode != http.StatusOK {
-							bodyBytes, _ := io.ReadAll(response.Body)
-							return fmt.Errorf("The HTTP request failed with response code %d: %s\n", response.StatusCode, bodyBytes)
-						}
-					} else {
-						return fmt.Errorf("The HTTP request failed with error: %s\n", err)
-					}
-				} else {
-					bodyBytes, _ := io.ReadAll(response.Body)
-					bodyString := string(bodyBytes)
-					_ = response.Body.Close()
-					fmt.Printf("response in %d ms from %v: Status code: %v: %v\n", endTime-startTime, policyServerEndpoint, response.Status, bodyString)
-				}
-			}
-		}
-	}
-	return nil
-}
-
-// chunkSlice - "chop" the give slice in smaller pieces and return them
-func chunkSlice(slice []model.NetworkPolicy, chunkSize int) [][]model.NetworkPolicy {
-	var chunks [][]model.NetworkPolicy
-	for i := 0; i < len(slice); i += chunkSize {
-		end := i + chunkSize
-		if end > len(slice) {
-			end = len(slice)
-		}
-		chunks = append(chunks, slice[i:end])
-	}
-	return chunks
-}
-
 // GetAccessTokenFromRequest - get the JWT from the request
 func GetAccessTokenFromRequest(r *http.Request) (string, error) {
 	var accessToken string
@@ -317,162 +344,3 @@ func Contains(elems []interface{}, v string) bool {
 	}
 	return false
 }
-
-// SyncLabels2Policies - Find all ServiceInstances and their bound apps, figure out what network policies they represent, check if they exist, and if not, report and create them.
-func SyncLabels2Policies() {
-	PrintfIfDebug("syncing labels to network policies...\n")
-	startTime := time.Now()
-	var allInstancesWithBinds []model.InstancesWithBinds
-	var totalServiceInstances int
-	var totalBinds int
-
-	//
-	// find all Instances with their binds, both source and destination
-	labelSelector := client.LabelSelector{}
-	labelSelector.Existence(conf.LabelNameType)
-	instanceListOption := client.ServiceInstanceListOptions{ListOptions: &client.ListOptions{LabelSel: labelSelector, PerPage: 5000}}
-	if instances, err := conf.CfClient.ServiceInstances.ListAll(conf.CfCtx, &instanceListOption); err != nil {
-		fmt.Printf("failed to list all service instances with label %s: %s\n", conf.LabelNameType, err)
-	} else {
-		if len(instances) < 1 {
-			PrintfIfDebug("could not find any service instances with label %s\n", conf.LabelNameType)
-		} else {
-			totalServiceInstances = len(instances)
-
-			//
-			// get all "npsb" service bindings (by filtering on the presence of the label npsb.dest.port)
-			labelSelector = client.LabelSelector{}
-			labelSelector.Existence(conf.LabelNamePort)
-			bindListOption := client.ServiceCredentialBindingListOptions{ListOptions: &client.ListOptions{LabelSel: labelSelector, PerPage: 5000}}
-			if bindings, err := conf.CfClient.ServiceCredentialBindings.ListAll(conf.CfCtx, &bindListOption); err != nil {
-				fmt.Printf("failed to list all service bindings with label %s: %s\n", conf.LabelNamePort, err)
-			} else {
-				if len(bindings) < 1 {
-					PrintfIfDebug("could not find any service bindings with label %s\n", conf.LabelNameType)
-				} else {
-					totalBinds = len(bindings)
-					for _, instance := range instances {
-						var nameOrSource string
-						if instance.Metadata.Labels[conf.LabelNameName] != nil && *instance.Metadata.Labels[conf.LabelNameName] != "" {
-							nameOrSource = *instance.Metadata.Labels[conf.LabelNameName]
-						}
-						if instance.Metadata.Labels[conf.LabelNameSourceName] != nil && *instance.Metadata.Labels[conf.LabelNameSourceName] != "" {
-							nameOrSource = *instance.Metadata.Labels[conf.LabelNameSourceName]
-						}
-						instanceWithBinds := model.InstancesWithBinds{
-							BoundApps:    make([]model.Destination, 0),
-							SrcOrDst:     *instance.Metadata.Labels[conf.LabelNameType],
-							NameOrSource: nameOrSource,
-						}
-						for _, binding := range bindings {
-							if binding.Relationships.ServiceInstance.Data.GUID == instance.GUID {
-								if instanceWithBinds.SrcOrDst == conf.LabelValueTypeSrc {
-									// if it is a type=source, we only need the app name
-									instanceWithBinds.BoundApps = append(instanceWithBinds.BoundApps, model.Destination{Id: binding.Relationships.App.Data.GUID})
-								} else {
-									port := 8080
-									if binding.Metadata.Labels[conf.LabelNamePort] != nil && *binding.Metadata.Labels[conf.LabelNamePort] != "" && *binding.Metadata.Labels[conf.LabelNamePort] != "0" {
-										port, _ = strconv.Atoi(*binding.Metadata.Labels[conf.LabelNamePort])
-									}
-									protocol := conf.LabelValueProtocolTCP
-									if binding.Metadata.Labels[conf.LabelNameProtocol] != nil && *binding.Metadata.Labels[conf.LabelNameProtocol] != "" {
-										protocol = *binding.Metadata.Labels[conf.LabelNameProtocol]
-									}
-									instanceWithBinds.BoundApps = append(instanceWithBinds.BoundApps, model.Destination{Id: binding.Relationships.App.Data.GUID, Protocol: protocol, Port: port})
-								}
-							}
-						}
-						allInstancesWithBinds = append(allInstancesWithBinds, instanceWithBinds)
-					}
-				}
-			}
-		}
-		PrintfIfDebug("found %d instances with label %s, %d instances have binds:\n", len(instances), conf.LabelNameType, len(allInstancesWithBinds))
-
-		//
-		// for each type=source instances, find the destination instances that point to this source instance, and generate the required network policies objects
-		var requiredNetworkPolicies []model.NetworkPolicy
-		for _, sourceInstance := range allInstancesWithBinds {
-			if sourceInstance.SrcOrDst == conf.LabelValueTypeSrc {
-				for _, destinationInstance := range allInstancesWithBinds {
-					if destinationInstance.SrcOrDst == conf.LabelValueTypeDest && destinationInstance.NameOrSource == sourceInstance.NameOrSource {
-						for _, sourceApp := range sourceInstance.BoundApps {
-							for _, destinationApp := range destinationInstance.BoundApps {
-								networkPolicy := model.NetworkPolicy{Source: model.Source{Id: sourceApp.Id}, Destination: model.Destination{Id: destinationApp.Id, Port: destinationApp.Port, Protocol: destinationApp.Protocol}}
-								// add the network policy to the list of network policies
-								requiredNetworkPolicies = append(requiredNetworkPolicies, networkPolicy)
-								// check if the network policy already exists, if not, create it
-							}
-						}
-					}
-				}
-			}
-		}
-		npString := ""
-		//for _, np := range requiredNetworkPolicies {
-		//	npString += fmt.Sprintf("%s=>%s:%d(%s)\n", Guid2AppName(np.Source.Id), Guid2AppName(np.Destination.Id), np.Destination.Port, np.Destination.Protocol)
-		//}
-		PrintfIfDebug("found %d network policies that should exist according to labels:\n%v\n", len(requiredNetworkPolicies), npString)
-
-		//
-		// get all existing network policies, then for each network policy object check if a real network policy exists, if not, create it
-		existingNetworkPolicies := getAllNetworkPolicies()
-		policiesFixed := 0
-		for _, requiredNetworkPolicy := range requiredNetworkPolicies {
-			found := false
-			for _, existingNetworkPolicy := range existingNetworkPolicies {
-				if existingNetworkPolicy.Source.Id == requiredNetworkPolicy.Source.Id && existingNetworkPolicy.Destination.Id == requiredNetworkPolicy.Destination.Id && existingNetworkPolicy.Destination.Port == requiredNetworkPolicy.Destination.Port && existingNetworkPolicy.Destination.Protocol == requiredNetworkPolicy.Destination.Protocol {
-					found = true
-					break
-				}
-			}
-			if !found {
-				fmt.Printf("network policy %s=>%s:%d(%s) does not exist, creating it\n", Guid2AppName(requiredNetworkPolicy.Source.Id), Guid2AppName(requiredNetworkPolicy.Destination.Id), requiredNetworkPolicy.Destination.Port, requiredNetworkPolicy.Destination.Protocol)
-				err := Send2PolicyServer(conf.ActionBind, model.NetworkPolicies{Policies: []model.NetworkPolicy{requiredNetworkPolicy}})
-				if err != nil {
-					fmt.Printf("failed to create network policy %s=>%s:%d(%s): %s\n", Guid2AppName(requiredNetworkPolicy.Source.Id), Guid2AppName(requiredNetworkPolicy.Destination.Id), requiredNetworkPolicy.Destination.Port, requiredNetworkPolicy.Destination.Protocol, err)
-				} else {
-					policiesFixed++
-				}
-			}
-		}
-		endTime := time.Now()
-		fmt.Printf("checked %d service instances, checked %d binds, fixed %d missing network policies in %d ms\n", totalServiceInstances, totalBinds, policiesFixed, endTime.Sub(startTime).Milliseconds())
-	}
-}
-
-// getAllNetworkPolicies - query the policy server and return all network-policies
-func getAllNetworkPolicies() []model.NetworkPolicy {
-	polServerResponse := &model.PolicyServerGetResponse{}
-	policyServerEndpoint := conf.CfApiURL + "/networking/v0/external/policies"
-	tokenSource, _ := conf.CfClient.CreateOAuth2TokenSource(conf.CfCtx)
-	token, _ := tokenSource.Token()
-	requestHeader := map[string][]string{"Content-Type": {"application/json"}, "Authorization": {token.AccessToken}}
-	requestUrl, _ := url.Parse(policyServerEndpoint)
-	httpRequest := http.Request{Method: http.MethodGet, URL: requestUrl, Header: requestHeader}
-	var httpClient http.Client
-	if conf.SkipSslValidation {
-		// Create new Transport that ignores untrusted CA's
-		clientAllowUntrusted := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
-		httpClient = http.Client{Transport: clientAllowUntrusted, Timeout: 30 * time.Second}
-	} else {
-		httpClient = http.Client{Timeout: 30 * time.Second}
-	}
-	response, err := httpClient.Do(&httpRequest)
-	if err != nil || (response != nil && response.StatusCode != http.StatusOK) {
-		if err != nil {
-			fmt.Printf("request to policy server failed: %s \n", err)
-		}
-		if response != nil && response.StatusCode != http.StatusOK {
-			fmt.Printf("request to policy server failed with response code %d\n", response.StatusCode)
-		}
-	} else {
-		defer func() { _ = response.Body.Close() }()
-		bodyBytes, _ := io.ReadAll(response.Body)
-		if err = json.Unmarshal(bodyBytes, polServerResponse); err != nil {
-			fmt.Printf("Failed to parse GET response from Policy Server: %s\n", err)
-		}
-	}
-	PrintfIfDebug("found %d existing network policies\n", len(polServerResponse.Policies))
-	return polServerResponse.Policies
-}
@@ -0,0 +1,234 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/cloudfoundry/go-cfclient/v3/client"
+	"github.com/cloudfoundry/go-cfclient/v3/resource"
+	"github.com/rabobank/npsb/conf"
+	"github.com/rabobank/npsb/model"
+	"github.com/rabobank/npsb/registry"
+)
+
+const SyncTriggerEvents = "events"
+
+var watchedEventTypes = []string{
+	conf.EventTypeBindingCreate,
+	conf.EventTypeBindingDelete,
+	conf.EventTypeInstanceCreate,
+	conf.EventTypeInstanceUpdate,
+	conf.EventTypeInstanceDelete,
+	conf.EventTypeAppCreate,
+	conf.EventTypeAppDelete,
+	conf.EventTypeAppUpdate,
+}
+
+// watcherCheckpoint - The time of the last handled audit event, with the guids of the events we handled at that second, as saved in the checkpoint file
+type watcherCheckpoint struct {
+	Checkpoint time.Time `json:"checkpoint"`
+	Handled    []string  `json:"handled"`
+}
+
+// WatchAuditEvents - Polls the CC audit events every conf.EventPollIntervalSecs, and syncs only the groups of the service instances that are affected by the events since the last poll.
+// The checkpoint is saved next to the registry file after every sync of affected instances, so after a restart the events we missed are handled as well.
+func WatchAuditEvents() {
+	checkpoint, handledAtCheckpoint := loadCheckpoint()
+	for {
+		time.Sleep(time.Duration(conf.EventPollIntervalSecs) * time.Second)
+		events, err := listAuditEvents(checkpoint)
+		if err != nil {
+			fmt.Printf("failed to list audit events since %s: %s\n", checkpoint.Format(time.RFC3339), err)
+			continue
+		}
+		newEvents := make([]*resource.AuditEvent, 0)
+		for _, event := range events {
+			if !handledAtCheckpoint[event.GUID] {
+				newEvents = append(newEvents, event)
+			}
+		}
+		if len(newEvents) == 0 {
+			continue
+		}
+		for _, event := range newEvents {
+			if event.CreatedAt.After(checkpoint) {
+				checkpoint = event.CreatedAt.Truncate(time.Second)
+				handledAtCheckpoint = make(map[string]bool)
+			}
+		}
+		for _, event := range events {
+			if !event.CreatedAt.Before(checkpoint) {
+				handledAtCheckpoint[event.GUID] = true
+			}
+		}
+		instanceGuids := affectedInstances(newEvents)
+		PrintfIfDebug("%d new audit events affect %d service instances\n", len(newEvents), len(instanceGuids))
+		if len(instanceGuids) > 0 {
+			_ = RunSync(SyncTriggerEvents, instanceGuids, conf.SyncDryRun)
+		}
+		if err = saveCheckpoint(checkpoint, handledAtCheckpoint); err != nil {
+			fmt.Println(err)
+		}
+	}
+}
+
+// checkpointFile - The file with the checkpoint of the audit event watcher, next to the registry file (so it is on the same persistent volume)
+func checkpointFile() string {
+	return conf.RegistryFile + ".checkpoint"
+}
+
+// loadCheckpoint - Returns the saved checkpoint with the guids of the events handled at the checkpoint second, or the current time if there is no (valid) checkpoint file
+func loadCheckpoint() (time.Time, map[string]bool) {
+	handledAtCheckpoint := make(map[string]bool)
+	file, err := os.ReadFile(checkpointFile())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			fmt.Printf("failed to read audit event checkpoint file %s, watching events from now on: %s\n", checkpointFile(), err)
+		}
+		return time.Now(), handledAtCheckpoint
+	}
+	var saved watcherCheckpoint
+	if err = json.Unmarshal(file, &saved); err != nil || saved.Checkpoint.IsZero() {
+		fmt.Printf("failed to parse audit event checkpoint file %s, watching events from now on: %v\n", checkpointFile(), err)
+		return time.Now(), handledAtCheckpoint
+	}
+	for _, guid := range saved.Handled {
+		handledAtCheckpoint[guid] = true
+	}
+	fmt.Printf("watching audit events since checkpoint %s\n", saved.Checkpoint.Format(time.RFC3339))
+	return saved.Checkpoint, handledAtCheckpoint
+}
+
+// saveCheckpoint - Writes the checkpoint to a temporary file and renames it to the checkpoint file
+func saveCheckpoint(checkpoint time.Time, handledAtCheckpoint map[string]bool) error {
+	saved := watcherCheckpoint{Checkpoint: checkpoint, Handled: make([]string, 0, len(handledAtCheckpoint))}
+	for guid := range handledAtCheckpoint {
+		saved.Handled = append(saved.Handled, guid)
+	}
+	sort.Strings(saved.Handled)
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit event checkpoint: %s", err)
+	}
+	tmpFile := checkpointFile() + ".tmp"
+	if err = os.WriteFile(tmpFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write audit event checkpoint file %s: %s", tmpFile, err)
+	}
+	if err = os.Rename(tmpFile, checkpointFile()); err != nil {
+		return fmt.Errorf("failed to rename %s to audit event checkpoint file %s: %s", tmpFile, checkpointFile(), err)
+	}
+	return nil
+}
+
+func listAuditEvents(since time.Time) ([]*resource.AuditEvent, error) {
+	listOptions := client.AuditEventListOptions{ListOptions: &client.ListOptions{PerPage: 5000, OrderBy: "created_at"}}
+	listOptions.Types.EqualTo(watchedEventTypes...)
+	listOptions.CreateAts.AfterOrEqualTo(since)
+	return conf.CfClient.AuditEvents.ListAll(conf.CfCtx, &listOptions)
+}
+
+// affectedInstances - Returns the (sorted) guids of the service instances that are affected by the given audit events.
+// Instances that no longer exist are found through the registry, so the sync can delete the policies that were created for them.
+func affectedInstances(events []*resource.AuditEvent) []string {
+	instanceGuids := make(map[string]bool)
+	appGuids := make(map[string]bool)
+	// the spaces where apps were created, deleted or (re)labelled, the space scoped sources and the instances with an app selector in those spaces can have new or fewer members
+	spaceGuids := make(map[string]bool)
+	for _, event := range events {
+		var data model.AuditEventData
+		if event.Data != nil {
+			if err := json.Unmarshal(*event.Data, &data); err != nil {
+				PrintfIfDebug("failed to parse data of audit event %s: %s\n", event.GUID, err)
+			}
+		}
+		switch event.Type {
+		case conf.EventTypeBindingCreate, conf.EventTypeBindingDelete:
+			instanceGuid := data.Request.Relationships.ServiceInstance.Data.Guid
+			if instanceGuid == "" {
+				instanceGuid = data.Request.ServiceInstanceGuid
+			}
+			if instanceGuid == "" {
+				if binding, err := conf.CfClient.ServiceCredentialBindings.Get(conf.CfCtx, event.Target.GUID); err == nil {
+					instanceGuid = binding.Relationships.ServiceInstance.Data.GUID
+				}
+			}
+			if instanceGuid != "" {
+				instanceGuids[instanceGuid] = true
+			}
+			for _, entry := range registry.ForBinding(event.Target.GUID) {
+				instanceGuids[entry.InstanceGuid] = true
+			}
+			if appGuid := data.Request.Relationships.App.Data.Guid; appGuid != "" {
+				appGuids[appGuid] = true
+			} else if data.Request.AppGuid != "" {
+				appGuids[data.Request.AppGuid] = true
+			}
+		case conf.EventTypeInstanceCreate, conf.EventTypeInstanceUpdate, conf.EventTypeInstanceDelete:
+			instanceGuids[event.Target.GUID] = true
+		case conf.EventTypeAppCreate:
+			spaceGuids[event.Space.GUID] = true
+		case conf.EventTypeAppDelete:
+			appGuids[event.Target.GUID] = true
+			spaceGuids[event.Space.GUID] = true
+		case conf.EventTypeAppUpdate:
+			// only a rename or a change of the labels is interesting, other app updates do not change the network policies
+			if data.Request.Name != "" {
+				InvalidateAppName(event.Target.GUID)
+				appGuids[event.Target.GUID] = true
+			}
+			if data.Request.Metadata != nil && len(data.Request.Metadata.Labels) > 0 {
+				appGuids[event.Target.GUID] = true
+				spaceGuids[event.Space.GUID] = true
+			}
+		}
+	}
+	// the policies of an app are registered with the instances of both the source and the destination side
+	if len(appGuids) > 0 {
+		for _, entry := range registry.Entries(func(entry registry.Entry) bool {
+			return appGuids[entry.Policy.Source.Id] || appGuids[entry.Policy.Destination.Id]
+		}) {
+			instanceGuids[entry.InstanceGuid] = true
+		}
+	}
+	for spaceGuid := range spaceGuids {
+		for _, instanceGuid := range implicitMemberInstances(spaceGuid) {
+			instanceGuids[instanceGuid] = true
+		}
+	}
+	result := make([]string, 0, len(instanceGuids))
+	for instanceGuid := range instanceGuids {
+		result = append(result, instanceGuid)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// implicitMemberInstances - Returns the guids of the space scoped source instances and the instances with an app selector in the given space,
+// errors are logged and result in an empty list (the full sync catches up)
+func implicitMemberInstances(spaceGuid string) []string {
+	instanceGuids := make([]string, 0)
+	if spaceGuid == "" {
+		return instanceGuids
+	}
+	scopeLabelSelector := client.LabelSelector{}
+	scopeLabelSelector.EqualTo(conf.LabelNameType, conf.LabelValueTypeSrc)
+	scopeLabelSelector.EqualTo(conf.LabelNameScope, conf.LabelValueScopeSpace)
+	appSelectorLabelSelector := client.LabelSelector{}
+	appSelectorLabelSelector.Existence(conf.LabelNameAppSelector)
+	for _, labelSelector := range []client.LabelSelector{scopeLabelSelector, appSelectorLabelSelector} {
+		instanceListOption := client.ServiceInstanceListOptions{ListOptions: &client.ListOptions{LabelSel: labelSelector}, SpaceGUIDs: client.Filter{Values: []string{spaceGuid}}}
+		instances, err := conf.CfClient.ServiceInstances.ListAll(conf.CfCtx, &instanceListOption)
+		if err != nil {
+			fmt.Printf("failed to list the service instances with implicit members in space %s: %s\n", spaceGuid, err)
+			return make([]string, 0)
+		}
+		for _, instance := range instances {
+			instanceGuids = append(instanceGuids, instance.GUID)
+		}
+	}
+	return instanceGuids
+}
@@ -0,0 +1,41 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/rabobank/npsb/conf"
+)
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	conf.RegistryFile = filepath.Join(t.TempDir(), "registry.json")
+	checkpoint := time.Date(2024, 5, 1, 12, 30, 15, 0, time.UTC)
+	handled := map[string]bool{"event-2": true, "event-1": true}
+	if err := saveCheckpoint(checkpoint, handled); err != nil {
+		t.Fatalf("failed to save checkpoint: %s", err)
+	}
+	loaded, loadedHandled := loadCheckpoint()
+	if !loaded.Equal(checkpoint) {
+		t.Errorf("expected checkpoint %s, got %s", checkpoint, loaded)
+	}
+	if !reflect.DeepEqual(loadedHandled, handled) {
+		t.Errorf("expected handled events %v, got %v", handled, loadedHandled)
+	}
+}
+
+func TestCheckpointMissingOrCorrupt(t *testing.T) {
+	conf.RegistryFile = filepath.Join(t.TempDir(), "registry.json")
+	before := time.Now()
+	if loaded, handled := loadCheckpoint(); loaded.Before(before) || len(handled) != 0 {
+		t.Errorf("expected the current time without handled events without a checkpoint file, got %s and %v", loaded, handled)
+	}
+	if err := os.WriteFile(checkpointFile(), []byte("not json"), 0644); err != nil {
+		t.Fatalf("failed to write checkpoint file: %s", err)
+	}
+	if loaded, handled := loadCheckpoint(); loaded.Before(before) || len(handled) != 0 {
+		t.Errorf("expected the current time without handled events with a corrupt checkpoint file, got %s and %v", loaded, handled)
+	}
+}